@@ -0,0 +1,459 @@
+package ipfsKeystoneTest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ==================================================================================
+//				Authenticated Block Encryption
+// ==================================================================================
+
+// CipherAESGCM 的密文由帧组成：enclave 的输出按 DefaultBlockSize 分块，每块封装为
+// nonce || AES-GCM(块) || 标签，最后一块可以更短。附加数据是块序号和是否为最后一块，
+// 交换、删除、截断或者追加块都会在对应的块上认证失败。空文件也有一个空的最后一块
+const (
+	aeadNonceSize = 12
+	aeadTagSize   = 16
+	// AEADOverhead 是每块增加的字节数
+	AEADOverhead = aeadNonceSize + aeadTagSize
+	// AEADFrameSize 是完整块封装之后的长度
+	AEADFrameSize = DefaultBlockSize + AEADOverhead
+)
+
+// AEADCiphertextSize 返回 enclave 输出 n 字节时 CipherAESGCM 密文的长度，
+// 使用 KeyManager 时还要加上 EnvelopeHeaderSize
+func AEADCiphertextSize(n int64) int64 {
+	blocks := (n + DefaultBlockSize - 1) / DefaultBlockSize
+	if blocks == 0 {
+		blocks = 1
+	}
+	return n + blocks*AEADOverhead
+}
+
+// aeadPlainSize 返回 CipherAESGCM 密文去掉帧之后的长度，长度不可能是一串帧时返回 false
+func aeadPlainSize(n int64) (int64, bool) {
+	full, rem := n/AEADFrameSize, n%AEADFrameSize
+	switch {
+	case rem == 0 && full > 0:
+		return full * DefaultBlockSize, true
+	case rem >= AEADOverhead:
+		return full*DefaultBlockSize + rem - AEADOverhead, true
+	}
+	return 0, false
+}
+
+// aeadBlockCount 返回 n 字节的 CipherAESGCM 密文中的帧数
+func aeadBlockCount(n int64) int64 {
+	return (n + AEADFrameSize - 1) / AEADFrameSize
+}
+
+// blockAEAD 封装和验证单个帧
+type blockAEAD struct {
+	gcm cipher.AEAD
+}
+
+func newBlockAEAD(key []byte) (*blockAEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &blockAEAD{gcm: gcm}, nil
+}
+
+// blockAD 返回第 index 块的附加数据
+func blockAD(index int64, final bool) []byte {
+	var ad [9]byte
+	binary.BigEndian.PutUint64(ad[:8], uint64(index))
+	if final {
+		ad[8] = 1
+	}
+	return ad[:]
+}
+
+// seal 把 pt 封装为第 index 块的帧，追加到 dst 之后
+func (a *blockAEAD) seal(dst []byte, index int64, final bool, pt []byte) ([]byte, error) {
+	var nonce [aeadNonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce[:]...)
+	return a.gcm.Seal(dst, nonce[:], pt, blockAD(index, final)), nil
+}
+
+// open 验证第 index 块的帧，把内容追加到 dst 之后，失败时返回 *IntegrityError
+func (a *blockAEAD) open(dst []byte, index int64, final bool, frame []byte) ([]byte, error) {
+	if len(frame) < AEADOverhead {
+		return nil, &IntegrityError{Block: index, Reason: "truncated block"}
+	}
+	out, err := a.gcm.Open(dst, frame[:aeadNonceSize], frame[aeadNonceSize:], blockAD(index, final))
+	if err != nil {
+		return nil, &IntegrityError{Block: index, Reason: "authentication failed"}
+	}
+	return out, nil
+}
+
+// ==================================================================================
+//				AEAD backend
+// ==================================================================================
+
+// aeadBackend 在 Backend 的数据流外面封装和验证帧，enclave 看到的仍然是不带帧的数据
+type aeadBackend struct {
+	Backend
+	a  *blockAEAD // WithKey 的密钥，km 不为 nil 时不使用
+	km KeyManager // 不为 nil 时每个文件使用新的数据密钥，密文以信封头开始
+}
+
+// newAEADBackend 使用 o.Key，没有设置时使用 o.KeyManager 或 DefaultKeyManager
+func newAEADBackend(b Backend, o Options) (*aeadBackend, error) {
+	if o.Key != nil {
+		a, err := newBlockAEAD(o.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &aeadBackend{Backend: b, a: a}, nil
+	}
+	km := o.KeyManager
+	if km == nil {
+		var err error
+		if km, err = DefaultKeyManager(); err != nil {
+			return nil, err
+		}
+	}
+	return &aeadBackend{Backend: b, km: km}, nil
+}
+
+// sealer 返回加密一个文件使用的 blockAEAD 和写在密文开头的信封头
+func (b *aeadBackend) sealer() (*blockAEAD, []byte, error) {
+	if b.km == nil {
+		return b.a, nil, nil
+	}
+	return newEnvelope(b.km)
+}
+
+// plainSize 返回 n 字节密文中 enclave 的输入长度
+func (b *aeadBackend) plainSize(n int64) (int64, error) {
+	if b.km != nil {
+		if n < EnvelopeHeaderSize {
+			return 0, fmt.Errorf("%w: %d of %d bytes", ErrEnvelope, n, EnvelopeHeaderSize)
+		}
+		n -= EnvelopeHeaderSize
+	}
+	plain, ok := aeadPlainSize(n)
+	if !ok {
+		return 0, &IntegrityError{Block: aeadBlockCount(n) - 1, Reason: "truncated block"}
+	}
+	return plain, nil
+}
+
+func (b *aeadBackend) OpenEncrypt(req Request) (Stream, error) {
+	a, header, err := b.sealer()
+	if err != nil {
+		return nil, err
+	}
+	s, err := b.Backend.OpenEncrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADSealStream(s, a, header), nil
+}
+
+func (b *aeadBackend) OpenDecrypt(req Request) (Stream, error) {
+	inner := req
+	if req.Size > 0 {
+		n, err := b.plainSize(req.Size)
+		if err != nil {
+			return nil, err
+		}
+		inner.Size = n
+	}
+	s, err := b.Backend.OpenDecrypt(inner)
+	if err != nil {
+		return nil, err
+	}
+	return newAEADOpenStream(s, b.a, b.km), nil
+}
+
+func (b *aeadBackend) OpenEncryptSession(req Request) (Session, error) {
+	ss, err := b.Backend.OpenEncryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadSession{ss: ss, b: b}, nil
+}
+
+func (b *aeadBackend) OpenDecryptSession(req Request) (Session, error) {
+	ss, err := b.Backend.OpenDecryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadSession{ss: ss, b: b}, nil
+}
+
+type aeadSession struct {
+	ss Session
+	b  *aeadBackend
+}
+
+func (ss *aeadSession) WaitReady() error { return ss.ss.WaitReady() }
+
+func (ss *aeadSession) NextEncrypt(path string, size int64) (Stream, error) {
+	a, header, err := ss.b.sealer()
+	if err != nil {
+		return nil, err
+	}
+	s, err := ss.ss.NextEncrypt(path, size)
+	if err != nil || s == nil {
+		return s, err
+	}
+	return newAEADSealStream(s, a, header), nil
+}
+
+func (ss *aeadSession) NextDecrypt(size uint64) (Stream, error) {
+	n, err := ss.b.plainSize(int64(size))
+	if err != nil {
+		return nil, err
+	}
+	s, err := ss.ss.NextDecrypt(uint64(n))
+	if err != nil || s == nil {
+		return s, err
+	}
+	return newAEADOpenStream(s, ss.b.a, ss.b.km), nil
+}
+
+func (ss *aeadSession) End() error { return ss.ss.End() }
+
+func (ss *aeadSession) Abort() error { return ss.ss.Abort() }
+
+func (ss *aeadSession) Workers() []WorkerStatus { return sessionWorkers(ss.ss) }
+
+// monitoredStream 把子进程状态的查询转发给被封装的数据流，ctxStream 仍然可以发现子进程崩溃
+type monitoredStream struct {
+	Stream
+}
+
+func (s monitoredStream) Workers() []WorkerStatus {
+	if m, ok := s.Stream.(workerMonitor); ok {
+		return m.Workers()
+	}
+	return nil
+}
+
+func (s monitoredStream) Crashed() <-chan struct{} {
+	if m, ok := s.Stream.(workerMonitor); ok {
+		return m.Crashed()
+	}
+	return nil
+}
+
+func (s monitoredStream) CrashErr() error {
+	if m, ok := s.Stream.(workerMonitor); ok {
+		return m.CrashErr()
+	}
+	return nil
+}
+
+// aeadSealStream 把 enclave 的输出凑成完整的块再封装。块满了之后要等读到下一字节才知道
+// 它是不是最后一块，所以缓冲区比一块多一字节。有信封头时先读出信封头
+type aeadSealStream struct {
+	monitoredStream
+	a     *blockAEAD
+	buf   []byte // 还没有封装的 enclave 输出
+	frame []byte // 封装好的帧
+	out   []byte // frame 中还没有读出的部分
+	index int64
+	eof   bool // enclave 的输出已经读完
+	final bool // 最后一帧已经封装
+}
+
+func newAEADSealStream(s Stream, a *blockAEAD, header []byte) *aeadSealStream {
+	return &aeadSealStream{
+		monitoredStream: monitoredStream{s},
+		a:               a,
+		buf:             make([]byte, 0, DefaultBlockSize+1),
+		frame:           make([]byte, 0, AEADFrameSize),
+		out:             header,
+	}
+}
+
+func (s *aeadSealStream) ReadBlock(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.final {
+			return 0, io.EOF
+		}
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+// fill 读到多于一块或者 enclave 结束，封装出下一帧
+func (s *aeadSealStream) fill() error {
+	for !s.eof && len(s.buf) <= DefaultBlockSize {
+		n, err := s.Stream.ReadBlock(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+n]
+		if err == io.EOF {
+			s.eof = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	n := min(len(s.buf), DefaultBlockSize)
+	final := s.eof && len(s.buf) <= DefaultBlockSize
+	frame, err := s.a.seal(s.frame[:0], s.index, final, s.buf[:n])
+	if err != nil {
+		return err
+	}
+	s.index++
+	s.final = final
+	s.out = frame
+	s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+	return nil
+}
+
+// aeadOpenStream 验证写入的帧，把内容交给 enclave。帧满了之后要等写入下一字节才知道
+// 它是不是最后一块，最后一帧在 WaitDone 中验证。使用 KeyManager 时先收齐信封头，取回数据密钥
+type aeadOpenStream struct {
+	monitoredStream
+	a       *blockAEAD // 收到信封头之前为 nil
+	km      KeyManager
+	pending []byte // 还没有验证的帧
+	plain   []byte
+	index   int64
+	err     error // 验证失败之后所有写入都返回这个错误
+	done    bool  // 最后一帧已经验证
+}
+
+func newAEADOpenStream(s Stream, a *blockAEAD, km KeyManager) *aeadOpenStream {
+	if km != nil {
+		a = nil
+	}
+	return &aeadOpenStream{
+		monitoredStream: monitoredStream{s},
+		a:               a,
+		km:              km,
+		pending:         make([]byte, 0, 2*AEADFrameSize),
+		plain:           make([]byte, 0, DefaultBlockSize),
+	}
+}
+
+func (s *aeadOpenStream) WriteBlock(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.pending = append(s.pending, p...)
+	rest := s.pending
+	if s.a == nil {
+		if len(rest) < EnvelopeHeaderSize {
+			return len(p), nil
+		}
+		if err := s.openHeader(rest[:EnvelopeHeaderSize]); err != nil {
+			return 0, err
+		}
+		rest = rest[EnvelopeHeaderSize:]
+	}
+	for len(rest) > AEADFrameSize {
+		if err := s.openNext(rest[:AEADFrameSize], false); err != nil {
+			return 0, err
+		}
+		rest = rest[AEADFrameSize:]
+	}
+	s.pending = s.pending[:copy(s.pending, rest)]
+	return len(p), nil
+}
+
+// openHeader 从信封头取回数据密钥，失败时停止 enclave
+func (s *aeadOpenStream) openHeader(h []byte) error {
+	a, err := openEnvelope(s.km, h)
+	if err != nil {
+		s.err = err
+		s.Stream.Abort()
+		return err
+	}
+	s.a = a
+	return nil
+}
+
+// openNext 验证一帧并写给 enclave，验证失败时停止 enclave
+func (s *aeadOpenStream) openNext(frame []byte, final bool) error {
+	plain, err := s.a.open(s.plain[:0], s.index, final, frame)
+	if err != nil {
+		s.err = err
+		s.Stream.Abort()
+		return err
+	}
+	s.index++
+	for len(plain) > 0 {
+		n, err := s.Stream.WriteBlock(plain)
+		if err != nil {
+			return err
+		}
+		plain = plain[n:]
+	}
+	return nil
+}
+
+// WaitDone 验证最后一帧，验证失败时仍然等待 enclave 结束，返回完整性错误
+func (s *aeadOpenStream) WaitDone() error {
+	err := s.err
+	if err == nil && !s.done {
+		s.done = true
+		if s.a == nil {
+			err = s.openHeader(s.pending)
+		}
+		if err == nil {
+			err = s.openNext(s.pending, true)
+		}
+		s.pending = s.pending[:0]
+	}
+	if werr := s.Stream.WaitDone(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// ==================================================================================
+//				AEAD Encrypt
+// ==================================================================================
+
+// AEADSealBlock 用 KeystoneAES 加密 pt，再用 key 封装为第 index 块的帧，
+// final 表示这是文件的最后一块。与 CipherAESGCM 的数据流使用相同的帧格式
+func AEADSealBlock(key []byte, index int64, final bool, pt []byte) ([]byte, error) {
+	a, err := newBlockAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := KeystoneAES{}.Seal(nil, pt)
+	if err != nil {
+		return nil, err
+	}
+	return a.seal(nil, index, final, ct)
+}
+
+// AEADOpenBlock 验证 AEADSealBlock 生成的帧并用 KeystoneAES 解密，
+// 帧被篡改或者 index、final 不一致时返回 *IntegrityError
+func AEADOpenBlock(key []byte, index int64, final bool, frame []byte) ([]byte, error) {
+	a, err := newBlockAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := a.open(nil, index, final, frame)
+	if err != nil {
+		return nil, err
+	}
+	return KeystoneAES{}.Open(nil, ct)
+}
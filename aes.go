@@ -0,0 +1,65 @@
+package ipfsKeystoneTest
+
+import (
+	"fmt"
+)
+
+// ==================================================================================
+//				AES Seal / Open
+// ==================================================================================
+
+// libipfs_keystone 的 encrypt / decrypt（ipfs_aes.h）是 AES-CBC 加 PKCS#7 填充，密钥和 IV 编译在库中。
+// 密文总比明文长 1 到 16 字节，所以 KeystoneAES 不实现 cipher.BlockMode；
+// 没有 nonce 也不认证，所以也不实现 cipher.AEAD，需要认证时使用 CipherAESGCM 的帧
+const aesBlockSize = 16
+
+// aesSealedSize 返回 n 字节明文填充之后的密文长度
+func aesSealedSize(n int) int {
+	return (n/aesBlockSize + 1) * aesBlockSize
+}
+
+// KeystoneAES 在 Rv_AES_Encrypt / Rv_AES_Decrypt 外面计算缓冲区长度并返回错误，
+// 零值可以直接使用，可以并发调用
+type KeystoneAES struct{}
+
+// SealedSize 返回 n 字节明文加密之后的长度
+func (KeystoneAES) SealedSize(n int) int { return aesSealedSize(n) }
+
+// Seal 加密 plaintext，把密文追加到 dst 之后返回。plaintext 可以为空，
+// dst 的剩余容量不够时重新分配，dst 和 plaintext 不能重叠
+func (KeystoneAES) Seal(dst, plaintext []byte) ([]byte, error) {
+	ret, out := sliceForAppend(dst, aesSealedSize(len(plaintext)))
+	n := Rv_AES_Encrypt(plaintext, len(plaintext), out)
+	if n != len(out) {
+		return nil, fmt.Errorf("%w: encrypt %d bytes returned %d", ErrCipher, len(plaintext), n)
+	}
+	return ret, nil
+}
+
+// Open 解密 Seal 生成的密文，把明文追加到 dst 之后返回。密文长度不是 16 的正整数倍
+// 或者填充无效时返回 ErrCipher，dst 和 ciphertext 不能重叠
+func (KeystoneAES) Open(dst, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aesBlockSize != 0 {
+		return nil, fmt.Errorf("%w: ciphertext length %d is not a positive multiple of %d", ErrCipher, len(ciphertext), aesBlockSize)
+	}
+	// C 函数去掉填充之前写出整个密文长度
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	n := Rv_AES_Decrypt(ciphertext, len(ciphertext), out)
+	if n < 0 || n > len(out) || len(ciphertext)-n > aesBlockSize {
+		return nil, fmt.Errorf("%w: decrypt returned %d", ErrCipher, n)
+	}
+	return ret[:len(dst)+n], nil
+}
+
+// sliceForAppend 与 crypto/cipher 中的同名函数相同：把 in 扩展 n 字节，
+// 返回扩展后的切片和新增的部分
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
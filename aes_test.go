@@ -0,0 +1,60 @@
+//go:build !keystone
+
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestKeystoneAESRoundTrip(t *testing.T) {
+	var a KeystoneAES
+	prefix := []byte("prefix")
+	for _, n := range []int{0, 1, 15, 16, 17, 100, DefaultBlockSize} {
+		pt := make([]byte, n)
+		if _, err := rand.Read(pt); err != nil {
+			t.Fatal(err)
+		}
+
+		ct, err := a.Seal(nil, pt)
+		if err != nil {
+			t.Fatalf("Seal(%d bytes): %v", n, err)
+		}
+		if len(ct) != a.SealedSize(n) || len(ct) <= n || len(ct)-n > aesBlockSize || len(ct)%aesBlockSize != 0 {
+			t.Fatalf("Seal(%d bytes) returned %d bytes, SealedSize %d", n, len(ct), a.SealedSize(n))
+		}
+		got, err := a.Open(nil, ct)
+		if err != nil || !bytes.Equal(got, pt) {
+			t.Fatalf("Open(Seal(%d bytes)): %d bytes, %v", n, len(got), err)
+		}
+
+		// 追加到 dst 之后，容量足够时不重新分配
+		for _, dst := range [][]byte{
+			append([]byte(nil), prefix...),
+			append(make([]byte, 0, len(prefix)+a.SealedSize(n)), prefix...),
+		} {
+			sealed, err := a.Seal(dst, pt)
+			if err != nil || !bytes.Equal(sealed[:len(prefix)], prefix) || !bytes.Equal(sealed[len(prefix):], ct) {
+				t.Fatalf("Seal(%d bytes) after a prefix: %v", n, err)
+			}
+			if cap(dst) >= len(sealed) && &sealed[0] != &dst[0] {
+				t.Fatalf("Seal(%d bytes) reallocated dst with enough capacity", n)
+			}
+			opened, err := a.Open(dst, ct)
+			if err != nil || !bytes.Equal(opened[:len(prefix)], prefix) || !bytes.Equal(opened[len(prefix):], pt) {
+				t.Fatalf("Open(%d bytes) after a prefix: %v", n, err)
+			}
+		}
+	}
+}
+
+func TestKeystoneAESOpenRejectsBadLength(t *testing.T) {
+	var a KeystoneAES
+	for _, n := range []int{0, 1, 15, 17, 31} {
+		if out, err := a.Open(nil, make([]byte, n)); !errors.Is(err, ErrCipher) || out != nil {
+			t.Errorf("Open(%d bytes) = %d bytes, %v, want ErrCipher", n, len(out), err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package ipfsKeystoneTest
+
+import (
+	"io"
+	"sync"
+)
+
+// Mode 标识调用 enclave 的方式，对应 ipfs-keystone.go 中的各个分区
+type Mode int
+
+const (
+	ModeSingle         Mode = iota // 单个 enclave，通过 RingBuffer 传输
+	ModeMultiThreaded              // 单进程内两个线程各处理一半
+	ModeMultiProcess               // 两个子进程各处理一半
+	ModeCross                      // 两个子进程交叉读取
+	ModeCrossFlexible              // flexible 个子进程交叉读取
+	ModeDispatch                   // 调度器向 flexible 个 enclave 分发数据块
+	ModeSecureDispatch             // 单块共享内存的 secure dispatch
+)
+
+// Request 描述一次打开数据流或会话所需的参数
+type Request struct {
+	Mode       Mode
+	IsAES      int
+	Path       string    // 加密时为源文件路径，解密时为输出文件路径
+	Source     io.Reader `json:"-"` // 加密时不为 nil 则从 Source 读明文，不使用 Path；录制时不保存
+	Sink       io.Writer `json:"-"` // 解密时不为 nil 则明文写到 Sink，不使用 Path；录制时不保存
+	Size       int64     // 文件大小
+	FirstBlock int64     // 单 enclave 解密时写入的第一个块的序号，模拟后端的计数器从这一块开始
+	Flexible   int       // enclave 数量
+	Config     *Config   // 子进程的位置和参数，为 nil 时由后端决定
+}
+
+// Stream 是后端中的一条加密或解密数据流。
+// 加密流只支持 ReadBlock，解密流只支持 WriteBlock
+type Stream interface {
+	ReadBlock(p []byte) (int, error)  // 从 enclave 读取输出，结束时返回 io.EOF
+	WriteBlock(p []byte) (int, error) // 向 enclave 写入输入
+	WaitReady() error                 // 等待 enclave 就绪
+	WaitDone() error                  // 通知输入结束并等待 enclave 处理完成
+	Abort() error                     // 停止缓冲区并杀死子进程，阻塞中的调用尽快返回
+	Close() error                     // 释放缓冲区和共享内存
+}
+
+// blockReader 由能直接交出已经完成的块的加密流实现，WriteTo 把块交给 io.Writer，不再复制
+type blockReader interface {
+	// NextBlock 返回下一个完成的块中还没有读出的部分，全部读完时返回 io.EOF。
+	// 切片在数据流关闭之前有效，调用方不能修改
+	NextBlock() ([]byte, error)
+}
+
+// blockWriter 由能直接交出待填充块槽的解密流实现，ReadFrom 把输入直接读进块槽
+type blockWriter interface {
+	// NextSlot 返回当前块还没有填充的部分，不再需要输入时返回长度为 0 的切片
+	NextSlot() ([]byte, error)
+	// CommitSlot 提交 NextSlot 返回的切片中已经填充的前 n 字节，块填满之后交给 enclave
+	CommitSlot(n int) error
+}
+
+// Session 对应 the new dir 系列：enclave 只启动一次，依次处理多个文件
+type Session interface {
+	WaitReady() error
+	NextEncrypt(path string, size int64) (Stream, error)
+	NextDecrypt(size uint64) (Stream, error)
+	End() error   // 通知 enclave 没有更多文件
+	Abort() error // 停止缓冲区并杀死子进程
+}
+
+// Backend 负责创建数据流。CgoBackend 调用 libipfs_keystone.a，
+// SimBackend 用纯 Go 模拟，RecordingBackend 和 ReplayBackend 用于测试
+type Backend interface {
+	OpenEncrypt(req Request) (Stream, error)
+	OpenDecrypt(req Request) (Stream, error)
+	OpenEncryptSession(req Request) (Session, error)
+	OpenDecryptSession(req Request) (Session, error)
+}
+
+var (
+	backendMu      sync.RWMutex
+	defaultBackend = builtinBackend()
+)
+
+// DefaultBackend 返回新建读写器时使用的后端
+func DefaultBackend() Backend {
+	backendMu.RLock()
+	defer backendMu.RUnlock()
+	return defaultBackend
+}
+
+// SetDefaultBackend 设置之后新建的读写器使用的后端，已经创建的读写器不受影响。
+// b 为 nil 时恢复为构建时选择的后端（-tags keystone 时为 CgoBackend，否则为 SimBackend）
+func SetDefaultBackend(b Backend) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if b == nil {
+		b = builtinBackend()
+	}
+	defaultBackend = b
+}
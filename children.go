@@ -0,0 +1,132 @@
+package ipfsKeystoneTest
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// WorkerStatus 是一个 enclave 子进程的状态
+type WorkerStatus struct {
+	Path   string // 子进程的可执行文件
+	PID    int
+	Exited bool  // 子进程已经退出并被回收
+	Err    error // 退出状态，正常退出时为 nil，还在等输入时正常退出为 errExitedEarly
+}
+
+// errExitedEarly 是子进程在数据流结束之前以状态 0 退出时记录的错误
+var errExitedEarly = errors.New("exited before the stream finished")
+
+// workerMonitor 由启动了子进程的数据流和会话实现
+type workerMonitor interface {
+	Workers() []WorkerStatus
+	Crashed() <-chan struct{} // 有子进程非正常退出时关闭
+	CrashErr() error
+}
+
+// sessionWorkers 返回会话的子进程状态，没有子进程时为 nil
+func sessionWorkers(ss Session) []WorkerStatus {
+	if m, ok := ss.(workerMonitor); ok {
+		return m.Workers()
+	}
+	return nil
+}
+
+// children 监督一条数据流或一个会话启动的 enclave 子进程：
+// 每个子进程由一个 goroutine 调用 Wait 回收，记录退出状态，
+// 在 kill 之前非正常退出的子进程视为崩溃，通过 Crashed 通知阻塞中的读写。
+// 子进程还在等父进程的输入时正常退出也是崩溃，父进程不会再等到它的输出；
+// 数据流在子进程不再需要输入之后调用 release
+type children struct {
+	mu       sync.Mutex
+	cmds     []*exec.Cmd
+	status   []WorkerStatus
+	killed   bool
+	released bool // 子进程不再需要父进程，正常退出不算崩溃
+	crashed  chan struct{}
+	crash    error
+	reaped   sync.WaitGroup
+	once     sync.Once
+}
+
+// start 依次启动子进程，某个子进程启动失败时杀死并回收已经启动的子进程
+func (c *children) start(cmds ...*exec.Cmd) error {
+	c.crashed = make(chan struct{})
+	for i, cmd := range cmds {
+		if err := startProcess(cmd); err != nil {
+			c.kill()
+			return fmt.Errorf("%w: %s (%d of %d): %w", ErrChildStart, cmd.Path, i+1, len(cmds), err)
+		}
+
+		c.mu.Lock()
+		c.cmds = append(c.cmds, cmd)
+		c.status = append(c.status, WorkerStatus{Path: cmd.Path, PID: cmd.Process.Pid})
+		c.mu.Unlock()
+
+		c.reaped.Add(1)
+		go c.wait(i, cmd)
+	}
+	return nil
+}
+
+// wait 回收第 i 个子进程并记录退出状态
+func (c *children) wait(i int, cmd *exec.Cmd) {
+	defer c.reaped.Done()
+	err := cmd.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status[i].Exited = true
+	if err == nil && !c.released && !c.killed {
+		err = errExitedEarly
+	}
+	c.status[i].Err = err
+	if err != nil && !c.killed && c.crash == nil {
+		c.crash = fmt.Errorf("%w: %s (pid %d): %w", ErrEnclaveAborted, cmd.Path, cmd.Process.Pid, err)
+		close(c.crashed)
+	}
+}
+
+// release 表示子进程已经拿到全部输入，之后可以自己正常退出。
+// 必须在交出最后的输入之前调用，否则子进程可能抢在前面退出
+func (c *children) release() {
+	c.mu.Lock()
+	c.released = true
+	c.mu.Unlock()
+}
+
+// kill 杀死还在运行的子进程并等待全部回收，可以多次调用
+func (c *children) kill() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.killed = true
+		for i, cmd := range c.cmds {
+			if !c.status[i].Exited {
+				cmd.Process.Kill()
+			}
+		}
+		c.mu.Unlock()
+	})
+	c.reaped.Wait()
+}
+
+// Workers 返回所有子进程的状态
+func (c *children) Workers() []WorkerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]WorkerStatus(nil), c.status...)
+}
+
+// Crashed 返回的通道在有子进程崩溃时关闭，没有启动子进程时为 nil
+func (c *children) Crashed() <-chan struct{} {
+	return c.crashed
+}
+
+// CrashErr 返回第一个崩溃的子进程的错误，包装了 ErrEnclaveAborted
+func (c *children) CrashErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.crash
+}
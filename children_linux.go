@@ -0,0 +1,42 @@
+package ipfsKeystoneTest
+
+import (
+	"os/exec"
+	"runtime"
+	"sync"
+	"syscall"
+)
+
+// Pdeathsig 在 fork 子进程的线程退出时就会触发，而不是父进程退出时。
+// 所有子进程都从一个锁定在自己线程上、永不返回的 goroutine 中启动，
+// 避免 Go 运行时回收线程时杀死 enclave 子进程
+var (
+	forkOnce  sync.Once
+	forkCalls chan func()
+)
+
+// setPdeathsig 让子进程在父进程退出时收到 SIGKILL，避免 enclave 子进程变成孤儿
+func setPdeathsig(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
+
+// startProcess 在 fork 专用的线程上启动 cmd
+func startProcess(cmd *exec.Cmd) error {
+	forkOnce.Do(func() {
+		forkCalls = make(chan func())
+		go func() {
+			runtime.LockOSThread()
+			for fn := range forkCalls {
+				fn()
+			}
+		}()
+	})
+
+	setPdeathsig(cmd)
+	errc := make(chan error, 1)
+	forkCalls <- func() { errc <- cmd.Start() }
+	return <-errc
+}
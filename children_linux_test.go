@@ -0,0 +1,65 @@
+package ipfsKeystoneTest
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 调用 start 的线程退出之后子进程必须继续运行
+func TestChildrenSurviveStartingThread(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip(err)
+	}
+
+	var c children
+	c.release()
+	defer c.kill()
+
+	// 主线程不会退出，锁住主线程的 goroutine 一直等到测试结束
+	hold := make(chan struct{})
+	defer close(hold)
+	type started struct {
+		tid int
+		err error
+	}
+	var st started
+	for {
+		ch := make(chan started)
+		go func() {
+			// 锁定线程的 goroutine 返回时线程随之退出
+			runtime.LockOSThread()
+			tid := syscall.Gettid()
+			if tid == os.Getpid() {
+				ch <- started{tid: -1}
+				<-hold
+				return
+			}
+			ch <- started{tid, c.start(exec.Command("sleep", "30"))}
+		}()
+		if st = <-ch; st.tid != -1 {
+			break
+		}
+	}
+	if st.err != nil {
+		t.Fatal(st.err)
+	}
+
+	task := fmt.Sprintf("/proc/self/task/%d", st.tid)
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(task); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Skip("starting thread did not exit")
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if ws := c.Workers(); ws[0].Exited {
+		t.Fatalf("worker died with the starting thread: %v", ws[0].Err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ipfsKeystoneTest
+
+import "os/exec"
+
+// 只有 Linux 支持 Pdeathsig，其他系统上依靠 Close 杀死子进程
+func startProcess(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
@@ -0,0 +1,48 @@
+package ipfsKeystoneTest
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestChildrenExitBeforeRelease(t *testing.T) {
+	if _, err := exec.LookPath("true"); err != nil {
+		t.Skip(err)
+	}
+
+	// 还在等输入时正常退出是崩溃
+	var c children
+	if err := c.start(exec.Command("true")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Crashed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("clean exit before release was not reported")
+	}
+	if err := c.CrashErr(); !errors.Is(err, ErrEnclaveAborted) || !errors.Is(err, errExitedEarly) {
+		t.Fatalf("CrashErr: %v", err)
+	}
+	if st := c.Workers(); !st[0].Exited || !errors.Is(st[0].Err, errExitedEarly) {
+		t.Fatalf("Workers: %+v", st)
+	}
+	c.kill()
+
+	// release 之后正常退出不是崩溃
+	var r children
+	r.release()
+	if err := r.start(exec.Command("true")); err != nil {
+		t.Fatal(err)
+	}
+	r.reaped.Wait()
+	select {
+	case <-r.Crashed():
+		t.Fatalf("clean exit after release reported: %v", r.CrashErr())
+	default:
+	}
+	if st := r.Workers(); !st[0].Exited || st[0].Err != nil {
+		t.Fatalf("Workers: %+v", st)
+	}
+}
@@ -0,0 +1,40 @@
+// keystone-janitor 列出 ipfs-keystone 创建的 System V 共享内存段，删除创建者已经退出的孤儿。
+//
+//	keystone-janitor          删除孤儿
+//	keystone-janitor -n       只列出，不删除
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	ipfsKeystoneTest "github.com/of-night/ipfs-keystone-test"
+)
+
+func main() {
+	dryRun := flag.Bool("n", false, "list segments without removing orphans")
+	flag.Parse()
+
+	j := ipfsKeystoneTest.Janitor{DryRun: *dryRun}
+	segs, err := j.Scan()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range segs {
+		fmt.Println(s)
+	}
+	if *dryRun {
+		return
+	}
+
+	removed, err := j.Clean()
+	for _, s := range removed {
+		fmt.Printf("removed shmid %d\n", s.ID)
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,163 @@
+package ipfsKeystoneTest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Worker 是 enclave 子进程可执行文件的默认名字
+type Worker string
+
+const (
+	WorkerMultiProcess      Worker = "child_process"
+	WorkerCross             Worker = "cross_child_process"
+	WorkerCrossFlexible     Worker = "flexible_cross_child_process"
+	WorkerDispatch          Worker = "dispath_child_process"
+	WorkerSecureDispatch    Worker = "secure_dispatch_child_process"
+	WorkerDirSecureDispatch Worker = "the_new_dir_secure_dispatch_child_process"
+	WorkerDirCrossFlexible  Worker = "the_new_dir_flexible_cross_child_process"
+)
+
+const (
+	envWorkerDir  = "IPFS_KEYSTONE_WORKER_DIR"
+	envPrefix     = "IPFS_KEYSTONE_"
+	envArgsSuffix = "_ARGS"
+)
+
+// allWorkers 列出所有子进程，ConfigFromEnv 按它读取环境变量
+var allWorkers = []Worker{
+	WorkerMultiProcess,
+	WorkerCross,
+	WorkerCrossFlexible,
+	WorkerDispatch,
+	WorkerSecureDispatch,
+	WorkerDirSecureDispatch,
+	WorkerDirCrossFlexible,
+}
+
+// Config 描述到哪里找 enclave 子进程以及启动时追加的参数
+type Config struct {
+	// WorkerDirs 是查找子进程的目录，按顺序使用第一个存在且可执行的文件。
+	// 为空时依次查找当前目录和当前程序所在的目录
+	WorkerDirs []string
+	// Binaries 替换子进程的文件名，可以是绝对路径
+	Binaries map[Worker]string
+	// ExtraArgs 追加在子进程默认参数之后
+	ExtraArgs map[Worker][]string
+}
+
+// ConfigFromEnv 从环境变量读取配置：
+//
+//	IPFS_KEYSTONE_WORKER_DIR           查找子进程的目录，多个目录用 ':' 分隔
+//	IPFS_KEYSTONE_<WORKER>             子进程的文件名，例如 IPFS_KEYSTONE_DISPATH_CHILD_PROCESS
+//	IPFS_KEYSTONE_<WORKER>_ARGS        追加的参数，用空格分隔
+func ConfigFromEnv() Config {
+	var c Config
+	if dirs := os.Getenv(envWorkerDir); dirs != "" {
+		c.WorkerDirs = filepath.SplitList(dirs)
+	}
+	for _, w := range allWorkers {
+		key := envPrefix + strings.ToUpper(string(w))
+		if name := os.Getenv(key); name != "" {
+			if c.Binaries == nil {
+				c.Binaries = make(map[Worker]string)
+			}
+			c.Binaries[w] = name
+		}
+		if args := os.Getenv(key + envArgsSuffix); args != "" {
+			if c.ExtraArgs == nil {
+				c.ExtraArgs = make(map[Worker][]string)
+			}
+			c.ExtraArgs[w] = strings.Fields(args)
+		}
+	}
+	return c
+}
+
+var (
+	configMu      sync.RWMutex
+	defaultConfig = ConfigFromEnv()
+)
+
+// DefaultConfig 返回 CgoBackend 没有指定 Config 时使用的配置，初始值由 ConfigFromEnv 读取
+func DefaultConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return defaultConfig
+}
+
+// SetDefaultConfig 设置之后启动的子进程使用的配置
+func SetDefaultConfig(c Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	defaultConfig = c
+}
+
+// dirs 返回查找子进程的目录
+func (c Config) dirs() []string {
+	if len(c.WorkerDirs) > 0 {
+		return c.WorkerDirs
+	}
+	dirs := []string{"."}
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	return dirs
+}
+
+// WorkerPath 查找子进程 w 的可执行文件，文件不存在或没有执行权限时返回包装了 ErrWorkerBinary 的错误
+func (c Config) WorkerPath(w Worker) (string, error) {
+	name := string(w)
+	if b := c.Binaries[w]; b != "" {
+		name = b
+	}
+
+	var candidates []string
+	if filepath.IsAbs(name) {
+		candidates = []string{name}
+	} else {
+		for _, dir := range c.dirs() {
+			p := filepath.Join(dir, name)
+			if !strings.ContainsRune(p, filepath.Separator) {
+				// exec.Command 会在 PATH 中查找不含路径分隔符的名字
+				p = "." + string(filepath.Separator) + p
+			}
+			candidates = append(candidates, p)
+		}
+	}
+
+	var firstErr error
+	for _, p := range candidates {
+		err := checkExecutable(p)
+		if err == nil {
+			return p, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", fmt.Errorf("%w: %s: %w", ErrWorkerBinary, name, firstErr)
+}
+
+// workerArgs 返回子进程的参数：默认参数之后追加 ExtraArgs
+func (c Config) workerArgs(w Worker, args ...string) []string {
+	return append(args, c.ExtraArgs[w]...)
+}
+
+// checkExecutable 检查 p 是存在的普通文件并且有执行权限
+func checkExecutable(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", p)
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", p)
+	}
+	return nil
+}
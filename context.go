@@ -0,0 +1,321 @@
+package ipfsKeystoneTest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ctxError 返回 ctx 结束的原因，超时的同时包装 ErrTimeout
+func ctxError(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+type ctxResult struct {
+	n   int
+	err error
+}
+
+// ctxStream 给 Stream 加上取消和子进程崩溃检测。C 函数无法中断，所以 ctx 可以取消
+// 或者数据流有子进程时，可能阻塞的调用在 goroutine 中执行，ctx 结束或子进程崩溃时
+// 中止数据流并立即返回；被放弃的调用返回之前不释放数据流，避免 C 代码访问已经释放的内存
+type ctxStream struct {
+	Stream
+	mu       sync.Mutex
+	pending  sync.WaitGroup // 在 goroutine 中执行、还没有返回的调用
+	buf      []byte         // goroutine 中读写使用的缓冲区，中止后不再使用
+	aborted  bool
+	released bool
+}
+
+func newCtxStream(s Stream) *ctxStream {
+	return &ctxStream{Stream: s}
+}
+
+// crashed 返回子进程崩溃时关闭的通道，数据流没有子进程时为 nil
+func (s *ctxStream) crashed() <-chan struct{} {
+	if m, ok := s.Stream.(workerMonitor); ok {
+		return m.Crashed()
+	}
+	return nil
+}
+
+// crashErr 返回崩溃的子进程的错误
+func (s *ctxStream) crashErr() error {
+	if m, ok := s.Stream.(workerMonitor); ok {
+		return m.CrashErr()
+	}
+	return nil
+}
+
+// Workers 返回数据流的子进程状态，没有子进程时为 nil
+func (s *ctxStream) Workers() []WorkerStatus {
+	if m, ok := s.Stream.(workerMonitor); ok {
+		return m.Workers()
+	}
+	return nil
+}
+
+// async 判断调用是否需要在 goroutine 中执行
+func (s *ctxStream) async(ctx context.Context) bool {
+	return ctx.Done() != nil || s.crashed() != nil
+}
+
+// run 执行可能阻塞的 fn。ctx 结束时中止数据流并返回 ctx 的错误，
+// 子进程崩溃时中止数据流并返回崩溃的错误
+func (s *ctxStream) run(ctx context.Context, fn func() (int, error)) (int, error) {
+	s.mu.Lock()
+	aborted := s.aborted
+	s.mu.Unlock()
+	if aborted {
+		return 0, ErrBufferStopped
+	}
+
+	if !s.async(ctx) {
+		return fn()
+	}
+	if ctx.Err() != nil {
+		s.abort()
+		return 0, ctxError(ctx)
+	}
+	crashed := s.crashed()
+	select {
+	case <-crashed:
+		s.abort()
+		return 0, s.crashErr()
+	default:
+	}
+
+	ch := make(chan ctxResult, 1)
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		n, err := fn()
+		ch <- ctxResult{n, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			// 子进程崩溃时 C 函数通常只是返回 0，用崩溃的原因代替
+			select {
+			case <-crashed:
+				return r.n, s.crashErr()
+			default:
+			}
+		}
+		return r.n, r.err
+	case <-crashed:
+		s.abort()
+		return 0, s.crashErr()
+	case <-ctx.Done():
+		s.abort()
+		return 0, ctxError(ctx)
+	}
+}
+
+// abort 中止数据流，只执行一次
+func (s *ctxStream) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.aborted {
+		s.aborted = true
+		s.Stream.Abort()
+	}
+}
+
+// lockForClose 为 Close 锁住读写器的 mu。阻塞在 RingBuffer 中的 Read 持有 mu，
+// 先中止数据流让它返回，再等它释放 mu
+func (s *ctxStream) lockForClose(mu *sync.Mutex) {
+	if !mu.TryLock() {
+		s.abort()
+		mu.Lock()
+	}
+}
+
+// buffer 返回长度为 n 的缓冲区。调用方持有读写器的锁，中止之后不再调用
+func (s *ctxStream) buffer(n int) []byte {
+	if cap(s.buf) < n {
+		s.buf = make([]byte, n)
+	}
+	return s.buf[:n]
+}
+
+// ReadContext 从 enclave 读取输出。被放弃的读取可能还在后台写入，所以先读到内部缓冲区
+func (s *ctxStream) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if !s.async(ctx) {
+		return s.run(ctx, func() (int, error) { return s.ReadBlock(p) })
+	}
+	buf := s.buffer(len(p))
+	n, err := s.run(ctx, func() (int, error) { return s.ReadBlock(buf) })
+	copy(p, buf[:n])
+	return n, err
+}
+
+// WriteContext 向 enclave 写入输入。被放弃的写入可能还在后台读取，所以先复制 p
+func (s *ctxStream) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if !s.async(ctx) {
+		return s.run(ctx, func() (int, error) { return s.WriteBlock(p) })
+	}
+	buf := s.buffer(len(p))
+	copy(buf, p)
+	return s.run(ctx, func() (int, error) { return s.WriteBlock(buf) })
+}
+
+// WriteTo 把 enclave 的输出写到 w，直到 io.EOF。后端实现 blockReader 时完成的块直接交给 w，
+// 否则每次读出一整块到内部缓冲区
+func (s *ctxStream) WriteTo(w io.Writer) (int64, error) {
+	ctx := context.Background()
+	br, direct := s.Stream.(blockReader)
+
+	var total int64
+	for {
+		var b []byte
+		var err error
+		if direct {
+			_, err = s.run(ctx, func() (int, error) {
+				var err error
+				b, err = br.NextBlock()
+				return len(b), err
+			})
+		} else {
+			buf := s.buffer(DefaultBlockSize)
+			var n int
+			n, err = s.run(ctx, func() (int, error) { return s.ReadBlock(buf) })
+			b = buf[:n]
+		}
+
+		if len(b) > 0 {
+			n, werr := w.Write(b)
+			total += int64(n)
+			if werr == nil && n < len(b) {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// ReadFrom 把 r 的内容交给 enclave，直到 io.EOF。后端实现 blockWriter 时直接读进块槽，
+// 否则每次读满一整块到内部缓冲区再写入
+func (s *ctxStream) ReadFrom(r io.Reader) (int64, error) {
+	ctx := context.Background()
+	bw, direct := s.Stream.(blockWriter)
+
+	var total int64
+	for {
+		var slot []byte
+		if direct {
+			_, err := s.run(ctx, func() (int, error) {
+				var err error
+				slot, err = bw.NextSlot()
+				return len(slot), err
+			})
+			if err != nil {
+				return total, err
+			}
+		}
+		// 没有块槽或者数据流不再需要输入时经过 WriteBlock，多出来的数据由后端报错
+		useSlot := len(slot) > 0
+		if !useSlot {
+			slot = s.buffer(DefaultBlockSize)
+		}
+
+		n, rerr := io.ReadFull(r, slot)
+		if n > 0 {
+			var nw int
+			var werr error
+			if useSlot {
+				nw, werr = s.run(ctx, func() (int, error) { return n, bw.CommitSlot(n) })
+			} else {
+				nw, werr = s.run(ctx, func() (int, error) { return s.WriteBlock(slot[:n]) })
+			}
+			total += int64(nw)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// WaitReadyContext 等待 enclave 就绪
+func (s *ctxStream) WaitReadyContext(ctx context.Context) error {
+	_, err := s.run(ctx, func() (int, error) { return 0, s.Stream.WaitReady() })
+	return err
+}
+
+// WaitReady 等待 enclave 就绪，子进程崩溃时返回崩溃的错误
+func (s *ctxStream) WaitReady() error {
+	return s.WaitReadyContext(context.Background())
+}
+
+// WaitDone 等待 enclave 处理完成。中止过的数据流子进程已经不在，不再等待
+func (s *ctxStream) WaitDone() error {
+	_, err := s.run(context.Background(), func() (int, error) { return 0, s.Stream.WaitDone() })
+	return err
+}
+
+// Close 释放数据流。中止过的数据流等被取消的调用返回之后在后台释放
+func (s *ctxStream) Close() error {
+	s.mu.Lock()
+	if s.released {
+		s.mu.Unlock()
+		return nil
+	}
+	s.released = true
+	aborted := s.aborted
+	s.mu.Unlock()
+
+	if aborted {
+		go func() {
+			s.pending.Wait()
+			s.Stream.Close()
+		}()
+		return nil
+	}
+	s.pending.Wait()
+	return s.Stream.Close()
+}
+
+// waitSessionReady 等待会话的 enclave 就绪，ctx 结束时立即返回，由调用方中止会话
+func waitSessionReady(ctx context.Context, ss Session) error {
+	if ctx.Done() == nil {
+		return ss.WaitReady()
+	}
+	if ctx.Err() != nil {
+		return ctxError(ctx)
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- ss.WaitReady()
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctxError(ctx)
+	}
+}
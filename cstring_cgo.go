@@ -0,0 +1,83 @@
+//go:build keystone
+
+package ipfsKeystoneTest
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// cString 分配交给 C 函数的字符串，必须用 freeCString 释放
+func cString(s string) *C.char {
+	cAllocs.Add(1)
+	return C.CString(s)
+}
+
+// freeCString 释放 cString 分配的字符串，p 为 nil 时什么都不做
+func freeCString(p *C.char) {
+	if p == nil {
+		return
+	}
+	C.free(unsafe.Pointer(p))
+	cAllocs.Add(-1)
+}
+
+// cMalloc 分配交给 C 函数的结构体，必须用 cFree 释放
+func cMalloc(size C.size_t, what string) (unsafe.Pointer, error) {
+	p := C.malloc(size)
+	if p == nil { // 检查内存分配是否成功
+		return nil, fmt.Errorf("failed to allocate memory for %s", what)
+	}
+	cAllocs.Add(1)
+	return p, nil
+}
+
+// cFree 释放 cMalloc 分配的内存，p 为 nil 时什么都不做
+func cFree(p unsafe.Pointer) {
+	if p == nil {
+		return
+	}
+	C.free(p)
+	cAllocs.Add(-1)
+}
+
+// cPath 是会话交给 enclave 的当前文件路径。C 代码只保存指针，
+// 所以路径由会话持有，enclave 确认处理完这个文件或者会话结束时才释放
+type cPath struct {
+	mu sync.Mutex
+	p  *C.char
+}
+
+// set 分配下一个文件的路径，上一个文件的路径如果还没有释放就一起释放
+func (c *cPath) set(s string) *C.char {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	freeCString(c.p)
+	c.p = cString(s)
+	return c.p
+}
+
+// release 释放路径 p，p 已经被新的路径替换时什么都不做
+func (c *cPath) release(p *C.char) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p != nil && c.p == p {
+		freeCString(c.p)
+		c.p = nil
+	}
+}
+
+// releaseAll 在会话结束时释放当前的路径
+func (c *cPath) releaseAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	freeCString(c.p)
+	c.p = nil
+}
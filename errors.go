@@ -0,0 +1,115 @@
+package ipfsKeystoneTest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrShmCreate 表示创建或连接共享内存失败，errors.Unwrap 可以得到原因
+	ErrShmCreate = errors.New("ipfs-keystone: create shared memory failed")
+	// ErrChildStart 表示启动 enclave 子进程失败，errors.Unwrap 可以得到原因
+	ErrChildStart = errors.New("ipfs-keystone: start child process failed")
+	// ErrWorkerBinary 表示子进程的可执行文件不存在或没有执行权限
+	ErrWorkerBinary = errors.New("ipfs-keystone: worker binary not found or not executable")
+
+	// ErrEnclaveAborted 表示 enclave 在处理完文件之前退出
+	ErrEnclaveAborted = errors.New("ipfs-keystone: enclave aborted")
+	// ErrIntegrity 表示数据块的完整性校验失败
+	ErrIntegrity = errors.New("ipfs-keystone: integrity check failed")
+	// ErrBufferStopped 表示缓冲区已经停止或读写器已经关闭，不能再读写
+	ErrBufferStopped = errors.New("ipfs-keystone: buffer stopped")
+	// ErrTimeout 表示等待 enclave 超时
+	ErrTimeout = errors.New("ipfs-keystone: timeout")
+	// ErrFileTooLarge 表示文件超过了所选模式的 C 接口能表示的长度
+	ErrFileTooLarge = errors.New("ipfs-keystone: file too large for this mode")
+	// ErrSourceLength 表示 EncryptStream 的 io.Reader 的长度与 WithSize 设置的长度不同
+	ErrSourceLength = errors.New("ipfs-keystone: source length does not match the size")
+	// ErrCipher 表示 AES 加密或解密失败，例如密文长度或填充无效
+	ErrCipher = errors.New("ipfs-keystone: cipher failed")
+)
+
+// IntegrityError 表示第 Block 块没有通过认证，errors.Is(err, ErrIntegrity) 为 true
+type IntegrityError struct {
+	Block  int64  // 块序号，从 0 开始
+	Reason string // 标签不匹配、帧不完整或者缺少最后一块
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("ipfs-keystone: integrity check failed: block %d: %s", e.Block, e.Reason)
+}
+
+func (e *IntegrityError) Is(target error) bool { return target == ErrIntegrity }
+
+// C 读写函数的返回值：大于 0 表示还有数据，0 表示 enclave 已经处理完文件，
+// 负数是下面的错误码
+const (
+	statusDone      = 0
+	statusAborted   = -1
+	statusIntegrity = -2
+	statusStopped   = -3
+	statusTimeout   = -4
+)
+
+// statusError 把 C 函数返回的错误码转换为对应的错误
+func statusError(status int) error {
+	switch status {
+	case statusAborted:
+		return ErrEnclaveAborted
+	case statusIntegrity:
+		return ErrIntegrity
+	case statusStopped:
+		return ErrBufferStopped
+	case statusTimeout:
+		return ErrTimeout
+	}
+	return fmt.Errorf("%w: status %d", ErrEnclaveAborted, status)
+}
+
+// streamCounter 记录已经从 enclave 读出的字节数。
+// C 函数在 enclave 崩溃时也返回 0，读出的长度不够时不能当作正常结束
+type streamCounter struct {
+	got  int64
+	want int64 // 文件大小，小于 0 表示未知
+}
+
+// readResult 根据一次读操作的返回值和长度返回 Read 的结果
+func (c *streamCounter) readResult(n int, status int) (int, error) {
+	c.got += int64(n)
+	switch {
+	case status > 0:
+		return n, nil
+	case status == statusDone:
+		if c.want >= 0 && c.got < c.want {
+			return n, fmt.Errorf("%w: read %d of %d bytes", ErrEnclaveAborted, c.got, c.want)
+		}
+		return n, io.EOF
+	}
+	return n, statusError(status)
+}
+
+// writeResult 根据一次写操作的返回值返回 Write 的结果，返回 0 表示缓冲区已经停止
+func writeResult(n int, status int) (int, error) {
+	switch {
+	case status > 0:
+		return n, nil
+	case status == 0:
+		return n, ErrBufferStopped
+	}
+	return n, statusError(status)
+}
+
+// shortWrite 在写入 dispatch 数据流的字节数少于 size 时返回错误。enclave 还在等待剩下的数据，
+// 不会自己结束
+func shortWrite(written, size int64) error {
+	if written < size {
+		return fmt.Errorf("%w: wrote %d of %d bytes", ErrEnclaveAborted, written, size)
+	}
+	return nil
+}
+
+// shmCreateError 返回包装了 ErrShmCreate 和原因的错误
+func shmCreateError(cause error) error {
+	return fmt.Errorf("%w: %w", ErrShmCreate, cause)
+}
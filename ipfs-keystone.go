@@ -1,969 +1,771 @@
 package ipfsKeystoneTest
 
-// #cgo LDFLAGS: -L/usr/local/ipfs-keystone -lipfs_keystone -lstdc++
-// #cgo CFLAGS: -I/usr/local/ipfs-keystone/include -I/usr/local/ipfs-keystone/include/host -I/usr/local/ipfs-keystone/include/edge
-// #include <stdlib.h>
-// #include "ipfs_keystone.h"
-// #include "ipfs_aes.h"
-import "C"
-
 import (
+	"context"
 	"fmt"
 	"io"
-	"unsafe"
 	"sync"
-	// "time"
-	"bytes"
-
-	"os"
-	"os/exec"
 )
 
-// TEEFileReader 结构体封装了环形缓冲区的相关操作
+// TEEFileReader 结构体封装了环形缓冲区的相关操作。加密时只能 Read，解密时只能 Write，
+// 用错了要到运行时才发现
+//
+// Deprecated: 加密使用 EncryptReader，解密使用 DecryptWriter。
 type TEEFileReader struct {
-	rb     *C.RingBuffer          // 指向C语言中的RingBuffer结构
-	readCh chan struct{}          // 通道用于通知读取完成
-	wg     sync.WaitGroup         // 等待组用于等待后台goroutine完成
-	mu     sync.Mutex             // 互斥锁，保护共享资源
-	closed bool                   // 标记是否已经关闭
+	s      *ctxStream    // 后端中的RingBuffer数据流
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
 // NewTEEFileReader 创建一个新的TEEFileReader实例
-func NewTEEFileReader(isAES int, FileName string) (*TEEFileReader, error) {
-	rb := (*C.RingBuffer)(C.malloc(C.sizeof_RingBuffer))
-	if rb == nil { // 检查内存分配是否成功
-		return nil, fmt.Errorf("failed to allocate memory for RingBuffer")
-	}
-
-	// Convert Go int to C int
-	cIsAES := C.int(isAES)
+//
+// Deprecated: 使用 NewEncryptReader。
+func NewTEEFileReader(FileName string, opts ...Option) (*TEEFileReader, error) {
+	return NewTEEFileReaderContext(context.Background(), FileName, opts...)
+}
 
-	C.init_ring_buffer(rb)
+// NewTEEFileReaderContext 与 NewTEEFileReader 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+//
+// Deprecated: 使用 NewEncryptReaderContext。
+func NewTEEFileReaderContext(ctx context.Context, FileName string, opts ...Option) (*TEEFileReader, error) {
+	s, err := openSingleStream(ctx, FileName, false, opts)
+	if err != nil {
+		return nil, err
+	}
 
 	reader := &TEEFileReader{
-		rb:     rb,
+		s:      s,
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	reader.wg.Add(1)
-	go func() {
-		defer reader.wg.Done() // 确保在goroutine结束时调用Done
-		C.ipfs_keystone(cIsAES, unsafe.Pointer(C.CString(FileName)), unsafe.Pointer(rb))
-		fmt.Println("TEE read file done")
-	}()
-
 	return reader, nil
 }
 
 // Read 实现io.Reader接口的方法，从缓冲区读取数据到p切片
 func (r *TEEFileReader) Read(p []byte) (int, error) {
+	return r.ReadContext(context.Background(), p)
+}
+
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (r *TEEFileReader) ReadContext(ctx context.Context, p []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if r.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var readLen C.int = 0;
-	result := C.ring_buffer_read((*C.RingBuffer)(r.rb), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
-	if result == 0 { // 检查ring_buffer_read的结果
-		return int(readLen), io.EOF
-	}
-	return int(readLen), nil
+	return r.s.ReadContext(ctx, p)
 }
 
-// Close 关闭TEEFileReader实例，释放相关资源
+// Close 关闭TEEFileReader实例，停止 enclave，等 enclave 线程返回之后释放 RingBuffer
 func (r *TEEFileReader) Close() error {
-	r.mu.Lock()
+	r.s.lockForClose(&r.mu)
 	defer r.mu.Unlock()
 
+	var err error
 	if !r.closed {
 		r.closed = true
-		C.free(unsafe.Pointer(r.rb))  // 释放C语言分配的内存
-		close(r.readCh)  // 确保通道被关闭
-		// r.wg.Wait()  // 等待后台goroutine完成
+		err = r.s.Close() // 释放RingBuffer
+		close(r.readCh)   // 确保通道被关闭
 	}
 	fmt.Println("TEEFileReader Close")
-	return nil
+	return err
 }
 
-func Ipfs_keystone_test(isAES int, FileName string) (TEEFileReader){
+// Ipfs_keystone_test 是 NewTEEFileReader 的旧接口，返回 *TEEFileReader。
+//
+// Deprecated: 使用 NewEncryptReader。
+func Ipfs_keystone_test(isAES int, FileName string) (*TEEFileReader, error) {
 
 	// 打印FileName
 	fmt.Println("Processing file:", FileName)
 
-	reader, _ := NewTEEFileReader(isAES, FileName)
-	// defer reader.Close()
-
-	// var ior io.ReadCloser = reader
-
-	return *reader
+	return NewTEEFileReader(FileName, legacyOptions(isAES)...)
 }
 
-func NewTEEFileReaderDe(isAES int, FileName string) (*TEEFileReader, error) {
+// NewTEEFileReaderDe 创建解密用的TEEFileReader实例
+//
+// Deprecated: 使用 NewDecryptWriter。
+func NewTEEFileReaderDe(FileName string, opts ...Option) (*TEEFileReader, error) {
+	return NewTEEFileReaderDeContext(context.Background(), FileName, opts...)
+}
 
-	rb := (*C.RingBuffer)(C.malloc(C.sizeof_RingBuffer))
-	if rb == nil { // 检查内存分配是否成功
-		return nil, fmt.Errorf("failed to allocate memory for RingBuffer")
+// NewTEEFileReaderDeContext 与 NewTEEFileReaderDe 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+//
+// Deprecated: 使用 NewDecryptWriterContext。
+func NewTEEFileReaderDeContext(ctx context.Context, FileName string, opts ...Option) (*TEEFileReader, error) {
+	s, err := openSingleStream(ctx, FileName, true, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// Convert Go int to C int
-	cIsAES := C.int(isAES)
-
-	C.init_ring_buffer(rb)
-
 	reader := &TEEFileReader{
-		rb:     rb,
+		s:      s,
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	reader.wg.Add(1)
-	go func() {
-		defer reader.wg.Done() // 确保在goroutine结束时调用Done
-		C.ipfs_keystone_de(cIsAES, unsafe.Pointer(C.CString(FileName)), unsafe.Pointer(rb))
-		fmt.Println("TEE read file done")
-	}()
-
 	return reader, nil
 }
 
-func Ipfs_keystone_test_de(isAES int, FileName string) (TEEFileReader){
+// Ipfs_keystone_test_de 是 NewTEEFileReaderDe 的旧接口，返回 *TEEFileReader。
+//
+// Deprecated: 使用 NewDecryptWriter。
+func Ipfs_keystone_test_de(isAES int, FileName string) (*TEEFileReader, error) {
 
 	// 打印FileName
 	fmt.Println("Get file:", FileName)
 
-	reader, _ := NewTEEFileReaderDe(isAES, FileName)
-	// defer reader.Close()
-
-	// var ior io.ReadCloser = reader
-
-	return *reader
+	return NewTEEFileReaderDe(FileName, legacyOptions(isAES)...)
 }
 
 // Write 实现io.Write接口的方法，从p切片读取数据到缓冲区
 func (r *TEEFileReader) Write(p []byte) (int, error) {
+	return r.WriteContext(context.Background(), p)
+}
+
+// WriteContext 与 Write 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的写入返回 ErrBufferStopped
+func (r *TEEFileReader) WriteContext(ctx context.Context, p []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if r.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var wrsult C.int = 0;
-	wrsult = C.ring_buffer_write((*C.RingBuffer)(r.rb), (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
-	if wrsult == 0 { // 检查ring_buffer_write的结果
-		return int(wrsult), io.EOF
-	}
-	return int(wrsult), nil
+	return r.s.WriteContext(ctx, p)
 }
 
-// Close 关闭TEEFileReader实例，释放相关资源
+// WaClose 停止写入并等待 enclave 处理完成
 func (r *TEEFileReader) WaClose() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	var err error
 	if !r.closed {
 		r.closed = true
-		C.ring_buffer_stop((*C.RingBuffer)(r.rb));
-		// C.free(unsafe.Pointer(r.rb))  // 由c语言程序释放内存
-		close(r.readCh)  // 确保通道被关闭
-		C.ring_buffer_already_got()
-		// time.Sleep(1500 * time.Millisecond)  // 固定等待1.5s
-		// r.wg.Wait()  // 等待后台goroutine完成
+		close(r.readCh) // 确保通道被关闭
+		err = r.s.WaitDone()
+		if cerr := r.s.Close(); err == nil {
+			err = cerr
+		}
 	}
 	fmt.Println("TEEFileReader WaClose")
-	return nil
+	return err
 }
 
-// ==================================================================================
-//				AES Encrypt
-// ==================================================================================
+// EncryptReader 从单个 enclave 读出 source 文件或 io.Reader 的密文，只能读取
+type EncryptReader struct {
+	s      *ctxStream // 后端中的RingBuffer数据流
+	source string     // 被加密的文件，EncryptStream 创建时为空
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewEncryptReader 启动单个 enclave 加密 FileName
+func NewEncryptReader(FileName string, opts ...Option) (*EncryptReader, error) {
+	return NewEncryptReaderContext(context.Background(), FileName, opts...)
+}
+
+// NewEncryptReaderContext 与 NewEncryptReader 相同，ctx 结束时停止 enclave 并释放资源
+func NewEncryptReaderContext(ctx context.Context, FileName string, opts ...Option) (*EncryptReader, error) {
+	s, err := openSingleStream(ctx, FileName, false, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptReader{s: s, source: FileName}, nil
+}
+
+// Source 返回被加密的文件，从 io.Reader 加密时为空
+func (r *EncryptReader) Source() string { return r.source }
+
+// Read 实现 io.Reader
+func (r *EncryptReader) Read(p []byte) (int, error) {
+	return r.ReadContext(context.Background(), p)
+}
+
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (r *EncryptReader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return 0, ErrBufferStopped
+	}
+	return r.s.ReadContext(ctx, p)
+}
+
+// Close 放弃还没有读出的密文：停止 enclave，等 enclave 线程返回之后释放 RingBuffer
+func (r *EncryptReader) Close() error {
+	r.s.lockForClose(&r.mu)
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.s.Close()
+}
+
+// DecryptWriter 把写入的密文交给单个 enclave 解密，enclave 把明文写到 output 或 sink，只能写入
+type DecryptWriter struct {
+	s      *ctxStream
+	output string    // enclave 写出明文的文件
+	sink   io.Writer // 接收明文的 io.Writer，不为 nil 时不使用 output
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewDecryptWriter 启动单个 enclave，明文写到 FileName
+func NewDecryptWriter(FileName string, opts ...Option) (*DecryptWriter, error) {
+	return NewDecryptWriterContext(context.Background(), FileName, opts...)
+}
+
+// NewDecryptWriterContext 与 NewDecryptWriter 相同，ctx 结束时停止 enclave 并释放资源
+func NewDecryptWriterContext(ctx context.Context, FileName string, opts ...Option) (*DecryptWriter, error) {
+	s, err := openSingleStream(ctx, FileName, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptWriter{s: s, output: FileName, sink: applyOptions(opts).Sink}, nil
+}
+
+// NewDecryptWriterTo 启动单个 enclave，明文通过第二个环形缓冲区写到 dst，不经过磁盘
+func NewDecryptWriterTo(dst io.Writer, opts ...Option) (*DecryptWriter, error) {
+	return NewDecryptWriterToContext(context.Background(), dst, opts...)
+}
+
+// NewDecryptWriterToContext 与 NewDecryptWriterTo 相同，ctx 结束时停止 enclave 并释放资源
+func NewDecryptWriterToContext(ctx context.Context, dst io.Writer, opts ...Option) (*DecryptWriter, error) {
+	if dst == nil {
+		return nil, fmt.Errorf("%w: nil plaintext writer", ErrInvalidOptions)
+	}
+	return NewDecryptWriterContext(ctx, "", append(opts[:len(opts):len(opts)], WithPlaintextWriter(dst))...)
+}
+
+// Output 返回 enclave 写出明文的文件，明文写到 io.Writer 时为空
+func (w *DecryptWriter) Output() string { return w.output }
+
+// Sink 返回接收明文的 io.Writer，明文写到文件时为 nil
+func (w *DecryptWriter) Sink() io.Writer { return w.sink }
+
+// Write 实现 io.Writer
+func (w *DecryptWriter) Write(p []byte) (int, error) {
+	return w.WriteContext(context.Background(), p)
+}
+
+// WriteContext 与 Write 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的写入返回 ErrBufferStopped
+func (w *DecryptWriter) WriteContext(ctx context.Context, p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrBufferStopped
+	}
+	return w.s.WriteContext(ctx, p)
+}
+
+// Close 通知 enclave 密文已经写完，等明文全部写到 Output 或 Sink 之后释放资源，
+// 返回 enclave 处理过程中的错误或者 Sink 返回的错误
+func (w *DecryptWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.s.WaitDone()
+	if cerr := w.s.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
 
-func Rv_AES_Encrypt(pt []byte, ptLen int, ct []byte)(int) {
+// openSingleStream 打开单个 enclave 的加密（de 为 false）或解密数据流
+func openSingleStream(ctx context.Context, FileName string, de bool, opts []Option) (*ctxStream, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-	ctLen := C.encrypt(unsafe.Pointer(&pt[0]), C.int(ptLen), unsafe.Pointer(&ct[0]))
-	// ctLen := C.encrypt(unsafe.Pointer(uintptr(unsafe.Pointer(&pt[0]))), C.int(ptLen), unsafe.Pointer(uintptr(unsafe.Pointer(&ct[0]))))
-	// ctLen := C.encrypt((*C.void)(unsafe.Pointer(&pt[0])), C.int(ptLen), (*C.void)(unsafe.Pointer(&ct[0])))
-	return int(ctLen)
+	b, req, err := newRequest(ModeSingle, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Path = FileName
 
+	open := b.OpenEncrypt
+	if de {
+		open = b.OpenDecrypt
+	}
+	s, err := open(req)
+	if err != nil {
+		return nil, err
+	}
+	return newCtxStream(s), nil
 }
 
-func Rv_AES_Decrypt(ct []byte, ctLen int, pt []byte)(int) {
+// ==================================================================================
+//				AES Encrypt
+// ==================================================================================
 
-	ptLen := C.decrypt(unsafe.Pointer(&ct[0]), C.int(ctLen), unsafe.Pointer(&pt[0]))
-	// ptLen := C.decrypt(unsafe.Pointer(uintptr(unsafe.Pointer(&ct[0]))), C.int(ctLen), unsafe.Pointer(uintptr(unsafe.Pointer(&pt[0]))))
-	// ptLen := C.decrypt((*C.void)(unsafe.Pointer(&ct[0])), C.int(ctLen), (*C.void)(unsafe.Pointer(&pt[0])))
-	return int(ptLen)
+// Rv_AES_Encrypt 加密 pt 的前 ptLen 字节，返回密文长度。ct 至少要有 (ptLen/16+1)*16 字节，
+// 长度无效时返回 -1。KeystoneAES.Seal 会计算长度
+func Rv_AES_Encrypt(pt []byte, ptLen int, ct []byte) int {
+	return aesEncrypt(pt, ptLen, ct)
+}
 
+// Rv_AES_Decrypt 解密 ct 的前 ctLen 字节，返回明文长度。C 函数去掉填充之前写出整个密文，
+// 所以 pt 至少要有 ctLen 字节，即使明文更短；pt 更短、长度或填充无效时返回负数。
+// 模拟后端的检查相同。KeystoneAES.Open 会计算长度
+func Rv_AES_Decrypt(ct []byte, ctLen int, pt []byte) int {
+	return aesDecrypt(ct, ctLen, pt)
 }
 
 // ==================================================================================
 //				MultiThreaded Keystone Encrypt
 // ==================================================================================
 
-
-// TEEFileReader 结构体封装了环形缓冲区的相关操作
+// MultiThreadedTEEFileReader 结构体封装了两个线程的缓冲区
 type MultiThreadedTEEFileReader struct {
-	mtb     *C.MultiThreadedBuffer  	// 指向C语言中的MultiThreadedBuffer结构
-	readCh chan struct{}          		// 通道用于通知读取完成
-	wg     sync.WaitGroup         		// 等待组用于等待后台goroutine完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
+	s      *ctxStream    // 后端中的MultiThreadedBuffer数据流
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
-
 // NewMultiThreadedTEEFileReader 创建一个新的MultiThreadedTEEFileReader实例
-func NewMultiThreadedTEEFileReader(isAES int, FileName string, fileSize int) (*MultiThreadedTEEFileReader, error) {
-	mtb := (*C.MultiThreadedBuffer)(C.malloc(C.sizeof_MultiThreadedBuffer))
-	if mtb == nil { // 检查内存分配是否成功
-		return nil, fmt.Errorf("failed to allocate memory for RingBuffer")
-	}
+func NewMultiThreadedTEEFileReader(FileName string, fileSize int64, opts ...Option) (*MultiThreadedTEEFileReader, error) {
+	return NewMultiThreadedTEEFileReaderContext(context.Background(), FileName, fileSize, opts...)
+}
 
-	// Convert Go int to C int
-	cIsAES := C.int(isAES)
-	cFileSize := C.int(fileSize)
+// NewMultiThreadedTEEFileReaderContext 与 NewMultiThreadedTEEFileReader 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewMultiThreadedTEEFileReaderContext(ctx context.Context, FileName string, fileSize int64, opts ...Option) (*MultiThreadedTEEFileReader, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-	cFileSize = C.alignedFileSize(cFileSize)
-	cAfileSize := C.aFileSize(cFileSize)
+	b, req, err := newRequest(ModeMultiThreaded, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Path = FileName
+	req.Size = fileSize
 
-	// 为 half part buffer 分配空间，设置两个buffer的运行状态都为running = 1
-	C.init_multi_threaded_ring_buffer(mtb, cFileSize, cAfileSize)
+	s, err := b.OpenEncrypt(req)
+	if err != nil {
+		return nil, err
+	}
 
 	reader := &MultiThreadedTEEFileReader{
-		mtb:    mtb,
+		s:      newCtxStream(s),
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	reader.wg.Add(1)
-	go func() {
-		defer reader.wg.Done() // 确保在goroutine结束时调用Done
-		C.multi_ipfs_keystone_ppb_buffer_wrapper(cIsAES, unsafe.Pointer(C.CString(FileName)), unsafe.Pointer(mtb), 0, cAfileSize)
-		fmt.Println("MultiTEE buffer read file done")
-	}()
-
-	reader.wg.Add(1)
-	go func() {
-		defer reader.wg.Done() // 确保在goroutine结束时调用Done
-		C.multi_ipfs_keystone_hpb_buffer_wrapper(cIsAES, unsafe.Pointer(C.CString(FileName)), unsafe.Pointer(mtb), cAfileSize + 1, cFileSize)
-		fmt.Println("MultiTEE ring buffer read file done")
-	}()
-
 	return reader, nil
 }
 
-func MultiThreaded_Ipfs_keystone_test(isAES int, FileName string, fileSize int) (MultiThreadedTEEFileReader){
+// MultiThreaded_Ipfs_keystone_test 是 NewMultiThreadedTEEFileReader 的旧接口，返回 *MultiThreadedTEEFileReader。
+//
+// Deprecated: 使用 NewMultiThreadedTEEFileReader。
+func MultiThreaded_Ipfs_keystone_test(isAES int, FileName string, fileSize int) (*MultiThreadedTEEFileReader, error) {
 
 	// 打印FileName
 	fmt.Println("MultiThread Processing file:", FileName)
 
-	reader, _ := NewMultiThreadedTEEFileReader(isAES, FileName, fileSize)
-
+	return NewMultiThreadedTEEFileReader(FileName, int64(fileSize), legacyOptions(isAES)...)
+}
 
-	return *reader
+func (mtbr *MultiThreadedTEEFileReader) Read(p []byte) (int, error) {
+	return mtbr.ReadContext(context.Background(), p)
 }
 
-func (mtbr *MultiThreadedTEEFileReader)Read(p []byte) (int, error)  {
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (mtbr *MultiThreadedTEEFileReader) ReadContext(ctx context.Context, p []byte) (int, error) {
 	mtbr.mu.Lock()
 	defer mtbr.mu.Unlock()
 
 	if mtbr.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var readLen C.int = 0;
-	result := C.which_pb_buffer_read((*C.MultiThreadedBuffer)(unsafe.Pointer(mtbr.mtb)), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
-	if result == 0 { // 检查ring_buffer_read的结果
-		return int(readLen), io.EOF
-	}
-	return int(readLen), nil
+	return mtbr.s.ReadContext(ctx, p)
 }
 
 // Close 关闭TMultiThreadedTEEFileReader实例，释放相关资源
 func (mtbr *MultiThreadedTEEFileReader) Close() error {
-	mtbr.mu.Lock()
+	mtbr.s.lockForClose(&mtbr.mu)
 	defer mtbr.mu.Unlock()
 
+	var err error
 	if !mtbr.closed {
 		mtbr.closed = true
-		C.destory_multi_threaded_ring_buffer((*C.MultiThreadedBuffer)(unsafe.Pointer(mtbr.mtb)))
-		// C.free(unsafe.Pointer(mtbr.mtb))  // 释放C语言分配的内存
-		close(mtbr.readCh)  // 确保通道被关闭
-		// mtbr.wg.Wait()  // 等待后台goroutine完成
+		err = mtbr.s.Close()
+		close(mtbr.readCh) // 确保通道被关闭
 	}
 	fmt.Println("TEEFileReader Close")
-	return nil
+	return err
 }
 
-
-
 // ==================================================================================
 //				Multi-process Keystone Encrypt
 // ==================================================================================
 
-const (
-	shmKey   = 241227 // 共享内存键值
-)
-
 type MultiProcessTEEFileReader struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     int				  		// 共享内存的长度
-	mpb		*C.MultiProcessSHMBuffer	// 指向C语言中的 MultiProcessSHMBuffer 结构
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
-}
-
-// 创建一个新的共享内存段
-func createShm(size int) ([]byte, error) {
-
-	shmaddr := C.creat_shareMemory(C.int(size))
-
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:size:size], nil
+	s      *ctxStream    // 后端中与子进程共享的内存
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
-// 连接到现有的共享内存段
-func attachShm(size int) ([]byte, error) {
-
-	shmaddr := C.attach_shareMemory(C.int(size))
-
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:size:size], nil
-}
-
-// 断开与共享内存段的连接
-func detachShm(shm []byte) error {
-	C.detach_shareMemory(unsafe.Pointer(&shm[0]))
-
-	return nil
-}
-
-// 删除共享内存段
-func removeShm(shmsize int) error {
-	C.removeShm(C.int(shmsize))
-
-	return nil
+// NewMultiProcessTEEFileReader MultiProcessTEEFileReader
+func NewMultiProcessTEEFileReader(FileName string, fileSize int64, opts ...Option) (*MultiProcessTEEFileReader, error) {
+	return NewMultiProcessTEEFileReaderContext(context.Background(), FileName, fileSize, opts...)
 }
 
-// NewMultiProcessTEEFileReader MultiProcessTEEFileReader
-func NewMultiProcessTEEFileReader(isAES int, FileName string, fileSize int) (*MultiProcessTEEFileReader, error) {
+// NewMultiProcessTEEFileReaderContext 与 NewMultiProcessTEEFileReader 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewMultiProcessTEEFileReaderContext(ctx context.Context, FileName string, fileSize int64, opts ...Option) (*MultiProcessTEEFileReader, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-	// 创建共享内存片段
-	shmsize := fileSize + C.sizeof_MultiProcessSHMBuffer
-	shm, err := createShm(shmsize)
+	b, req, err := newRequest(ModeMultiProcess, opts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
+	req.Path = FileName
+	req.Size = fileSize
 
-	// Convert Go int to C int
-	cFileSize := C.int(fileSize)
-
-	cFileSize = C.alignedFileSize(cFileSize)
-	cAfileSize := C.aFileSize(cFileSize)
+	s, err := b.OpenEncrypt(req)
+	if err != nil {
+		return nil, err
+	}
 
 	reader := &MultiProcessTEEFileReader{
-		shmaddr:    shm,
-		shmsize:	shmsize,
+		s:      newCtxStream(s),
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	// 启动第一个子进程，读取文件的前半部分
-	cmd1 := exec.Command("./child_process", fmt.Sprintf("%d", isAES), fmt.Sprintf("%d", shmsize), FileName, fmt.Sprintf("%d", 0), fmt.Sprintf("%d", cAfileSize))
-
-	// 创建缓冲区来存储标准输出和标准错误
-	var stdout1, stderr1 bytes.Buffer
-
-	// 将子进程的标准输出和标准错误重定向到上面创建的缓冲区
-	cmd1.Stdout = &stdout1
-	cmd1.Stderr = &stderr1
-
-	err = cmd1.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start first child process: %v\n", err)
-		os.Exit(1)
-	}
-
-	// 启动第二个子进程，读取文件的后半部分
-	cmd2 := exec.Command("./child_process", fmt.Sprintf("%d", isAES), fmt.Sprintf("%d", shmsize), FileName, fmt.Sprintf("%d", cAfileSize), fmt.Sprintf("%d", cFileSize))
-
-	// 创建缓冲区来存储标准输出和标准错误
-    var stdout2, stderr2 bytes.Buffer
-
-    // 将子进程的标准输出和标准错误重定向到上面创建的缓冲区
-    cmd2.Stdout = &stdout2
-    cmd2.Stderr = &stderr2
-
-	err = cmd2.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start second child process: %v\n", err)
-		os.Exit(1)
+	if err := reader.s.WaitReadyContext(ctx); err != nil {
+		reader.s.Close()
+		return nil, err
 	}
 
-	// time.Sleep(1500 * time.Millisecond)
-
-	// // 打印子进程的标准输出
-    //     fmt.Printf("Child process output:\n%s\n", stdout1.String())
-    //     fmt.Printf("Child process output:\n%s\n", stdout2.String())
-
-	// cmd1.Wait()
-	// cmd2.Wait()
-
-	// // 打印子进程的标准输出
-    //     fmt.Printf("Child process output:\n%s\n", stdout1.String())
-    //     fmt.Printf("Child process output:\n%s\n", stdout2.String())
-
-	// // 打印子进程的输出
-    //     fmt.Printf("Child process output:\n%s\n", stderr1.String())
-    //     fmt.Printf("Child process output:\n%s\n", stderr2.String())
-
-
-	C.waitKeystoneReady(unsafe.Pointer(&reader.shmaddr[0]))
-
-	fmt.Printf("Child1 process output:\n%s\n", stdout1.String())
-	fmt.Printf("Child2 process output:\n%s\n", stdout2.String())
-
 	return reader, nil
 }
 
-
-func MultiProcess_Ipfs_keystone_test(isAES int, FileName string, fileSize int) (MultiProcessTEEFileReader){
+// MultiProcess_Ipfs_keystone_test 是 NewMultiProcessTEEFileReader 的旧接口，返回 *MultiProcessTEEFileReader。
+//
+// Deprecated: 使用 NewMultiProcessTEEFileReader。
+func MultiProcess_Ipfs_keystone_test(isAES int, FileName string, fileSize int) (*MultiProcessTEEFileReader, error) {
 
 	// 打印FileName
 	fmt.Println("MultiProcess Processing file:", FileName)
 
-	reader, _ := NewMultiProcessTEEFileReader(isAES, FileName, fileSize)
-
-
-	return *reader
+	return NewMultiProcessTEEFileReader(FileName, int64(fileSize), legacyOptions(isAES)...)
 }
 
-
 // Close 关闭MultiProcessTEEFileReader实例，释放相关资源
 func (mptr *MultiProcessTEEFileReader) Close() error {
-	mptr.mu.Lock()
+	mptr.s.lockForClose(&mptr.mu)
 	defer mptr.mu.Unlock()
 
+	var err error
 	if !mptr.closed {
 		mptr.closed = true
-		close(mptr.readCh)  // 确保通道被关闭
-		defer detachShm(mptr.shmaddr)
-		defer removeShm(mptr.shmsize)
+		close(mptr.readCh) // 确保通道被关闭
+		err = mptr.s.Close()
 	}
 	fmt.Println("MultiProcess TEEFileReader Close")
-	return nil
+	return err
 }
 
-// 从共享内存中读取数据并打印出来
-func parentProcess(shmaddr []byte, shmsize int, p []byte, size int)(int, error) {
-
-	var readLen C.int = 0;
-	// 交给c语言函数处理
-	result := C.MultiProcessRead(unsafe.Pointer(&shmaddr[0]), C.int(shmsize), unsafe.Pointer(&p[0]), C.int(size), &readLen);
-
-	if result == 0 {
-		return int(readLen), io.EOF
-	}
+// Workers 返回 enclave 子进程的 PID 和退出状态
+func (mptr *MultiProcessTEEFileReader) Workers() []WorkerStatus {
+	return mptr.s.Workers()
+}
 
-	return int(readLen), nil;
+func (mtbr *MultiProcessTEEFileReader) Read(p []byte) (int, error) {
+	return mtbr.ReadContext(context.Background(), p)
 }
 
-func (mtbr *MultiProcessTEEFileReader)Read(p []byte) (int, error)  {
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (mtbr *MultiProcessTEEFileReader) ReadContext(ctx context.Context, p []byte) (int, error) {
 	mtbr.mu.Lock()
 	defer mtbr.mu.Unlock()
 
 	if mtbr.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	return parentProcess(mtbr.shmaddr, mtbr.shmsize, p, len(p))
+	return mtbr.s.ReadContext(ctx, p)
 }
 
-
 // ==================================================================================
 //				Multi-process Cross-read Keystone Encrypt
 // ==================================================================================
 
-
 type MultiProcessCrossTEEFileReader struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     int64				  		// 共享内存的长度
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
+	s      *ctxStream    // 后端中与子进程共享的内存
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
-// 创建一个新的共享内存段
-func longcreateShm(size int64) ([]byte, error) {
-
-	shmaddr := C.long_create_shareMemory(C.longlong(size))
-
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:size:size], nil
-}
-
-// 删除共享内存段
-func longremoveShm(shmsize int64) error {
-	C.long_removeShm(C.longlong(shmsize))
-
-	return nil
+// NewMultiProcessCrossTEEFileReader MultiProcessCrossTEEFileReader
+func NewMultiProcessCrossTEEFileReader(FileName string, fileSize int64, opts ...Option) (*MultiProcessCrossTEEFileReader, error) {
+	return NewMultiProcessCrossTEEFileReaderContext(context.Background(), FileName, fileSize, opts...)
 }
 
+// NewMultiProcessCrossTEEFileReaderContext 与 NewMultiProcessCrossTEEFileReader 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewMultiProcessCrossTEEFileReaderContext(ctx context.Context, FileName string, fileSize int64, opts ...Option) (*MultiProcessCrossTEEFileReader, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-// NewMultiProcessCrossTEEFileReader MultiProcessCrossTEEFileReader
-func NewMultiProcessCrossTEEFileReader(isAES int, FileName string, fileSize int64) (*MultiProcessCrossTEEFileReader, error) {
-
-	// Convert Go int to C int
-	cFileSize := C.longlong(fileSize)
+	b, req, err := newRequest(ModeCross, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Path = FileName
+	req.Size = fileSize
 
-	cFileSize = C.long_alignedFileSize(cFileSize)
-	cBlocksNums := C.long_alignedFileSize_blocksnums(cFileSize)
-	
-	// 创建共享内存片段
-	shmsize := C.sizeof_MultiProcessCrossSHMBuffer + (int64(cBlocksNums) * 4) + int64(cFileSize)
-	shm, err := longcreateShm(shmsize)
+	s, err := b.OpenEncrypt(req)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	reader := &MultiProcessCrossTEEFileReader{
-		shmaddr:    shm,
-		shmsize:	shmsize,
+		s:      newCtxStream(s),
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	// 启动keystone之前先初始化内存空间
-	C.crossInitSHM(unsafe.Pointer(&reader.shmaddr[0]), cBlocksNums);
-	// fmt.Println("MultiProcess Processing file test")
-
-	// 启动第一个子进程，读取文件的前半部分
-	cmd1 := exec.Command("./cross_child_process", fmt.Sprintf("%d", isAES), fmt.Sprintf("%d", shmsize), FileName, fmt.Sprintf("%d", 0))
-
-	// 创建缓冲区来存储标准输出和标准错误
-	var stdout1, stderr1 bytes.Buffer
-
-	// 将子进程的标准输出和标准错误重定向到上面创建的缓冲区
-	cmd1.Stdout = &stdout1
-	cmd1.Stderr = &stderr1
-
-	err = cmd1.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start first child process: %v\n", err)
-		os.Exit(1)
+	if err := reader.s.WaitReadyContext(ctx); err != nil {
+		reader.s.Close()
+		return nil, err
 	}
 
-	// 启动第二个子进程，读取文件的后半部分
-	cmd2 := exec.Command("./cross_child_process", fmt.Sprintf("%d", isAES), fmt.Sprintf("%d", shmsize), FileName, fmt.Sprintf("%d", 1))
-
-	// 创建缓冲区来存储标准输出和标准错误
-	var stdout2, stderr2 bytes.Buffer
-
-	// 将子进程的标准输出和标准错误重定向到上面创建的缓冲区
-	cmd2.Stdout = &stdout2
-	cmd2.Stderr = &stderr2
-
-	err = cmd2.Start()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start second child process: %v\n", err)
-		os.Exit(1)
-	}
-
-	C.crosswaitKeystoneReady(unsafe.Pointer(&reader.shmaddr[0]))
-
-	// fmt.Println("MultiProcess Processing file wait")
-
-	// cmd1.Wait()
-	// cmd2.Wait()
-
-	// // 打印子进程的标准输出
-    //     fmt.Printf("Child process output:\n%s\n", stdout1.String())
-    //     fmt.Printf("Child process output:\n%s\n", stdout2.String())
-
-	// // 打印子进程的标准错误输出
-    //     fmt.Printf("Child process err output:\n%s\n", stderr1.String())
-    //     fmt.Printf("Child process err output:\n%s\n", stderr2.String())
-
 	return reader, nil
 }
 
-
-func MultiProcess_Cross_Ipfs_keystone_test(isAES int, FileName string, fileSize int64) (MultiProcessCrossTEEFileReader){
+// MultiProcess_Cross_Ipfs_keystone_test 是 NewMultiProcessCrossTEEFileReader 的旧接口，返回 *MultiProcessCrossTEEFileReader。
+//
+// Deprecated: 使用 NewMultiProcessCrossTEEFileReader。
+func MultiProcess_Cross_Ipfs_keystone_test(isAES int, FileName string, fileSize int64) (*MultiProcessCrossTEEFileReader, error) {
 
 	// 打印FileName
 	fmt.Println("MultiProcess Processing file:", FileName)
 
-	reader, _ := NewMultiProcessCrossTEEFileReader(isAES, FileName, fileSize)
-
+	return NewMultiProcessCrossTEEFileReader(FileName, fileSize, legacyOptions(isAES)...)
+}
 
-	return *reader
+func (mpcr *MultiProcessCrossTEEFileReader) Read(p []byte) (int, error) {
+	return mpcr.ReadContext(context.Background(), p)
 }
 
-func (mpcr *MultiProcessCrossTEEFileReader)Read(p []byte) (int, error)  {
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (mpcr *MultiProcessCrossTEEFileReader) ReadContext(ctx context.Context, p []byte) (int, error) {
 	mpcr.mu.Lock()
 	defer mpcr.mu.Unlock()
 
 	if mpcr.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	// fmt.Println("MultiProcess Processing read start")
-	var readLen C.int = 0;
-	// 交给c语言函数处理
-	result := C.MultiProcessCrossRead(unsafe.Pointer(&mpcr.shmaddr[0]), C.int(mpcr.shmsize), unsafe.Pointer(&p[0]), C.int(len(p)), &readLen);
-	if result == 0 {
-		return int(readLen), io.EOF
-	}
-
-	// fmt.Println("MultiProcess Processing read done")
-
-	return int(readLen), nil;
+	return mpcr.s.ReadContext(ctx, p)
 }
 
 // Close 关闭MultiProcessCrossTEEFileReader实例，释放相关资源
 func (mpcr *MultiProcessCrossTEEFileReader) Close() error {
-	mpcr.mu.Lock()
+	mpcr.s.lockForClose(&mpcr.mu)
 	defer mpcr.mu.Unlock()
 
+	var err error
 	if !mpcr.closed {
 		mpcr.closed = true
-		close(mpcr.readCh)  // 确保通道被关闭
-		defer detachShm(mpcr.shmaddr)
-		defer longremoveShm(mpcr.shmsize)
+		close(mpcr.readCh) // 确保通道被关闭
+		err = mpcr.s.Close()
 	}
 	fmt.Println("MultiProcess Cross TEEFileReader Close")
-	return nil
+	return err
 }
 
+// Workers 返回 enclave 子进程的 PID 和退出状态
+func (mpcr *MultiProcessCrossTEEFileReader) Workers() []WorkerStatus {
+	return mpcr.s.Workers()
+}
 
 // ==================================================================================
 //				Multi-process Cross-read Flexible Keystone Encrypt
 // ==================================================================================
 
 type MultiProcessCrossTEEFileFlexibleReader struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     int64				  	// 共享内存的长度
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
+	s      *ctxStream    // 后端中与子进程共享的内存
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
-
 // NewMultiProcessCrossTEEFileFlexibleReader MultiProcessCrossTEEFileFlexibleReader
-func NewMultiProcessCrossTEEFileFlexibleReader(isAES int, FileName string, fileSize int64, flexible int) (*MultiProcessCrossTEEFileFlexibleReader, error) {
+func NewMultiProcessCrossTEEFileFlexibleReader(FileName string, fileSize int64, opts ...Option) (*MultiProcessCrossTEEFileFlexibleReader, error) {
+	return NewMultiProcessCrossTEEFileFlexibleReaderContext(context.Background(), FileName, fileSize, opts...)
+}
+
+// NewMultiProcessCrossTEEFileFlexibleReaderContext 与 NewMultiProcessCrossTEEFileFlexibleReader 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewMultiProcessCrossTEEFileFlexibleReaderContext(ctx context.Context, FileName string, fileSize int64, opts ...Option) (*MultiProcessCrossTEEFileFlexibleReader, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-	// Convert Go int to C int
-	cFileSize := C.longlong(fileSize)
+	b, req, err := newRequest(ModeCrossFlexible, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Path = FileName
+	req.Size = fileSize
 
-	cFileSize = C.long_alignedFileSize(cFileSize)
-	cBlocksNums := C.long_alignedFileSize_blocksnums(cFileSize)
-	
-	// 创建共享内存片段
-	shmsize := C.sizeof_MultiProcessCrossFlexibleSHMBuffer + (int64(cBlocksNums) * 4) + int64(cFileSize)
-	shm, err := longcreateShm(shmsize)
+	s, err := b.OpenEncrypt(req)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	reader := &MultiProcessCrossTEEFileFlexibleReader{
-		shmaddr:    shm,
-		shmsize:	shmsize,
+		s:      newCtxStream(s),
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	// 启动keystone之前先初始化内存空间
-	C.flexiblecrossInitSHM(unsafe.Pointer(&reader.shmaddr[0]), cBlocksNums);
-	// fmt.Println("MultiProcess Processing file test")
-
-	var numflexible int = 0
-	// MAXNUM 10
-	C.fixFlexibleNum(unsafe.Pointer(&flexible))
-	for numflexible < flexible {
-
-		// 启动第一个子进程，读取文件的前半部分
-		cmd := exec.Command("./flexible_cross_child_process", 
-			fmt.Sprintf("%d", isAES), 
-			fmt.Sprintf("%d", shmsize), 
-			FileName, 
-			fmt.Sprintf("%d", numflexible), 
-			fmt.Sprintf("%d", flexible),
-		)
-
-		err = cmd.Start()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start %d child process: %v\n", numflexible, err)
-			os.Exit(1)
-		}
-		numflexible++
-
+	if err := reader.s.WaitReadyContext(ctx); err != nil {
+		reader.s.Close()
+		return nil, err
 	}
 
-	C.flexiblecrosswaitKeystoneReady(unsafe.Pointer(&reader.shmaddr[0]), C.int(flexible))
-
 	return reader, nil
 }
 
-
-func MultiProcess_Cross_Flexible_Ipfs_keystone_test(isAES int, FileName string, fileSize int64, flexible int) (MultiProcessCrossTEEFileFlexibleReader){
+// MultiProcess_Cross_Flexible_Ipfs_keystone_test 是 NewMultiProcessCrossTEEFileFlexibleReader 的旧接口，返回 *MultiProcessCrossTEEFileFlexibleReader。
+//
+// Deprecated: 使用 NewMultiProcessCrossTEEFileFlexibleReader。
+func MultiProcess_Cross_Flexible_Ipfs_keystone_test(isAES int, FileName string, fileSize int64, flexible int) (*MultiProcessCrossTEEFileFlexibleReader, error) {
 
 	// 打印FileName
 	fmt.Println("MultiProcess flexible Processing file:", FileName)
 
-	reader, _ := NewMultiProcessCrossTEEFileFlexibleReader(isAES, FileName, fileSize, flexible)
-
-
-	return *reader
+	return NewMultiProcessCrossTEEFileFlexibleReader(FileName, fileSize, legacyFlexibleOptions(isAES, flexible)...)
 }
 
+func (mpcfr *MultiProcessCrossTEEFileFlexibleReader) Read(p []byte) (int, error) {
+	return mpcfr.ReadContext(context.Background(), p)
+}
 
-func (mpcfr *MultiProcessCrossTEEFileFlexibleReader)Read(p []byte) (int, error)  {
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (mpcfr *MultiProcessCrossTEEFileFlexibleReader) ReadContext(ctx context.Context, p []byte) (int, error) {
 	mpcfr.mu.Lock()
 	defer mpcfr.mu.Unlock()
 
 	if mpcfr.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	// fmt.Println("MultiProcess Processing read start")
-	var readLen C.int = 0;
-	// 交给c语言函数处理
-	result := C.MultiProcessCrossReadFlexible(unsafe.Pointer(&mpcfr.shmaddr[0]), C.int(mpcfr.shmsize), unsafe.Pointer(&p[0]), C.int(len(p)), &readLen);
-	if result == 0 {
-		return int(readLen), io.EOF
-	}
+	return mpcfr.s.ReadContext(ctx, p)
+}
 
-	// fmt.Println("MultiProcess Processing read done")
+// WriteTo 实现 io.WriterTo，io.Copy 使用它整块写到 w。只有模拟后端把完成的块直接交给 w，
+// cgo 后端每次从共享内存复制一整块到复用的缓冲区
+func (mpcfr *MultiProcessCrossTEEFileFlexibleReader) WriteTo(w io.Writer) (int64, error) {
+	mpcfr.mu.Lock()
+	defer mpcfr.mu.Unlock()
 
-	return int(readLen), nil;
+	if mpcfr.closed {
+		return 0, ErrBufferStopped
+	}
+	return mpcfr.s.WriteTo(w)
 }
 
 // Close 关闭 MultiProcessCrossTEEFileFlexibleReader 实例，释放相关资源
 func (mpcfr *MultiProcessCrossTEEFileFlexibleReader) Close() error {
-	mpcfr.mu.Lock()
+	mpcfr.s.lockForClose(&mpcfr.mu)
 	defer mpcfr.mu.Unlock()
 
+	var err error
 	if !mpcfr.closed {
 		mpcfr.closed = true
-		close(mpcfr.readCh)  // 确保通道被关闭
-		defer detachShm(mpcfr.shmaddr)
-		defer longremoveShm(mpcfr.shmsize)
+		close(mpcfr.readCh) // 确保通道被关闭
+		err = mpcfr.s.Close()
 	}
 	fmt.Println("MultiProcess Cross TEEFileReader Close")
-	return nil
+	return err
 }
 
-
+// Workers 返回 enclave 子进程的 PID 和退出状态
+func (mpcfr *MultiProcessCrossTEEFileFlexibleReader) Workers() []WorkerStatus {
+	return mpcfr.s.Workers()
+}
 
 // ==================================================================================
 //				Multi-process Keystone Decrypt
 // ==================================================================================
 
 type Shmsm struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     int64				  	// 共享内存的长度
+	shmaddr ShmRegion // 共享内存的地址
+	shmsize int64     // 共享内存的长度
 }
 
 type MultiProcessTEEDispatch struct {
-	shmsm	[]Shmsm
-	blockcount int64
-	blockbytes int64
+	s        *ctxStream
 	flexible int
-	readCh	chan struct{}          		// 通道用于通知读取完成
-	mu		sync.Mutex             		// 互斥锁，保护共享资源
-	closed	bool                   		// 标记是否已经关闭
+	readCh   chan struct{} // 通道用于通知读取完成
+	mu       sync.Mutex    // 互斥锁，保护共享资源
+	closed   bool          // 标记是否已经关闭
 }
 
 func DispathSetLength(size uint64) {
-	C.dispathSetLength(C.ulonglong(size))
+	dispathSetLength(size)
 }
 
 // 获取递增的engine_id函数
-func GetDispathEngineSeq() (uint64) {
-	return uint64(C.getDispathEngineSeq())
+func GetDispathEngineSeq() uint64 {
+	return getDispathEngineSeq()
 }
 
-// 创建一个新的共享内存段
-func dispath_longcreateShm(size int64, en_id int) ([]byte, error) {
-
-	shmaddr := C.dispath_long_create_shareMemory(C.longlong(size), C.int(en_id))
-
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:size:size], nil
-}
-
-// 断开连接共享内存
-func dispath_detachShm(shm []Shmsm, flexible int) error {
-
-	for i := 0; i < flexible; i++ {
-		C.dispath_detach_shareMemory(unsafe.Pointer(&shm[i].shmaddr[0]))
-	}
-
-	return nil
+// NewMultiProcessTEEDispatch MultiProcessTEEDispatch
+func NewMultiProcessTEEDispatch(fileSize uint64, opts ...Option) (*MultiProcessTEEDispatch, error) {
+	return NewMultiProcessTEEDispatchContext(context.Background(), fileSize, opts...)
 }
 
-// 删除共享内存段
-func dispath_longremoveShm(shm []Shmsm, flexible int) error {
-
-	for i := 0; i < flexible; i++ {
-		C.dispath_long_removeShm(C.longlong(shm[i].shmsize), C.int(i))
+// NewMultiProcessTEEDispatchContext 与 NewMultiProcessTEEDispatch 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewMultiProcessTEEDispatchContext(ctx context.Context, fileSize uint64, opts ...Option) (*MultiProcessTEEDispatch, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
 	}
 
-	return nil
-}
-
-// NewMultiProcessTEEDispatch MultiProcessTEEDispatch
-func NewMultiProcessTEEDispatch(isAES int, fileSize uint64, flexible int) (*MultiProcessTEEDispatch, error) {
-
-	// MAXNUM <= 10
-	C.fixFlexibleNum(unsafe.Pointer(&flexible))
-	
-	reader := &MultiProcessTEEDispatch{
-		shmsm:  make([]Shmsm, flexible),
-		blockcount: 0,
-		blockbytes: 0,
-		flexible: flexible,
-		readCh: make(chan struct{}, 1),
-		closed: false,
+	b, req, err := newRequest(ModeDispatch, opts)
+	if err != nil {
+		return nil, err
 	}
+	req.Size = int64(fileSize)
 
-	// // 需要调度的块总数,对256*1024向上取整
-	// cBlocksNums := C.long_alignedFileSize_blocksnums(C.longlong(fileSize))
-
-	// //每一个enclave最少需要接收的块数量和大小
-	// eblock := (int64(cBlocksNums)/flexible)
-	// esize := eblock * 256 * 1024
-
-	// // 剩下的块数量
-	// seblock := int64(cBlocksNums)%flexible
-
-	var eblock int64;
-	var seblock int64;
-	C.dispath_blocks(C.ulonglong(fileSize), unsafe.Pointer(&eblock), unsafe.Pointer(&seblock), C.int(flexible));
-
-	var shmsize int64;
-	// 创建共享内存片段
-	if (seblock == 0) {
-		for i := 0; i < flexible; i++ {
-			// 每个enclave的共享内存的大小，调度器与enclave之间
-			if (i == (flexible - 1)) {
-				if eblock == 0 {
-					shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer
-				} else {
-					shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer + (eblock - 1)*(4+262144) + (int64)(4 + (fileSize & 0x3ffff))
-				}
-				
-			} else {
-				shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer + eblock*(4+262144)
-			}
-			
-			// 每一个enclave与dispath之间都有一个共享内存
-			shm, err := dispath_longcreateShm(shmsize, i)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-				os.Exit(1)
-			}
-			reader.shmsm[i] = Shmsm{
-				shmaddr: shm,
-				shmsize: shmsize,
-			}
-			// 启动keystone之前先初始化内存空间
-			C.dispath_InitSHM(unsafe.Pointer(&reader.shmsm[i].shmaddr[0]), C.longlong(eblock));
-		}
-	} else {
-		for i := 0; i < flexible; i++ {
-			var snumber int64;
-			var snumber_size int64;
-			if seblock > 1 {
-				snumber = 1
-				snumber_size = 4 + 262144
-			} else if seblock == 1{
-				snumber = 1
-				snumber_size = (int64)(4 + (fileSize & 0x3ffff))
-			} else {
-				snumber = 0
-				snumber_size = 0
-			}
-			seblock -= 1
-			// 每个enclave的共享内存的大小，调度器与enclave之间
-			// shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer + (eblock+snumber)*(4+256*1024)
-			shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer + eblock*(4+262144) + snumber_size;
-			// 每一个enclave与dispath之间都有一个共享内存
-			shm, err := dispath_longcreateShm(shmsize, i)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-				os.Exit(1)
-			}
-			reader.shmsm[i] = Shmsm{
-				shmaddr: shm,
-				shmsize: shmsize,
-			}
-			
-			// 启动keystone之前先初始化内存空间
-			C.dispath_InitSHM(unsafe.Pointer(&reader.shmsm[i].shmaddr[0]), C.longlong(eblock+snumber));
-		}
+	s, err := b.OpenDecrypt(req)
+	if err != nil {
+		return nil, err
 	}
 
-	// fmt.Println("ipfs-keystone testing SHM")
-
-	// 获取当前ms_group的 engine_id
-	dispathEngineSeq := GetDispathEngineSeq()
-
-	for numflexible:=0;numflexible<flexible;numflexible++ {
-		// var stdout, stderr bytes.Buffer
-
-		// 启动第一个子进程，读取文件的前半部分
-		cmd := exec.Command("./dispath_child_process", 
-			fmt.Sprintf("%d", isAES), 
-			fmt.Sprintf("%d", shmsize), 
-			fmt.Sprintf("%d", numflexible), 
-			fmt.Sprintf("%d", flexible),
-			fmt.Sprintf("%d", dispathEngineSeq),
-		)
-
-		// cmd.Stdout = &stdout
-		// cmd.Stderr = &stderr
-
-		err := cmd.Start()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start %d child process: %v\n", numflexible, err)
-			os.Exit(1)
-		}
-
-		// fmt.Printf("ipfs-keystone Child %d process output:\n%s\n", numflexible, stdout.String())
-		// fmt.Printf("ipfs-keystone Child %d process err   :\n%s\n", numflexible, stderr.String())
+	reader := &MultiProcessTEEDispatch{
+		s:        newCtxStream(s),
+		flexible: req.Flexible,
+		readCh:   make(chan struct{}, 1),
+		closed:   false,
 	}
 
-	
-	// fmt.Printf("ipfs-keystone testing numberflexible Sleep 1500 ms\n")
-	// time.Sleep(1500 * time.Millisecond)
-
-	// fmt.Println("ipfs-keystone testing cmd Start")
-	
-	for i := 0; i < flexible; i++ {
-		for {
-			if (C.dispathwaitKeystoneReady(unsafe.Pointer(&reader.shmsm[i].shmaddr[0])) == 1) {
-				break
-			}
-		}
+	if err := reader.s.WaitReadyContext(ctx); err != nil {
+		reader.s.Close()
+		return nil, err
 	}
 
 	fmt.Println("ipfs-keystone testing ready")
@@ -971,87 +773,47 @@ func NewMultiProcessTEEDispatch(isAES int, fileSize uint64, flexible int) (*Mult
 	return reader, nil
 }
 
-func MultiProcess_Dispath_Ipfs_keystone_test(isAES int, flexible int) (MultiProcessTEEDispatch){
+// MultiProcess_Dispath_Ipfs_keystone_test 是 NewMultiProcessTEEDispatch 的旧接口，返回 *MultiProcessTEEDispatch。
+//
+// Deprecated: 使用 NewMultiProcessTEEDispatch。
+func MultiProcess_Dispath_Ipfs_keystone_test(isAES int, flexible int) (*MultiProcessTEEDispatch, error) {
 
 	// 打印
 	fmt.Println("MultiProcess dispath Processing...")
 
 	// 获取总大小
-	var fileSize uint64
-	C.dispathGetLength((*C.ulonglong)(unsafe.Pointer(&fileSize)))
-
-	reader, _ := NewMultiProcessTEEDispatch(isAES, fileSize, flexible)
-
+	fileSize := dispathGetLength()
 
-	return *reader
+	return NewMultiProcessTEEDispatch(fileSize, legacyFlexibleOptions(isAES, flexible)...)
 }
 
 // Write 实现io.Write接口的方法，从p切片读取数据到缓冲区
 func (MPDispath *MultiProcessTEEDispatch) Write(p []byte) (int, error) {
+	return MPDispath.WriteContext(context.Background(), p)
+}
+
+// WriteContext 与 Write 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的写入返回 ErrBufferStopped
+func (MPDispath *MultiProcessTEEDispatch) WriteContext(ctx context.Context, p []byte) (int, error) {
 	MPDispath.mu.Lock()
 	defer MPDispath.mu.Unlock()
 
 	if MPDispath.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var readLen C.int = 0;
-	
-	// fmt.Println("ipfs testing dispath 1 block blockcount=%d", MPDispath.blockcount)
-	// fmt.Println("ipfs testing dispath 1 block blockbytes=%d", MPDispath.blockbytes)
-
-	var sbytes int64 = int64(262144 - (MPDispath.blockbytes + int64(len(p))))
-
-	var bnumber int64;
-	
-	bnumber = MPDispath.blockcount % int64(MPDispath.flexible)
-
-	if sbytes >= 0 {
-		result := C.dispath_data_block_4096(unsafe.Pointer(&MPDispath.shmsm[bnumber].shmaddr[0]), C.longlong(MPDispath.shmsm[bnumber].shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
-		MPDispath.blockbytes = MPDispath.blockbytes+int64(len(p))
-		// fmt.Println("ipfs testing dispath block only bnumber=%d, len=%d", bnumber, len(p))
-		if sbytes == 0 {
-			MPDispath.blockbytes = 0
-			MPDispath.blockcount++
-		}
-		if result == 0 {
-			return int(readLen), io.EOF
-		}
-	} else {
-		var syx int = int(262144 - MPDispath.blockbytes)
-		result := C.dispath_data_block_4096(unsafe.Pointer(&MPDispath.shmsm[bnumber].shmaddr[0]), C.longlong(MPDispath.shmsm[bnumber].shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(syx), &readLen)
-		// fmt.Println("ipfs testing dispath block oonly bnumber=%d, len=%d", bnumber, syx)
-		if result == 0 {
-			return int(readLen), io.EOF
-		}
-		MPDispath.blockcount++
+	return MPDispath.s.WriteContext(ctx, p)
+}
 
-		bnumber = MPDispath.blockcount % int64(MPDispath.flexible)
-		var readLen1 C.int = 0;
-		result = C.dispath_data_block_4096(unsafe.Pointer(&MPDispath.shmsm[bnumber].shmaddr[0]), C.longlong(MPDispath.shmsm[bnumber].shmsize), (*C.char)(unsafe.Pointer(&p[syx])), C.int(len(p) - syx), &readLen1)
-		// fmt.Println("ipfs testing dispath block oonly bnumber=%d, len=%d", bnumber, len(p) - syx)
+// ReadFrom 实现 io.ReaderFrom，io.Copy 使用它整块交给 enclave。只有模拟后端把 r 的内容
+// 直接读进块槽，cgo 后端每次读满复用的缓冲区再复制到共享内存
+func (MPDispath *MultiProcessTEEDispatch) ReadFrom(r io.Reader) (int64, error) {
+	MPDispath.mu.Lock()
+	defer MPDispath.mu.Unlock()
 
-		MPDispath.blockbytes = int64(len(p) - syx)
-		readLen = readLen + readLen1
-		if result == 0 {
-			return int(readLen), io.EOF
-		}
+	if MPDispath.closed {
+		return 0, ErrBufferStopped
 	}
-
-	return int(readLen), nil
-
-	// // var bnumber int64 = int64(C.dispathBNumber((*C.longlong)(unsafe.Pointer(&MPDispath.blockcount)), C.int(MPDispath.flexible)))
-	// var bnumber int64 = int64(C.dispathBNumber_4096((*C.longlong)(unsafe.Pointer(&MPDispath.blockbytes)), (*C.longlong)(unsafe.Pointer(&MPDispath.blockcount)), C.int(MPDispath.flexible), C.int(len(p))))
-	// fmt.Println("ipfs testing dispath 1 block data %d", bnumber)
-	// result := C.dispath_data_block(unsafe.Pointer(&MPDispath.shmsm[bnumber].shmaddr[0]), C.longlong(MPDispath.shmsm[bnumber].shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
-	// fmt.Println("ipfs testing dispath 1 block data done bnumber=%d", bnumber)
-	// fmt.Println("ipfs testing dispath 1 block data done blockcount=%d", MPDispath.blockcount)
-	// fmt.Println("ipfs testing dispath 1 block data done result=%d", result)
-	// if result == 0 {
-	// 	return int(readLen), io.EOF
-	// }
-	// fmt.Println("ipfs testing dispath 1 block data done %d", MPDispath.blockcount)
-	// return int(readLen), nil
+	return MPDispath.s.ReadFrom(r)
 }
 
 // Close 关闭TEEFileReader实例，释放相关资源
@@ -1059,164 +821,119 @@ func (MPDispath *MultiProcessTEEDispatch) Close() error {
 	MPDispath.mu.Lock()
 	defer MPDispath.mu.Unlock()
 
+	var err error
 	if !MPDispath.closed {
 		MPDispath.closed = true
-		close(MPDispath.readCh)  // 确保通道被关闭
-		// defer detachShm(MPDispath.shmaddr)
+		close(MPDispath.readCh) // 确保通道被关闭
 
 		// 等待 Keystone done
 		fmt.Println("ipfs testing wait keystone done")
-		for i := 0; i < MPDispath.flexible; i++ {
-			for {
-				if (C.dispathwaitKeystoneReady(unsafe.Pointer(&MPDispath.shmsm[i].shmaddr[0])) == 2) {
-					break
-				}
-			}
+		err = MPDispath.s.WaitDone()
+		if cerr := MPDispath.s.Close(); err == nil {
+			err = cerr
 		}
-		defer dispath_detachShm(MPDispath.shmsm, MPDispath.flexible)
-		defer dispath_longremoveShm(MPDispath.shmsm, MPDispath.flexible)
 	}
 	fmt.Println("TEEWriterDispath Close")
-	return nil
+	return err
 }
 
+// Workers 返回 enclave 子进程的 PID 和退出状态
+func (MPDispath *MultiProcessTEEDispatch) Workers() []WorkerStatus {
+	return MPDispath.s.Workers()
+}
 
 // ==================================================================================
 //				Multi-process Keystone Decrypt secure dispatch
 // ==================================================================================
 
 type MultiProcessTEESecureDispatch struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     uint64				  	// 共享内存的长度
-	blockNum 	uint64
-	blockcount int64
-	blockbytes int64
+	s        *ctxStream
 	flexible int
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
-}
-
-// 创建一个新的共享内存段
-func secure_dispatch_ulonglongcreateShm(shmsize uint64) ([]byte, error) {
-
-	shmaddr := C.secure_dispatch_ulnoglong_create_shareMemory(C.ulonglong(shmsize))
-
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:shmsize:shmsize], nil
+	readCh   chan struct{} // 通道用于通知读取完成
+	mu       sync.Mutex    // 互斥锁，保护共享资源
+	closed   bool          // 标记是否已经关闭
 }
 
 // NewMultiProcessTEESecureDispatch MultiProcessTEESecureDispatch
-func NewMultiProcessTEESecureDispatch(isAES int, fileSize uint64, flexible int) (*MultiProcessTEESecureDispatch, error) {
+func NewMultiProcessTEESecureDispatch(fileSize uint64, opts ...Option) (*MultiProcessTEESecureDispatch, error) {
+	return NewMultiProcessTEESecureDispatchContext(context.Background(), fileSize, opts...)
+}
 
-	// MAXNUM <= 10
-	C.fixFlexibleNum(unsafe.Pointer(&flexible))
+// NewMultiProcessTEESecureDispatchContext 与 NewMultiProcessTEESecureDispatch 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewMultiProcessTEESecureDispatchContext(ctx context.Context, fileSize uint64, opts ...Option) (*MultiProcessTEESecureDispatch, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-	// 创建共享内存片段
-	var blockNum uint64
-	shmsize := uint64(C.MultiProcessTEESecureDispatchGetSHMSize(C.ulonglong(fileSize), unsafe.Pointer(&blockNum), C.int(flexible)))
-	shmaddr, err := secure_dispatch_ulonglongcreateShm(shmsize)
+	b, req, err := newRequest(ModeSecureDispatch, opts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
-	
-	reader := &MultiProcessTEESecureDispatch{
-		shmaddr:    shmaddr,
-		shmsize:	shmsize,
-		blockNum: 	blockNum,
-		blockcount: 0,
-		blockbytes: 0,
-		flexible: 	flexible,
-		readCh: 	make(chan struct{}, 1),
-		closed: 	false,
-	}
-
-	C.secure_dispacth_initSHM(unsafe.Pointer(&reader.shmaddr[0]), C.ulonglong(blockNum), C.int(flexible));
-
-	// fmt.Println("ipfs-keystone testing SHM")
-
-	// 获取当前ms_group的 engine_id  
-	// dispatch
-	dispatchEngineSeq := GetDispathEngineSeq()
-
-	for numflexible:=0;numflexible<flexible;numflexible++ {
-		// var stdout, stderr bytes.Buffer
-
-		// 启动第一个子进程，读取文件的前半部分
-		cmd := exec.Command("./secure_dispatch_child_process", 
-			fmt.Sprintf("%d", isAES), 
-			fmt.Sprintf("%d", shmsize), 
-			fmt.Sprintf("%d", numflexible), 
-			fmt.Sprintf("%d", flexible),
-			fmt.Sprintf("%d", dispatchEngineSeq),
-		)
-
-		// cmd.Stdout = &stdout
-		// cmd.Stderr = &stderr
-
-		err := cmd.Start()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start %d child process: %v\n", numflexible, err)
-			os.Exit(1)
-		}
+	req.Size = int64(fileSize)
 
-		// fmt.Printf("ipfs-keystone Child %d process output:\n%s\n", numflexible, stdout.String())
-		// fmt.Printf("ipfs-keystone Child %d process err   :\n%s\n", numflexible, stderr.String())
+	s, err := b.OpenDecrypt(req)
+	if err != nil {
+		return nil, err
 	}
 
-	
-	// fmt.Printf("ipfs-keystone testing numberflexible Sleep 1500 ms\n")
-	// time.Sleep(1500 * time.Millisecond)
+	reader := &MultiProcessTEESecureDispatch{
+		s:        newCtxStream(s),
+		flexible: req.Flexible,
+		readCh:   make(chan struct{}, 1),
+		closed:   false,
+	}
 
-	// fmt.Println("ipfs-keystone testing cmd Start")
-	
-	C.secure_dispatch_waitKeystoneReady(unsafe.Pointer(&reader.shmaddr[0]), C.int(flexible))
+	if err := reader.s.WaitReadyContext(ctx); err != nil {
+		reader.s.Close()
+		return nil, err
+	}
 
 	fmt.Println("ipfs-keystone testing ready")
 
 	return reader, nil
 }
 
-func MultiProcess_Secure_Dispatch_Ipfs_keystone_test(isAES int, flexible int) (MultiProcessTEESecureDispatch){
+// MultiProcess_Secure_Dispatch_Ipfs_keystone_test 是 NewMultiProcessTEESecureDispatch 的旧接口，返回 *MultiProcessTEESecureDispatch。
+//
+// Deprecated: 使用 NewMultiProcessTEESecureDispatch。
+func MultiProcess_Secure_Dispatch_Ipfs_keystone_test(isAES int, flexible int) (*MultiProcessTEESecureDispatch, error) {
 
 	// 打印
 	fmt.Println("MultiProcess secure dispatch Processing...")
 
 	// 获取总大小
-	var fileSize uint64
-	C.dispathGetLength((*C.ulonglong)(unsafe.Pointer(&fileSize)))
-
-	reader, _ := NewMultiProcessTEESecureDispatch(isAES, fileSize, flexible)
-
+	fileSize := dispathGetLength()
 
-	return *reader
+	return NewMultiProcessTEESecureDispatch(fileSize, legacyFlexibleOptions(isAES, flexible)...)
 }
 
 // Write 实现io.Write接口的方法，从p切片读取数据到缓冲区
 func (MPSecureDispath *MultiProcessTEESecureDispatch) Write(p []byte) (int, error) {
+	return MPSecureDispath.WriteContext(context.Background(), p)
+}
+
+// WriteContext 与 Write 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的写入返回 ErrBufferStopped
+func (MPSecureDispath *MultiProcessTEESecureDispatch) WriteContext(ctx context.Context, p []byte) (int, error) {
 	MPSecureDispath.mu.Lock()
 	defer MPSecureDispath.mu.Unlock()
 
 	if MPSecureDispath.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var readLen C.int = 0;
-	
-	// fmt.Println("ipfs testing dispath 1 block blockcount=%d", MPSecureDispath.blockcount)
-	// fmt.Println("ipfs testing dispath 1 block blockbytes=%d", MPSecureDispath.blockbytes)
+	return MPSecureDispath.s.WriteContext(ctx, p)
+}
 
-	result := C.secure_dispatch_write(unsafe.Pointer(&MPSecureDispath.shmaddr[0]), C.longlong(MPSecureDispath.shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen, C.int(MPSecureDispath.flexible))
+// ReadFrom 实现 io.ReaderFrom，io.Copy 使用它整块交给 enclave。只有模拟后端把 r 的内容
+// 直接读进块槽，cgo 后端每次读满复用的缓冲区再复制到共享内存
+func (MPSecureDispath *MultiProcessTEESecureDispatch) ReadFrom(r io.Reader) (int64, error) {
+	MPSecureDispath.mu.Lock()
+	defer MPSecureDispath.mu.Unlock()
 
-	if result == 0 {
-		return int(readLen), io.EOF
+	if MPSecureDispath.closed {
+		return 0, ErrBufferStopped
 	}
-
-	return int(readLen), nil
+	return MPSecureDispath.s.ReadFrom(r)
 }
 
 // Close 关闭TEEFileReader实例，释放相关资源
@@ -1224,193 +941,181 @@ func (MPSecureDispath *MultiProcessTEESecureDispatch) Close() error {
 	MPSecureDispath.mu.Lock()
 	defer MPSecureDispath.mu.Unlock()
 
+	var err error
 	if !MPSecureDispath.closed {
 		MPSecureDispath.closed = true
-		close(MPSecureDispath.readCh)  // 确保通道被关闭
-		// defer detachShm(MPSecureDispath.shmaddr)
+		close(MPSecureDispath.readCh) // 确保通道被关闭
 
 		// 等待 Keystone done
 		fmt.Println("ipfs testing wait keystone done")
-		C.secure_dispatch_waitKeystoneDone(unsafe.Pointer(&MPSecureDispath.shmaddr[0]), C.int(MPSecureDispath.flexible))
-
-		// 断开连接共享内存
-		defer C.secure_dispatch_detach_shareMemory(unsafe.Pointer(&MPSecureDispath.shmaddr[0]))
-		// 删除共享内存段
-		defer C.secure_dispatch_ulnoglong_remove_shareMemory(C.ulonglong(MPSecureDispath.shmsize))
+		err = MPSecureDispath.s.WaitDone()
+		if cerr := MPSecureDispath.s.Close(); err == nil {
+			err = cerr
+		}
 	}
 	fmt.Println("TEEWriterSeucreDispacth Close")
-	return nil
+	return err
 }
 
+// Workers 返回 enclave 子进程的 PID 和退出状态
+func (MPSecureDispath *MultiProcessTEESecureDispatch) Workers() []WorkerStatus {
+	return MPSecureDispath.s.Workers()
+}
 
 // ==================================================================================
 //				The new dir Multi-process Keystone Decrypt secure dispatch
 // ==================================================================================
 
 type TheNewDirMultiProcessTEESecureDispatch struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     uint64				  	// 共享内存的长度
-	shmaddr_justcall     []byte				  	// 共享内存的地址
-	shmsize_justcall     uint64				  	// 共享内存的长度
-	fileCount	int64
-	blockNum 	uint64
-	blockcount int64
-	blockbytes int64
-	flexible int
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
+	s         *ctxStream
+	fileCount int64
+	flexible  int
+	readCh    chan struct{} // 通道用于通知读取完成
+	mu        sync.Mutex    // 互斥锁，保护共享资源
+	closed    bool          // 标记是否已经关闭
 }
 
 type TheNewDirMultiProcessTEESecureDispatchJustCall struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     uint64				  	// 共享内存的长度
-	fileCount   int64
-	flexible int
+	ss                 Session
+	fileCount          int64
+	flexible           int
 	transferfilereader *TheNewDirMultiProcessTEESecureDispatch
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
-}
-
-// 创建一个新的共享内存段
-func the_new_secure_dispatch_ulonglongcreateShm_just_call(shmsize uint64) ([]byte, error) {
-
-	shmaddr := C.the_new_dir_secure_dispatch_ulnoglong_create_shareMemory_just_call(C.ulonglong(shmsize))
-
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:shmsize:shmsize], nil
+	readCh             chan struct{} // 通道用于通知读取完成
+	mu                 sync.Mutex    // 互斥锁，保护共享资源
+	closed             bool          // 标记是否已经关闭
 }
 
 // NewTheNewDirMultiProcessTEESecureDispatchJustCall TheNewDirMultiProcessTEESecureDispatchJustCall
 // Just call keystone, it cant receive data dont know size
-func NewTheNewDirMultiProcessTEESecureDispatchJustCall(isAES int, flexible int) (*TheNewDirMultiProcessTEESecureDispatchJustCall, error) {
+func NewTheNewDirMultiProcessTEESecureDispatchJustCall(opts ...Option) (*TheNewDirMultiProcessTEESecureDispatchJustCall, error) {
+	return NewTheNewDirMultiProcessTEESecureDispatchJustCallContext(context.Background(), opts...)
+}
 
-	// MAXNUM <= 10
-	C.fixFlexibleNum(unsafe.Pointer(&flexible))
+// NewTheNewDirMultiProcessTEESecureDispatchJustCallContext 与 NewTheNewDirMultiProcessTEESecureDispatchJustCall 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewTheNewDirMultiProcessTEESecureDispatchJustCallContext(ctx context.Context, opts ...Option) (*TheNewDirMultiProcessTEESecureDispatchJustCall, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-	// 创建共享内存片段
-	shmsize := uint64(C.TheNewDirMultiProcessTEESecureDispatchGetSHMSizeJustCall(C.int(flexible)))
-	shmaddr, err := the_new_secure_dispatch_ulonglongcreateShm_just_call(shmsize)
+	b, req, err := newRequest(ModeSecureDispatch, opts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
-	
+
+	ss, err := b.OpenDecryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+
 	reader := &TheNewDirMultiProcessTEESecureDispatchJustCall{
-		shmaddr:    shmaddr,
-		shmsize:	shmsize,
-		flexible: 	flexible,
+		ss:                 ss,
+		flexible:           req.Flexible,
 		transferfilereader: nil,
-		fileCount:	0,
-		readCh: 	make(chan struct{}, 1),
-		closed: 	false,
+		fileCount:          0,
+		readCh:             make(chan struct{}, 1),
+		closed:             false,
 	}
 
-	C.the_new_secure_dispacth_initSHM_just_call(unsafe.Pointer(&reader.shmaddr[0]), C.int(flexible));
-
-	// 获取当前ms_group的 engine_id  
-	// dispatch
-	dispatchEngineSeq := GetDispathEngineSeq()
-
-	for numflexible:=0;numflexible<flexible;numflexible++ {
-
-		// 启动第一个子进程，读取文件的前半部分
-		cmd := exec.Command("./the_new_dir_secure_dispatch_child_process", 
-			fmt.Sprintf("%d", isAES), 
-			fmt.Sprintf("%d", shmsize), 
-			fmt.Sprintf("%d", numflexible), 
-			fmt.Sprintf("%d", flexible),
-			fmt.Sprintf("%d", dispatchEngineSeq),
-		)
-
-		err := cmd.Start()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start %d child process: %v\n", numflexible, err)
-			os.Exit(1)
-		}
+	if err := waitSessionReady(ctx, ss); err != nil {
+		ss.Abort()
+		return nil, err
 	}
-	
-	C.the_new_secure_dispatch_waitKeystoneReady_just_call(unsafe.Pointer(&reader.shmaddr[0]), C.int(flexible))
 
 	fmt.Println("ipfs-keystone testing ready just call")
 
 	return reader, nil
 }
 
-func The_New_DIR_MultiProcess_Secure_Dispatch_Ipfs_keystone_test(isAES int, flexible int) (TheNewDirMultiProcessTEESecureDispatchJustCall){
+// The_New_DIR_MultiProcess_Secure_Dispatch_Ipfs_keystone_test 是 NewTheNewDirMultiProcessTEESecureDispatchJustCall 的旧接口，返回 *TheNewDirMultiProcessTEESecureDispatchJustCall。
+//
+// Deprecated: 使用 NewTheNewDirMultiProcessTEESecureDispatchJustCall。
+func The_New_DIR_MultiProcess_Secure_Dispatch_Ipfs_keystone_test(isAES int, flexible int) (*TheNewDirMultiProcessTEESecureDispatchJustCall, error) {
 
 	// 打印
 	fmt.Println("The new dir multiProcess secure dispatch Processing...")
 
-	reader, _ := NewTheNewDirMultiProcessTEESecureDispatchJustCall(isAES, flexible)
-
-	return *reader
+	return NewTheNewDirMultiProcessTEESecureDispatchJustCall(legacyFlexibleOptions(isAES, flexible)...)
 }
 
-// set filesize
-func TheNewDirSecureDispathSetLength(tee_just_call_reader *TheNewDirMultiProcessTEESecureDispatchJustCall, shmsize uint64){
-	var blockNum uint64
-	// fmt.Printf("shmsize: %d\n", shmsize)
-	shmaddr := C.thenewdirsecuredispathSetLength(unsafe.Pointer(&tee_just_call_reader.shmaddr[0]), unsafe.Pointer(&blockNum), unsafe.Pointer(&shmsize), C.int(tee_just_call_reader.flexible))
-
-	// fmt.Printf("shmsize: %d\n", shmsize)
+// TheNewDirSecureDispathSetLength 设置下一个文件的长度，shmsize 为 0 时结束会话。
+// 失败时返回错误，之后的 TheNewDirSecureDispathWaitTransferKeystoneReady 返回 ErrInvalidOptions
+func TheNewDirSecureDispathSetLength(tee_just_call_reader *TheNewDirMultiProcessTEESecureDispatchJustCall, shmsize uint64) error {
+	tee_just_call_reader.transferfilereader = nil
 	if shmsize == 0 {
 		tee_just_call_reader.fileCount = 0
-		return
+		return tee_just_call_reader.ss.End()
+	}
+
+	s, err := tee_just_call_reader.ss.NextDecrypt(shmsize)
+	if err == nil && s == nil {
+		err = fmt.Errorf("%w: no shared memory for %d bytes", ErrShmCreate, shmsize)
+	}
+	if err != nil {
+		tee_just_call_reader.fileCount = 0
+		return err
 	}
 	tee_just_call_reader.fileCount++
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 4GB
+
 	reader := &TheNewDirMultiProcessTEESecureDispatch{
-		shmaddr:    (*[1 << 32]byte)(shmaddr)[:shmsize:shmsize],
-		shmsize:	shmsize,
-		shmaddr_justcall:   tee_just_call_reader.shmaddr,
-		shmsize_justcall:	tee_just_call_reader.shmsize,
-		flexible: 	tee_just_call_reader.flexible,
-		blockNum: 	blockNum,
-		fileCount:	tee_just_call_reader.fileCount,
-		blockcount: 0,
-		blockbytes: 0,
-		readCh: 	make(chan struct{}, 1),
-		closed: 	false,
-	}
-	
+		s:         newCtxStream(s),
+		flexible:  tee_just_call_reader.flexible,
+		fileCount: tee_just_call_reader.fileCount,
+		readCh:    make(chan struct{}, 1),
+		closed:    false,
+	}
+
 	tee_just_call_reader.transferfilereader = reader
+	return nil
 }
 
-func TheNewDirSecureDispathWaitTransferKeystoneReady(tee_just_call_reader *TheNewDirMultiProcessTEESecureDispatchJustCall)(*TheNewDirMultiProcessTEESecureDispatch) {
-	C.the_new_secure_dispatch_wait_transfer_keystone_ready(unsafe.Pointer(&tee_just_call_reader.shmaddr[0]), C.int(tee_just_call_reader.flexible))
-	return tee_just_call_reader.transferfilereader
+// Workers 返回 enclave 子进程的 PID 和退出状态
+func (tee_just_call_reader *TheNewDirMultiProcessTEESecureDispatchJustCall) Workers() []WorkerStatus {
+	return sessionWorkers(tee_just_call_reader.ss)
 }
 
+// TheNewDirSecureDispathWaitTransferKeystoneReady 等待 TheNewDirSecureDispathSetLength 打开的文件就绪。
+// enclave 启动失败时关闭这个文件的数据流并返回错误
+func TheNewDirSecureDispathWaitTransferKeystoneReady(tee_just_call_reader *TheNewDirMultiProcessTEESecureDispatchJustCall) (*TheNewDirMultiProcessTEESecureDispatch, error) {
+	reader := tee_just_call_reader.transferfilereader
+	if reader == nil {
+		return nil, fmt.Errorf("%w: file length not set", ErrInvalidOptions)
+	}
+	tee_just_call_reader.transferfilereader = nil
+
+	if err := reader.s.WaitReady(); err != nil {
+		reader.s.Close()
+		return nil, err
+	}
+	return reader, nil
+}
 
 // Write 实现io.Write接口的方法，从p切片读取数据到缓冲区
 func (theNDMPSecureDispath *TheNewDirMultiProcessTEESecureDispatch) Write(p []byte) (int, error) {
+	return theNDMPSecureDispath.WriteContext(context.Background(), p)
+}
+
+// WriteContext 与 Write 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的写入返回 ErrBufferStopped
+func (theNDMPSecureDispath *TheNewDirMultiProcessTEESecureDispatch) WriteContext(ctx context.Context, p []byte) (int, error) {
 	theNDMPSecureDispath.mu.Lock()
 	defer theNDMPSecureDispath.mu.Unlock()
 
 	if theNDMPSecureDispath.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var readLen C.int = 0;
-	
-	// fmt.Println("ipfs testing dispath 1 block blockcount=%d", theNDMPSecureDispath.blockcount)
-	// fmt.Println("ipfs testing dispath 1 block blockbytes=%d", theNDMPSecureDispath.blockbytes)
+	return theNDMPSecureDispath.s.WriteContext(ctx, p)
+}
 
-	result := C.the_new_secure_dispatch_write(unsafe.Pointer(&theNDMPSecureDispath.shmaddr[0]), C.longlong(theNDMPSecureDispath.shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen, C.int(theNDMPSecureDispath.flexible))
+// ReadFrom 实现 io.ReaderFrom，io.Copy 使用它整块交给 enclave。只有模拟后端把 r 的内容
+// 直接读进块槽，cgo 后端每次读满复用的缓冲区再复制到共享内存
+func (theNDMPSecureDispath *TheNewDirMultiProcessTEESecureDispatch) ReadFrom(r io.Reader) (int64, error) {
+	theNDMPSecureDispath.mu.Lock()
+	defer theNDMPSecureDispath.mu.Unlock()
 
-	if result == 0 {
-		return int(readLen), io.EOF
+	if theNDMPSecureDispath.closed {
+		return 0, ErrBufferStopped
 	}
-
-	return int(readLen), nil
+	return theNDMPSecureDispath.s.ReadFrom(r)
 }
 
 // Close 关闭TEEFileReader实例，释放相关资源
@@ -1418,488 +1123,426 @@ func (theNDMPSecureDispath *TheNewDirMultiProcessTEESecureDispatch) Close() erro
 	theNDMPSecureDispath.mu.Lock()
 	defer theNDMPSecureDispath.mu.Unlock()
 
+	var err error
 	if !theNDMPSecureDispath.closed {
 		theNDMPSecureDispath.closed = true
-		close(theNDMPSecureDispath.readCh)  // 确保通道被关闭
-		// defer detachShm(theNDMPSecureDispath.shmaddr)
+		close(theNDMPSecureDispath.readCh) // 确保通道被关闭
 
 		// 等待 Keystone done
 		fmt.Println("ipfs testing wait keystone done")
-		C.the_new_secure_dispatch_wait_transfer_keystoneDone(unsafe.Pointer(&theNDMPSecureDispath.shmaddr_justcall[0]), C.int(theNDMPSecureDispath.flexible))
-
-		// fmt.Printf("fileCount: %d\n", theNDMPSecureDispath.fileCount)
-		// 断开连接共享内存
-		defer C.the_new_secure_dispatch_detach_shareMemory(unsafe.Pointer(&theNDMPSecureDispath.shmaddr[0]))
-		// 删除共享内存段
-		defer C.the_new_secure_dispatch_ulnoglong_remove_shareMemory(C.ulonglong(theNDMPSecureDispath.shmsize), C.longlong(theNDMPSecureDispath.fileCount))
+		err = theNDMPSecureDispath.s.WaitDone()
+		if cerr := theNDMPSecureDispath.s.Close(); err == nil {
+			err = cerr
+		}
 	}
 	fmt.Println("the New TEEWriterSeucreDispacth Close")
-	return nil
+	return err
 }
 
-
 // ==================================================================================
 //				The new dir Keystone Decrypt
 // ==================================================================================
 
 type TheNewDirTEEFileReaderJustCall struct {
-	rb     *C.RingBuffer          // 指向C语言中的RingBuffer结构
-	kjb    *C.KeystoneJustReady          
-	readCh chan struct{}          // 通道用于通知读取完成
-	wg     sync.WaitGroup         // 等待组用于等待后台goroutine完成
-	mu     sync.Mutex             // 互斥锁，保护共享资源
-	closed bool                   // 标记是否已经关闭
+	ss     Session
+	next   Stream        // TheNewDirKeystoneDecryptSetLength 设置的下一个文件
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
 // TheNewDirTEEFileReader 结构体封装了环形缓冲区的相关操作
 type TheNewDirTEEFileReader struct {
-	rb     *C.RingBuffer          // 指向C语言中的RingBuffer结构
-	kjb    *C.KeystoneJustReady
-	readCh chan struct{}          // 通道用于通知读取完成
-	wg     sync.WaitGroup         // 等待组用于等待后台goroutine完成
-	mu     sync.Mutex             // 互斥锁，保护共享资源
-	closed bool                   // 标记是否已经关闭
+	s      *ctxStream
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
-func NewTheNewDirTEEFileReaderJustCall(isAES int, FileName string) (*TheNewDirTEEFileReaderJustCall, error) {
+func NewTheNewDirTEEFileReaderJustCall(FileName string, opts ...Option) (*TheNewDirTEEFileReaderJustCall, error) {
+	return NewTheNewDirTEEFileReaderJustCallContext(context.Background(), FileName, opts...)
+}
 
-	kjb := (*C.KeystoneJustReady)(C.malloc(C.sizeof_KeystoneJustReady))
-	if kjb == nil { // 检查内存分配是否成功
-		return nil, fmt.Errorf("failed to allocate memory for KeystoneJustReady")
+// NewTheNewDirTEEFileReaderJustCallContext 与 NewTheNewDirTEEFileReaderJustCall 相同，ctx 结束时停止 enclave、杀死子进程并释放资源。
+// 设置了 WithPlaintextWriter 时所有文件的明文依次写到这个 io.Writer，FileName 不使用，
+// TheNewDirKeystoneDecryptSetLength(…, 0) 等明文写完之后返回
+func NewTheNewDirTEEFileReaderJustCallContext(ctx context.Context, FileName string, opts ...Option) (*TheNewDirTEEFileReaderJustCall, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
 	}
 
-	rb := (*C.RingBuffer)(C.malloc(C.sizeof_RingBuffer))
-	if rb == nil { // 检查内存分配是否成功
-		return nil, fmt.Errorf("failed to allocate memory for RingBuffer")
+	b, req, err := newRequest(ModeSingle, opts)
+	if err != nil {
+		return nil, err
 	}
+	req.Path = FileName
 
-	// Convert Go int to C int
-	cIsAES := C.int(isAES)
-
-	C.init_keystone_just_ready(kjb)
-	C.init_ring_buffer(rb)
+	ss, err := b.OpenDecryptSession(req)
+	if err != nil {
+		return nil, err
+	}
 
 	kjbreader := &TheNewDirTEEFileReaderJustCall{
-		kjb:     kjb,
-		rb:     rb,
+		ss:     ss,
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	kjbreader.wg.Add(1)
-	go func() {
-		defer kjbreader.wg.Done() // 确保在goroutine结束时调用Done
-		C.the_new_dir_ipfs_keystone_de(cIsAES, unsafe.Pointer(C.CString(FileName)), unsafe.Pointer(kjb), unsafe.Pointer(rb))
-		fmt.Println("the new dir TEE read file done")
-	}()
-
-	C.the_new_dir_keystone_wait_ready(unsafe.Pointer(kjb))
+	if err := waitSessionReady(ctx, ss); err != nil {
+		ss.Abort()
+		return nil, err
+	}
 
 	return kjbreader, nil
 }
 
-func The_New_DIR_Ipfs_keystone_test_de(isAES int, FileName string) (TheNewDirTEEFileReaderJustCall){
+// The_New_DIR_Ipfs_keystone_test_de 是 NewTheNewDirTEEFileReaderJustCall 的旧接口，返回 *TheNewDirTEEFileReaderJustCall。
+//
+// Deprecated: 使用 NewTheNewDirTEEFileReaderJustCall。
+func The_New_DIR_Ipfs_keystone_test_de(isAES int, FileName string) (*TheNewDirTEEFileReaderJustCall, error) {
 
 	// 打印FileName
 	fmt.Println("The New Dir Get file:", FileName)
 
-	kjbreader, _ := NewTheNewDirTEEFileReaderJustCall(isAES, FileName)
-
-	return *kjbreader
+	return NewTheNewDirTEEFileReaderJustCall(FileName, legacyOptions(isAES)...)
 }
 
-// set filesize
-func TheNewDirKeystoneDecryptSetLength(kjbreader *TheNewDirTEEFileReaderJustCall, shmsize uint64){
-	// fmt.Printf("shmsize: %d\n", shmsize)
-	C.thenewdirkeystonedecryptSetLength(unsafe.Pointer(kjbreader.kjb), C.ulonglong(shmsize))
-
-	// fmt.Printf("shmsize: %d\n", shmsize)
+// TheNewDirKeystoneDecryptSetLength 设置下一个文件的长度，shmsize 为 0 时结束会话。
+// 失败时返回错误，之后的 TheNewDirWaitKeystoneFileReady 也返回错误
+func TheNewDirKeystoneDecryptSetLength(kjbreader *TheNewDirTEEFileReaderJustCall, shmsize uint64) error {
+	kjbreader.next = nil
 	if shmsize == 0 {
-		return
+		return kjbreader.ss.End()
+	}
+
+	s, err := kjbreader.ss.NextDecrypt(shmsize)
+	if err != nil {
+		return err
 	}
-	// return
+	kjbreader.next = s
+	return nil
 }
 
-func TheNewDirWaitKeystoneFileReady(kjbreader *TheNewDirTEEFileReaderJustCall) (TheNewDirTEEFileReader) {
-	C.the_new_dir_wait_keystone_file_ready(unsafe.Pointer(kjbreader.kjb))
+// TheNewDirWaitKeystoneFileReady 等待 enclave 准备好接收下一个文件，返回写入密文的 *TheNewDirTEEFileReader。
+// 没有成功调用 TheNewDirKeystoneDecryptSetLength 时返回 ErrInvalidOptions
+func TheNewDirWaitKeystoneFileReady(kjbreader *TheNewDirTEEFileReaderJustCall) (*TheNewDirTEEFileReader, error) {
+	next := kjbreader.next
+	if next == nil {
+		return nil, fmt.Errorf("%w: file length not set", ErrInvalidOptions)
+	}
+	kjbreader.next = nil
 
-	rbreader := &TheNewDirTEEFileReader {
-		kjb:    kjbreader.kjb,
-		rb:     kjbreader.rb,
+	rbreader := &TheNewDirTEEFileReader{
+		s:      newCtxStream(next),
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
+	if err := rbreader.s.WaitReady(); err != nil {
+		rbreader.s.Close()
+		return nil, err
+	}
 
-	return *rbreader
+	return rbreader, nil
 }
 
-
 // Write 实现io.Write接口的方法，从p切片读取数据到缓冲区
 func (r *TheNewDirTEEFileReader) Write(p []byte) (int, error) {
-	// fmt.Printf("test 3\n");
+	return r.WriteContext(context.Background(), p)
+}
+
+// WriteContext 与 Write 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的写入返回 ErrBufferStopped
+func (r *TheNewDirTEEFileReader) WriteContext(ctx context.Context, p []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if r.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var wrsult C.int = 0;
-	wrsult = C.ring_buffer_write((*C.RingBuffer)(r.rb), (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
-	if wrsult == 0 { // 检查ring_buffer_write的结果
-		return int(wrsult), io.EOF
-	}
-	return int(wrsult), nil
+	return r.s.WriteContext(ctx, p)
 }
 
-
 // Close 关闭TheNewDirTEEFileReader实例，释放相关资源
 func (r *TheNewDirTEEFileReader) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	var err error
 	if !r.closed {
 		r.closed = true
-		C.ring_buffer_stop((*C.RingBuffer)(r.rb));
-		// C.free(unsafe.Pointer(r.rb))  // 由c语言程序释放内存
-		close(r.readCh)  // 确保通道被关闭
-		fmt.Println("wait TheNewDirTEEFileReader Close")
-		C.the_new_dir_wait_keystone_file_end((*C.KeystoneJustReady)(r.kjb))
-		// time.Sleep(1500 * time.Millisecond)  // 固定等待1.5s
-		// r.wg.Wait()  // 等待后台goroutine完成
+		close(r.readCh) // 确保通道被关闭
+		err = r.s.WaitDone()
+		if cerr := r.s.Close(); err == nil {
+			err = cerr
+		}
 	}
 	fmt.Println("TheNewDirTEEFileReader Close")
-	return nil
+	return err
 }
 
-
 // ==================================================================================
 //				The New Dir Multi-process Cross-read Flexible Keystone Encrypt
 // ==================================================================================
 
-
 type TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     int64				  	// 共享内存的长度
-	fileCount	int64
-	flexible 	int
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
+	ss        Session
+	fileCount int64
+	flexible  int
+	readCh    chan struct{} // 通道用于通知读取完成
+	mu        sync.Mutex    // 互斥锁，保护共享资源
+	closed    bool          // 标记是否已经关闭
 }
 
 type TheNewDirMultiProcessCrossTEEFileFlexibleReader struct {
-	shmaddr     []byte				  	// 共享内存的地址
-	shmsize     int64				  	// 共享内存的长度
-	fileCount	int64
-	flexible 	int
-	shmaddr_justcall     []byte				  	// 共享内存的地址
-	shmsize_justcall     int64				  	// 共享内存的长度
-	readCh chan struct{}          		// 通道用于通知读取完成
-	mu     sync.Mutex             		// 互斥锁，保护共享资源
-	closed bool                   		// 标记是否已经关闭
+	s         *ctxStream
+	fileCount int64
+	flexible  int
+	readCh    chan struct{} // 通道用于通知读取完成
+	mu        sync.Mutex    // 互斥锁，保护共享资源
+	closed    bool          // 标记是否已经关闭
 }
 
-// 创建一个新的共享内存段
-func theNewDirlongcreateShm(size int64) ([]byte, error) {
+// NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall
+func NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall(opts ...Option) (*TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall, error) {
+	return NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCallContext(context.Background(), opts...)
+}
 
-	shmaddr := C.the_new_dir_long_create_shareMemory(C.longlong(size))
+// NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCallContext 与 NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCallContext(ctx context.Context, opts ...Option) (*TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
 
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:size:size], nil
-}
+	b, req, err := newRequest(ModeCrossFlexible, opts)
+	if err != nil {
+		return nil, err
+	}
 
-// NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall
-func NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall(isAES int, flexible int) (*TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall, error) {
-	
-	// MAXNUM 10
-	C.fixFlexibleNum(unsafe.Pointer(&flexible))
-
-	// 创建共享内存片段
-	shmsize := int64(C.sizeof_TheNewDirMultiProcessCrossFlexibleSHMBufferJustCall + (flexible * C.sizeof_int) + (flexible * C.sizeof_longlong))
-	shm, err := theNewDirlongcreateShm(shmsize)
+	ss, err := b.OpenEncryptSession(req)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 
 	reader := &TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall{
-		shmaddr:    shm,
-		shmsize:	shmsize,
-		fileCount:	0,
-		flexible: flexible,
-		readCh: make(chan struct{}, 1),
-		closed: false,
+		ss:        ss,
+		fileCount: 0,
+		flexible:  req.Flexible,
+		readCh:    make(chan struct{}, 1),
+		closed:    false,
 	}
 
-	// 启动keystone之前先初始化内存空间
-	C.theNewDirflexiblecrossInitSHMJustCall(unsafe.Pointer(&reader.shmaddr[0]), C.int(flexible))
-	// fmt.Println("MultiProcess Processing file test")
-
-	var numflexible int = 0
-	for numflexible < flexible {
-
-		// fmt.Printf("isAES:%d, shmsize:%d, numflexible:%d, flexible:%d\n", isAES, shmsize, numflexible, flexible)
-
-		// 启动第一个子进程，读取文件的前半部分
-		cmd := exec.Command("./the_new_dir_flexible_cross_child_process", 
-			fmt.Sprintf("%d", isAES), 
-			fmt.Sprintf("%d", shmsize), 
-			fmt.Sprintf("%d", numflexible), 
-			fmt.Sprintf("%d", flexible),
-		)
-
-		err = cmd.Start()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start %d child process: %v\n", numflexible, err)
-			os.Exit(1)
-		}
-
-		numflexible++
-
+	if err := waitSessionReady(ctx, ss); err != nil {
+		ss.Abort()
+		return nil, err
 	}
 
-	C.theNewDirflexiblecrosswaitKeystoneReady(unsafe.Pointer(&reader.shmaddr[0]), C.int(flexible))
-
 	return reader, nil
 }
 
-func The_New_Dir_MultiProcess_Cross_Flexible_Ipfs_keystone_test_just_call(isAES int, flexible int) (TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall){
+// The_New_Dir_MultiProcess_Cross_Flexible_Ipfs_keystone_test_just_call 是 NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall 的旧接口，返回 *TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall。
+//
+// Deprecated: 使用 NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall。
+func The_New_Dir_MultiProcess_Cross_Flexible_Ipfs_keystone_test_just_call(isAES int, flexible int) (*TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall, error) {
 
 	// 打印FileName
 	fmt.Println("The New Dir MultiProcess flexible Processing file")
 
-	reader, _ := NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall(isAES, flexible)
-
-	return *reader
+	return NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall(legacyFlexibleOptions(isAES, flexible)...)
 }
 
-
-// 创建一个新的共享内存段
-func theNewDirlongcreateShmofFile(size int64, fileCount int64) ([]byte, error) {
-
-	shmaddr := C.the_new_dir_long_create_shareMemory_of_file(C.longlong(size), C.longlong(fileCount))
-
-	// 错误写法 (*[size]byte)中 size 必须为常量，只是类型转换，并没有分配空间
-	// return (*[size]byte)(shmaddr)[:], nil
-	// [low:high:max] 获取内存切片low-high 可以索引low-high  数组实际空间大小为max
-	// 若不指定 max 则是前面类型的空间，即1 << 32 = 1GB
-	return (*[1 << 32]byte)(shmaddr)[:size:size], nil
+// Workers 返回 enclave 子进程的 PID 和退出状态
+func (thenewdirReader *TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall) Workers() []WorkerStatus {
+	return sessionWorkers(thenewdirReader.ss)
 }
 
-func (thenewdirReader *TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall) The_New_Dir_MultiProcess_cross_Flexible_Set_fileAbsPath(fpath string, fileSize int64)(*TheNewDirMultiProcessCrossTEEFileFlexibleReader){
-	// fmt.Printf("thenewdirReader fpath:%s, fileSize:%d, thenewdirReader.fileCount:%d\n", fpath, fileSize, thenewdirReader.fileCount)
+// The_New_Dir_MultiProcess_cross_Flexible_Set_fileAbsPath 把下一个文件交给 enclave，返回读取密文的 reader。
+// fpath 为空或 fileSize 为 0 时结束会话，返回 nil 和 End 的错误；交给 enclave 失败时返回错误
+func (thenewdirReader *TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall) The_New_Dir_MultiProcess_cross_Flexible_Set_fileAbsPath(fpath string, fileSize int64) (*TheNewDirMultiProcessCrossTEEFileFlexibleReader, error) {
 
-	if fileSize == 0 || fpath == ""{
-		C.theNewDirflexiblecrosswaitKeystoneTransferFilesReady(unsafe.Pointer(&thenewdirReader.shmaddr[0]), C.int(thenewdirReader.flexible), nil, 0, 0, nil)
-		return nil
+	if fileSize == 0 || fpath == "" {
+		return nil, thenewdirReader.ss.End()
 	}
 
-	cFileSize := C.long_alignedFileSize(C.longlong(fileSize))
-	cBlocksNums := C.long_alignedFileSize_blocksnums(cFileSize)
-
-	thenewdirReader.fileCount++
-
-	// 创建共享内存片段
-	shmsize := C.sizeof_TheNewDirMultiProcessCrossFlexibleSHMBufferReader + int64(cBlocksNums * C.sizeof_int) + int64(cFileSize)
-	shm, err := theNewDirlongcreateShmofFile(shmsize, thenewdirReader.fileCount)
+	s, err := thenewdirReader.ss.NextEncrypt(fpath, fileSize)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create shared memory: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("transfer file %s: %w", fpath, err)
 	}
+	thenewdirReader.fileCount++
 
 	reader := &TheNewDirMultiProcessCrossTEEFileFlexibleReader{
-		shmaddr:    shm,
-		shmsize:	shmsize,
-		fileCount:	thenewdirReader.fileCount,
-		flexible: 	thenewdirReader.flexible,
-		shmaddr_justcall:    thenewdirReader.shmaddr,
-		shmsize_justcall:	thenewdirReader.shmsize,
-		readCh: 	make(chan struct{}, 1),
-		closed: 	false,
+		s:         newCtxStream(s),
+		fileCount: thenewdirReader.fileCount,
+		flexible:  thenewdirReader.flexible,
+		readCh:    make(chan struct{}, 1),
+		closed:    false,
 	}
 
-	C.theNewDirflexiblecrosswaitKeystoneTransferFilesReady(unsafe.Pointer(&thenewdirReader.shmaddr[0]), C.int(thenewdirReader.flexible), unsafe.Pointer(&reader.shmaddr[0]), cBlocksNums, cFileSize, unsafe.Pointer(C.CString(fpath)))
-	// fmt.Println("MultiProcess Processing file test")
-
-	return reader
-	
+	return reader, nil
 }
 
+func (r *TheNewDirMultiProcessCrossTEEFileFlexibleReader) Read(p []byte) (int, error) {
+	return r.ReadContext(context.Background(), p)
+}
 
-func (r *TheNewDirMultiProcessCrossTEEFileFlexibleReader)Read(p []byte) (int, error)  {
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (r *TheNewDirMultiProcessCrossTEEFileFlexibleReader) ReadContext(ctx context.Context, p []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if r.closed {
-		return 0, io.EOF
-	}
-
-	// fmt.Println("The New Dir MultiProcess Processing read start")
-	var readLen C.int = 0;
-	// 交给c语言函数处理
-	result := C.TheNewDirMultiProcessCrossReadFlexible(unsafe.Pointer(&r.shmaddr[0]), C.int(r.shmsize), unsafe.Pointer(&p[0]), C.int(len(p)), &readLen);
-	if result == 0 {
-		return int(readLen), io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	// fmt.Println("The New Dir MultiProcess Processing read done")
-
-	return int(readLen), nil;
+	return r.s.ReadContext(ctx, p)
 }
 
-// 删除共享内存段
-func the_new_dir_flexbile_longremoveShm(shmsize int64, fileCount int64) error {
-	C.the_new_dir_flexbile_long_removeShm(C.longlong(shmsize), C.longlong(fileCount))
+// WriteTo 实现 io.WriterTo，io.Copy 使用它整块写到 w。只有模拟后端把完成的块直接交给 w，
+// cgo 后端每次从共享内存复制一整块到复用的缓冲区
+func (r *TheNewDirMultiProcessCrossTEEFileFlexibleReader) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return nil
+	if r.closed {
+		return 0, ErrBufferStopped
+	}
+	return r.s.WriteTo(w)
 }
 
 // Close 关闭 TheNewDirMultiProcessCrossTEEFileFlexibleReader 实例，释放相关资源
 func (r *TheNewDirMultiProcessCrossTEEFileFlexibleReader) Close() error {
-	r.mu.Lock()
+	r.s.lockForClose(&r.mu)
 	defer r.mu.Unlock()
 
+	var err error
 	if !r.closed {
 		r.closed = true
-		close(r.readCh)  // 确保通道被关闭
-		fmt.Println("The New Dir MultiProcess Cross Flexible wait TEEFileReader end")
-		C.theNewDirflexiblecrosswaitKeystoneTransferFilesEnd(unsafe.Pointer(&r.shmaddr_justcall[0]), C.int(r.flexible))
-		defer detachShm(r.shmaddr)
-		defer the_new_dir_flexbile_longremoveShm(r.shmsize, r.fileCount)
+		close(r.readCh) // 确保通道被关闭
+		err = r.s.WaitDone()
+		if cerr := r.s.Close(); err == nil {
+			err = cerr
+		}
 	}
 	fmt.Println("The New Dir MultiProcess Cross Flexible TEEFileReader Close")
-	return nil
+	return err
 }
 
-
 // ==================================================================================
 //				The New Dir Keystone Encrypt
 // ==================================================================================
 
-
 type TheNewDirTEEFileReaderJustCallADD struct {
-	rb     *C.RingBuffer          // 指向C语言中的RingBuffer结构
-	kjb    *C.KeystoneJustReadyAdd          
-	readCh chan struct{}          // 通道用于通知读取完成
-	wg     sync.WaitGroup         // 等待组用于等待后台goroutine完成
-	mu     sync.Mutex             // 互斥锁，保护共享资源
-	closed bool                   // 标记是否已经关闭
+	ss     Session
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
-// TheNewDirTEEFileReader 结构体封装了环形缓冲区的相关操作
+// TheNewDirTEEFileReaderADD 结构体封装了环形缓冲区的相关操作
 type TheNewDirTEEFileReaderADD struct {
-	rb     *C.RingBuffer          // 指向C语言中的RingBuffer结构
-	kjb    *C.KeystoneJustReadyAdd
-	readCh chan struct{}          // 通道用于通知读取完成
-	wg     sync.WaitGroup         // 等待组用于等待后台goroutine完成
-	mu     sync.Mutex             // 互斥锁，保护共享资源
-	closed bool                   // 标记是否已经关闭
+	s      *ctxStream
+	readCh chan struct{} // 通道用于通知读取完成
+	mu     sync.Mutex    // 互斥锁，保护共享资源
+	closed bool          // 标记是否已经关闭
 }
 
-func NewTheNewDirTEEFileReaderJustCallADD(isAES int) (*TheNewDirTEEFileReaderJustCallADD, error) {
+func NewTheNewDirTEEFileReaderJustCallADD(opts ...Option) (*TheNewDirTEEFileReaderJustCallADD, error) {
+	return NewTheNewDirTEEFileReaderJustCallADDContext(context.Background(), opts...)
+}
 
-	kjb := (*C.KeystoneJustReadyAdd)(C.malloc(C.sizeof_KeystoneJustReadyAdd))
-	if kjb == nil { // 检查内存分配是否成功
-		return nil, fmt.Errorf("failed to allocate memory for KeystoneJustReadyAdd")
+// NewTheNewDirTEEFileReaderJustCallADDContext 与 NewTheNewDirTEEFileReaderJustCallADD 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func NewTheNewDirTEEFileReaderJustCallADDContext(ctx context.Context, opts ...Option) (*TheNewDirTEEFileReaderJustCallADD, error) {
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
 	}
 
-	rb := (*C.RingBuffer)(C.malloc(C.sizeof_RingBuffer))
-	if rb == nil { // 检查内存分配是否成功
-		return nil, fmt.Errorf("failed to allocate memory for RingBuffer")
+	b, req, err := newRequest(ModeSingle, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// Convert Go int to C int
-	cIsAES := C.int(isAES)
-
-	C.init_keystone_just_ready_add(kjb)
-	C.init_ring_buffer(rb)
+	ss, err := b.OpenEncryptSession(req)
+	if err != nil {
+		return nil, err
+	}
 
 	kjbreader := &TheNewDirTEEFileReaderJustCallADD{
-		kjb:     kjb,
-		rb:     rb,
+		ss:     ss,
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	kjbreader.wg.Add(1)
-	go func() {
-		defer kjbreader.wg.Done() // 确保在goroutine结束时调用Done
-		C.the_new_dir_ipfs_keystone(cIsAES, unsafe.Pointer(kjb), unsafe.Pointer(rb))
-		fmt.Println("the new dir TEE read file done")
-	}()
-
-	C.the_new_dir_keystone_wait_ready_add(unsafe.Pointer(kjb))
+	if err := waitSessionReady(ctx, ss); err != nil {
+		ss.Abort()
+		return nil, err
+	}
 
 	return kjbreader, nil
 }
 
-func The_New_DIR_Ipfs_keystone_test(isAES int) (TheNewDirTEEFileReaderJustCallADD){
+// The_New_DIR_Ipfs_keystone_test 是 NewTheNewDirTEEFileReaderJustCallADD 的旧接口，返回 *TheNewDirTEEFileReaderJustCallADD。
+//
+// Deprecated: 使用 NewTheNewDirTEEFileReaderJustCallADD。
+func The_New_DIR_Ipfs_keystone_test(isAES int) (*TheNewDirTEEFileReaderJustCallADD, error) {
 
 	// 打印FileName
 	fmt.Println("The New Dir add file:")
 
-	kjbreader, _ := NewTheNewDirTEEFileReaderJustCallADD(isAES)
-
-	return *kjbreader
+	return NewTheNewDirTEEFileReaderJustCallADD(legacyOptions(isAES)...)
 }
 
-func (thenewdirReader *TheNewDirTEEFileReaderJustCallADD) The_New_Dir_Keystone_Set_fileAbsPath(fpath string, fileSize int64)(*TheNewDirTEEFileReaderADD){
-	// fmt.Printf("thenewdirReader fpath:%s, fileSize:%d\n", fpath, fileSize)
+// The_New_Dir_Keystone_Set_fileAbsPath 把下一个文件交给 enclave，返回读取密文的 reader。
+// fpath 为空或 fileSize 为 0 时结束会话，返回 nil 和 End 的错误；交给 enclave 失败时返回错误
+func (thenewdirReader *TheNewDirTEEFileReaderJustCallADD) The_New_Dir_Keystone_Set_fileAbsPath(fpath string, fileSize int64) (*TheNewDirTEEFileReaderADD, error) {
 
 	if fileSize == 0 || fpath == "" {
-		C.theNewDirKeystoneTransferFilesReady(unsafe.Pointer(thenewdirReader.kjb), 0, nil)
-		return nil
+		return nil, thenewdirReader.ss.End()
 	}
 
-	// C.init_ring_buffer(thenewdirReader.rb)
+	s, err := thenewdirReader.ss.NextEncrypt(fpath, fileSize)
+	if err != nil {
+		return nil, fmt.Errorf("transfer file %s: %w", fpath, err)
+	}
 
 	reader := &TheNewDirTEEFileReaderADD{
-		kjb:    thenewdirReader.kjb,
-		rb:     thenewdirReader.rb,
+		s:      newCtxStream(s),
 		readCh: make(chan struct{}, 1),
 		closed: false,
 	}
 
-	C.theNewDirKeystoneTransferFilesReady(unsafe.Pointer(thenewdirReader.kjb), C.longlong(fileSize), unsafe.Pointer(C.CString(fpath)))
-
-	return reader
-	
+	return reader, nil
 }
 
 // Read 实现io.Reader接口的方法，从缓冲区读取数据到p切片
 func (r *TheNewDirTEEFileReaderADD) Read(p []byte) (int, error) {
+	return r.ReadContext(context.Background(), p)
+}
+
+// ReadContext 与 Read 相同，ctx 结束时停止 enclave 并返回 ctx 的错误，之后的读取返回 ErrBufferStopped
+func (r *TheNewDirTEEFileReaderADD) ReadContext(ctx context.Context, p []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	if r.closed {
-		return 0, io.EOF
+		return 0, ErrBufferStopped
 	}
 
-	var readLen C.int = 0;
-	result := C.ring_buffer_read((*C.RingBuffer)(r.rb), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
-	if result == 0 { // 检查ring_buffer_read的结果
-		return int(readLen), io.EOF
-	}
-	return int(readLen), nil
+	return r.s.ReadContext(ctx, p)
 }
 
-
 // Close 关闭TheNewDirTEEFileReaderADD实例，释放相关资源
 func (r *TheNewDirTEEFileReaderADD) Close() error {
-	r.mu.Lock()
+	r.s.lockForClose(&r.mu)
 	defer r.mu.Unlock()
 
+	var err error
 	if !r.closed {
 		r.closed = true
-		// C.free(unsafe.Pointer(r.rb))  // 释放C语言分配的内存
-		C.the_new_dir_wait_keystone_file_end_add((*C.KeystoneJustReadyAdd)(r.kjb), (*C.RingBuffer)(r.rb))
-		close(r.readCh)  // 确保通道被关闭
-		// r.wg.Wait()  // 等待后台goroutine完成
+		err = r.s.WaitDone()
+		if cerr := r.s.Close(); err == nil {
+			err = cerr
+		}
+		close(r.readCh) // 确保通道被关闭
 	}
 	fmt.Println("TEEFileReader Close")
-	return nil
+	return err
 }
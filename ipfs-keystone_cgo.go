@@ -0,0 +1,1745 @@
+//go:build keystone
+
+package ipfsKeystoneTest
+
+// #cgo LDFLAGS: -L/usr/local/ipfs-keystone -lipfs_keystone -lstdc++
+// #cgo CFLAGS: -I/usr/local/ipfs-keystone/include -I/usr/local/ipfs-keystone/include/host -I/usr/local/ipfs-keystone/include/edge
+// #include <stdlib.h>
+// #include "ipfs_keystone.h"
+// #include "ipfs_aes.h"
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"sync"
+	"unsafe"
+)
+
+// 使用 -tags keystone 构建时默认通过 cgo 调用 libipfs_keystone.a
+func builtinBackend() Backend { return CgoBackend{} }
+
+// CgoBackend 通过 cgo 调用 libipfs_keystone.a，启动真实的 enclave
+type CgoBackend struct {
+	Config *Config // 子进程的位置和参数，为 nil 时使用 DefaultConfig()
+}
+
+// config 依次使用请求、后端和 DefaultConfig() 中的配置
+func (b CgoBackend) config(req Request) Config {
+	if req.Config != nil {
+		return *req.Config
+	}
+	if b.Config != nil {
+		return *b.Config
+	}
+	return DefaultConfig()
+}
+
+func (b CgoBackend) OpenEncrypt(req Request) (Stream, error) {
+	if req.Source != nil && req.Mode != ModeSingle && req.Mode != ModeCrossFlexible {
+		return nil, fmt.Errorf("encrypt mode %d cannot read from an io.Reader", req.Mode)
+	}
+	switch req.Mode {
+	case ModeSingle:
+		return openRingStream(req, false)
+	case ModeMultiThreaded:
+		return openMultiThreadedStream(req)
+	case ModeMultiProcess:
+		return openMultiProcessStream(req, b.config(req))
+	case ModeCross:
+		return openCrossStream(req, b.config(req))
+	case ModeCrossFlexible:
+		return openCrossFlexibleStream(req, b.config(req))
+	}
+	return nil, fmt.Errorf("unsupported encrypt mode %d", req.Mode)
+}
+
+func (b CgoBackend) OpenDecrypt(req Request) (Stream, error) {
+	switch req.Mode {
+	case ModeSingle:
+		return openRingStream(req, true)
+	case ModeDispatch:
+		return openDispatchStream(req, b.config(req))
+	case ModeSecureDispatch:
+		return openSecureDispatchStream(req, b.config(req))
+	}
+	return nil, fmt.Errorf("unsupported decrypt mode %d", req.Mode)
+}
+
+func (b CgoBackend) OpenEncryptSession(req Request) (Session, error) {
+	switch req.Mode {
+	case ModeSingle:
+		return openDirAddSession(req)
+	case ModeCrossFlexible:
+		return openDirFlexibleSession(req, b.config(req))
+	}
+	return nil, fmt.Errorf("unsupported encrypt session mode %d", req.Mode)
+}
+
+func (b CgoBackend) OpenDecryptSession(req Request) (Session, error) {
+	switch req.Mode {
+	case ModeSingle:
+		return openDirRingSession(req)
+	case ModeSecureDispatch:
+		return openDirSecureDispatchSession(req, b.config(req))
+	}
+	return nil, fmt.Errorf("unsupported decrypt session mode %d", req.Mode)
+}
+
+// ==================================================================================
+//				C int sizes
+// ==================================================================================
+
+// cInt 把长度转换为 C int。libipfs_keystone.a 中部分接口用 int 表示文件或共享内存的长度，
+// 超过 math.MaxInt32 时返回 ErrFileTooLarge，不能截断后交给 C 代码
+func cInt(n int64, what string) (C.int, error) {
+	if n < 0 || n > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: %s %d exceeds the int range of libipfs_keystone", ErrFileTooLarge, what, n)
+	}
+	return C.int(n), nil
+}
+
+// ==================================================================================
+//				AES Encrypt
+// ==================================================================================
+
+// aesEncrypt 检查缓冲区的长度，ct 放不下填充之后的密文时返回 -1，不让 C 函数越界写
+func aesEncrypt(pt []byte, ptLen int, ct []byte) int {
+	if ptLen < 0 || ptLen > len(pt) || ptLen > math.MaxInt32-aesBlockSize || aesSealedSize(ptLen) > len(ct) {
+		return -1
+	}
+	// 空明文没有 &pt[0]，C 函数不会读这个字节
+	var empty [1]byte
+	in := unsafe.Pointer(&empty[0])
+	if ptLen > 0 {
+		in = unsafe.Pointer(&pt[0])
+	}
+	ctLen := C.encrypt(in, C.int(ptLen), unsafe.Pointer(&ct[0]))
+	return int(ctLen)
+}
+
+// aesDecrypt 检查缓冲区的长度。C 函数去掉填充之前会写出 ctLen 字节，pt 至少要有这么长
+func aesDecrypt(ct []byte, ctLen int, pt []byte) int {
+	if ctLen <= 0 || ctLen > len(ct) || ctLen > math.MaxInt32 || ctLen%aesBlockSize != 0 || ctLen > len(pt) {
+		return -1
+	}
+	ptLen := C.decrypt(unsafe.Pointer(&ct[0]), C.int(ctLen), unsafe.Pointer(&pt[0]))
+	return int(ptLen)
+}
+
+// ==================================================================================
+//				Keystone RingBuffer
+// ==================================================================================
+
+// ringStream 封装单个 enclave 与 Go 之间的 RingBuffer
+type ringStream struct {
+	streamCounter
+	rb        *C.RingBuffer // 指向C语言中的RingBuffer结构
+	de        bool          // 解密时由 Go 写入，enclave 读出
+	plain     *plainFifo    // 解密到 Request.Sink 时 enclave 写明文的管道
+	input     *inputFifo    // 从 Request.Source 加密时 enclave 读明文的管道
+	plainErr  error         // plainOnce 之后可读
+	plainOnce sync.Once
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func openRingStream(req Request, de bool) (*ringStream, error) {
+	// 解密到 io.Writer 时 enclave 的输出文件换成命名管道
+	var plain *plainFifo
+	if de && req.Sink != nil {
+		var err error
+		if plain, err = newPlainFifo(req.Sink); err != nil {
+			return nil, err
+		}
+		req.Path = plain.Path()
+	}
+	// 从 io.Reader 加密时 enclave 的源文件换成命名管道
+	var input *inputFifo
+	if !de && req.Source != nil {
+		var err error
+		if input, err = newInputFifo(req.Source, req.Size); err != nil {
+			return nil, err
+		}
+		req.Path = input.Path()
+	}
+
+	p, err := cMalloc(C.sizeof_RingBuffer, "RingBuffer")
+	if err != nil {
+		if plain != nil {
+			plain.Close()
+		}
+		if input != nil {
+			input.Close()
+		}
+		return nil, err
+	}
+	rb := (*C.RingBuffer)(p)
+
+	// Convert Go int to C int
+	cIsAES := C.int(req.IsAES)
+
+	C.init_ring_buffer(rb)
+
+	s := &ringStream{rb: rb, de: de, plain: plain, input: input}
+	s.want = -1 // 解密流不读取
+	if input != nil {
+		if req.Size > 0 {
+			s.want = req.Size
+		}
+	} else if fi, err := os.Stat(req.Path); err == nil && !de {
+		s.want = fi.Size() // enclave 输出的长度不小于文件大小
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done() // 确保在goroutine结束时调用Done
+		// enclave 返回之后路径不再使用
+		path := cString(req.Path)
+		defer freeCString(path)
+		if de {
+			C.ipfs_keystone_de(cIsAES, unsafe.Pointer(path), unsafe.Pointer(rb))
+		} else {
+			C.ipfs_keystone(cIsAES, unsafe.Pointer(path), unsafe.Pointer(rb))
+		}
+		fmt.Println("TEE read file done")
+	}()
+
+	return s, nil
+}
+
+func (s *ringStream) ReadBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+	result := C.ring_buffer_read(s.rb, (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
+	n, err := s.readResult(int(readLen), int(result))
+	// io.Reader 出错时 enclave 只是读到文件结束，密文不完整
+	if err == io.EOF && s.input != nil {
+		if ierr := s.input.Err(); ierr != nil {
+			return n, fmt.Errorf("%w: %w", ErrEnclaveAborted, ierr)
+		}
+	}
+	return n, err
+}
+
+func (s *ringStream) WriteBlock(p []byte) (int, error) {
+	wrsult := C.ring_buffer_write(s.rb, (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
+	// ring_buffer_write 返回写入的长度，缓冲区停止时返回 0
+	return writeResult(int(wrsult), int(wrsult))
+}
+
+func (s *ringStream) WaitReady() error { return nil }
+
+func (s *ringStream) WaitDone() error {
+	if s.de {
+		C.ring_buffer_stop(s.rb)
+		C.ring_buffer_already_got()
+	}
+	if s.plain != nil {
+		return s.finishPlain()
+	}
+	return nil
+}
+
+// finishPlain 等 enclave 线程返回，把管道中剩余的明文写到 io.Writer，只执行一次
+func (s *ringStream) finishPlain() error {
+	s.plainOnce.Do(func() {
+		s.wg.Wait()
+		s.plainErr = s.plain.Close()
+	})
+	return s.plainErr
+}
+
+func (s *ringStream) Abort() error {
+	C.ring_buffer_stop(s.rb)
+	if s.input != nil {
+		s.input.Stop()
+	}
+	return nil
+}
+
+// Close 停止 RingBuffer，等 enclave 线程返回之后再释放，enclave 不会再访问已经释放的内存
+func (s *ringStream) Close() error {
+	s.closeOnce.Do(func() {
+		C.ring_buffer_stop(s.rb)
+		s.wg.Wait()
+		if s.plain != nil {
+			s.finishPlain()
+		}
+		if s.input != nil {
+			s.input.Close()
+		}
+		cFree(unsafe.Pointer(s.rb))
+	})
+	return nil
+}
+
+// ==================================================================================
+//				MultiThreaded Keystone Encrypt
+// ==================================================================================
+
+type multiThreadedStream struct {
+	streamCounter
+	mtb       *C.MultiThreadedBuffer // 指向C语言中的MultiThreadedBuffer结构
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func openMultiThreadedStream(req Request) (*multiThreadedStream, error) {
+	// 多线程模式的接口用 int 表示文件长度，对齐之后也不能超出
+	cFileSize, err := cInt(int64(C.long_alignedFileSize(C.longlong(req.Size))), "aligned file size")
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := cMalloc(C.sizeof_MultiThreadedBuffer, "MultiThreadedBuffer")
+	if err != nil {
+		return nil, err
+	}
+	mtb := (*C.MultiThreadedBuffer)(p)
+
+	// Convert Go int to C int
+	cIsAES := C.int(req.IsAES)
+
+	cFileSize = C.alignedFileSize(cFileSize)
+	cAfileSize := C.aFileSize(cFileSize)
+
+	// 为 half part buffer 分配空间，设置两个buffer的运行状态都为running = 1
+	C.init_multi_threaded_ring_buffer(mtb, cFileSize, cAfileSize)
+
+	s := &multiThreadedStream{mtb: mtb}
+	s.want = req.Size
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done() // 确保在goroutine结束时调用Done
+		path := cString(req.Path)
+		defer freeCString(path)
+		C.multi_ipfs_keystone_ppb_buffer_wrapper(cIsAES, unsafe.Pointer(path), unsafe.Pointer(mtb), 0, cAfileSize)
+		fmt.Println("MultiTEE buffer read file done")
+	}()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done() // 确保在goroutine结束时调用Done
+		path := cString(req.Path)
+		defer freeCString(path)
+		C.multi_ipfs_keystone_hpb_buffer_wrapper(cIsAES, unsafe.Pointer(path), unsafe.Pointer(mtb), cAfileSize+1, cFileSize)
+		fmt.Println("MultiTEE ring buffer read file done")
+	}()
+
+	return s, nil
+}
+
+func (s *multiThreadedStream) ReadBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+	result := C.which_pb_buffer_read(s.mtb, (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
+	return s.readResult(int(readLen), int(result))
+}
+
+func (s *multiThreadedStream) WriteBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("multi-threaded stream is read only")
+}
+
+func (s *multiThreadedStream) WaitReady() error { return nil }
+
+func (s *multiThreadedStream) WaitDone() error { return nil }
+
+// MultiThreadedBuffer 没有停止函数，两个线程在 enclave 处理完之前不会退出
+func (s *multiThreadedStream) Abort() error { return nil }
+
+// Close 销毁 MultiThreadedBuffer。缓冲区没有停止函数，提前关闭时两个线程会阻塞在写满的
+// 缓冲区上，所以在后台读完剩余的输出，等两个线程返回之后再销毁
+func (s *multiThreadedStream) Close() error {
+	s.closeOnce.Do(func() {
+		go func() {
+			buf := make([]byte, DefaultBlockSize)
+			for {
+				if n, err := s.ReadBlock(buf); n == 0 || err != nil {
+					break
+				}
+			}
+			s.wg.Wait()
+			// destory_multi_threaded_ring_buffer 释放 init 分配的两半缓冲区，结构体本身由 cMalloc 分配
+			C.destory_multi_threaded_ring_buffer(s.mtb)
+			cFree(unsafe.Pointer(s.mtb))
+		}()
+	})
+	return nil
+}
+
+// ==================================================================================
+//				Multi-process Keystone Encrypt
+// ==================================================================================
+
+const (
+	shmKey = 241227 // 共享内存键值
+)
+
+// 创建一个新的共享内存段，末尾的 shmTrailerSize 字节留给 Janitor 的尾部
+func createShm(size int64) (ShmRegion, error) {
+	cSize, err := cInt(withTrailer(size), "shared memory size")
+	if err != nil {
+		return ShmRegion{}, err
+	}
+	shmaddr := C.creat_shareMemory(cSize)
+	return stampedShmRegion(shmaddr, size, fmt.Sprintf("creat_shareMemory(%d)", cSize))
+}
+
+// 连接到现有的共享内存段
+func attachShm(size int64) (ShmRegion, error) {
+	cSize, err := cInt(size, "shared memory size")
+	if err != nil {
+		return ShmRegion{}, err
+	}
+	shmaddr := C.attach_shareMemory(cSize)
+	return newShmRegion(shmaddr, size, fmt.Sprintf("attach_shareMemory(%d)", size))
+}
+
+// 断开与共享内存段的连接
+func detachShm(shm ShmRegion) error {
+	if shm.Valid() {
+		C.detach_shareMemory(shm.Ptr())
+	}
+
+	return nil
+}
+
+// 删除共享内存段，shmsize 已经在 createShm 中检查过
+func removeShm(shmsize int64) error {
+	C.removeShm(C.int(shmsize))
+
+	return nil
+}
+
+type multiProcessStream struct {
+	children // enclave 子进程
+	streamCounter
+	shmaddr          ShmRegion // 共享内存的地址
+	shmsize          int64     // 共享内存的长度
+	stdout1, stdout2 bytes.Buffer
+	stderr1, stderr2 bytes.Buffer
+}
+
+func openMultiProcessStream(req Request, cfg Config) (*multiProcessStream, error) {
+
+	// 分配共享内存之前先检查子进程的可执行文件
+	bin, err := cfg.WorkerPath(WorkerMultiProcess)
+	if err != nil {
+		return nil, err
+	}
+
+	// 多进程模式的接口用 int 表示文件长度
+	cFileSize, err := cInt(req.Size, "file size")
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建共享内存片段，MultiProcessRead 用 int 表示共享内存的长度
+	shmsize := req.Size + C.sizeof_MultiProcessSHMBuffer
+	if _, err := cInt(shmsize, "shared memory size"); err != nil {
+		return nil, err
+	}
+	shm, err := createShm(shmsize)
+	if err != nil {
+		return nil, err
+	}
+
+	cFileSize = C.alignedFileSize(cFileSize)
+	cAfileSize := C.aFileSize(cFileSize)
+
+	s := &multiProcessStream{
+		streamCounter: streamCounter{want: req.Size},
+		shmaddr:       shm,
+		shmsize:       shmsize,
+	}
+
+	// 第一个子进程读取文件的前半部分
+	cmd1 := exec.Command(bin, cfg.workerArgs(WorkerMultiProcess, fmt.Sprintf("%d", req.IsAES), fmt.Sprintf("%d", shmsize), req.Path, fmt.Sprintf("%d", 0), fmt.Sprintf("%d", cAfileSize))...)
+
+	// 将子进程的标准输出和标准错误重定向到缓冲区
+	cmd1.Stdout = &s.stdout1
+	cmd1.Stderr = &s.stderr1
+
+	// 第二个子进程读取文件的后半部分
+	cmd2 := exec.Command(bin, cfg.workerArgs(WorkerMultiProcess, fmt.Sprintf("%d", req.IsAES), fmt.Sprintf("%d", shmsize), req.Path, fmt.Sprintf("%d", cAfileSize), fmt.Sprintf("%d", cFileSize))...)
+
+	cmd2.Stdout = &s.stdout2
+	cmd2.Stderr = &s.stderr2
+
+	// 输出全部留在共享内存中，子进程写完就可以退出，不完整的输出由 readResult 报错
+	s.children.release()
+	if err := s.children.start(cmd1, cmd2); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *multiProcessStream) ReadBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+	// 交给c语言函数处理
+	result := C.MultiProcessRead(s.shmaddr.Ptr(), C.int(s.shmsize), unsafe.Pointer(&p[0]), C.int(len(p)), &readLen)
+
+	return s.readResult(int(readLen), int(result))
+}
+
+func (s *multiProcessStream) WriteBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("multi-process stream is read only")
+}
+
+func (s *multiProcessStream) WaitReady() error {
+	C.waitKeystoneReady(unsafe.Pointer(s.shmaddr.multiProcessHeader()))
+
+	fmt.Printf("Child1 process output:\n%s\n", s.stdout1.String())
+	fmt.Printf("Child2 process output:\n%s\n", s.stdout2.String())
+	return nil
+}
+
+func (s *multiProcessStream) WaitDone() error { return nil }
+
+func (s *multiProcessStream) Abort() error {
+	s.children.kill()
+	return nil
+}
+
+func (s *multiProcessStream) Close() error {
+	s.children.kill()
+	defer detachShm(s.shmaddr)
+	defer removeShm(s.shmsize)
+	return nil
+}
+
+// ==================================================================================
+//				Multi-process Cross-read Keystone Encrypt
+// ==================================================================================
+
+// 创建一个新的共享内存段
+func longcreateShm(size int64) (ShmRegion, error) {
+	shmaddr := C.long_create_shareMemory(C.longlong(withTrailer(size)))
+	return stampedShmRegion(shmaddr, size, fmt.Sprintf("long_create_shareMemory(%d)", withTrailer(size)))
+}
+
+// 删除共享内存段
+func longremoveShm(shmsize int64) error {
+	C.long_removeShm(C.longlong(shmsize))
+
+	return nil
+}
+
+// crossStream 封装交叉读取模式下父进程与子进程之间的共享内存。
+// 块的布局和完成状态只在 libipfs_keystone 内部，所以它和 dispatch 数据流都不实现
+// blockReader、blockWriter，WriteTo 和 ReadFrom 每次复制一整块
+type crossStream struct {
+	children // enclave 子进程
+	streamCounter
+	shmaddr  ShmRegion // 共享内存的地址
+	shmsize  int64     // 共享内存的长度
+	cShmsize C.int     // 交给读取函数的共享内存长度
+	input    *os.File  // 从 Request.Source 加密时放明文的内存文件
+	flexible int       // 为 0 时是两个子进程的交叉读取
+}
+
+func openCrossStream(req Request, cfg Config) (*crossStream, error) {
+
+	// 分配共享内存之前先检查子进程的可执行文件
+	bin, err := cfg.WorkerPath(WorkerCross)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert Go int to C int
+	cFileSize := C.longlong(req.Size)
+
+	cFileSize = C.long_alignedFileSize(cFileSize)
+	cBlocksNums := C.long_alignedFileSize_blocksnums(cFileSize)
+
+	// 创建共享内存片段
+	shmsize := C.sizeof_MultiProcessCrossSHMBuffer + (int64(cBlocksNums) * 4) + int64(cFileSize)
+	// MultiProcessCrossRead 用 int 表示共享内存的长度
+	cShmsize, err := cInt(shmsize, "shared memory size")
+	if err != nil {
+		return nil, err
+	}
+	shm, err := longcreateShm(shmsize)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &crossStream{
+		streamCounter: streamCounter{want: req.Size},
+		shmaddr:       shm,
+		shmsize:       shmsize,
+		cShmsize:      cShmsize,
+	}
+
+	// 启动keystone之前先初始化内存空间
+	C.crossInitSHM(unsafe.Pointer(s.shmaddr.crossHeader()), cBlocksNums)
+
+	// 两个子进程交叉读取文件
+	cmds := make([]*exec.Cmd, 2)
+	for i := range cmds {
+		cmds[i] = exec.Command(bin, cfg.workerArgs(WorkerCross, fmt.Sprintf("%d", req.IsAES), fmt.Sprintf("%d", shmsize), req.Path, fmt.Sprintf("%d", i))...)
+	}
+	// 输出全部留在共享内存中，子进程写完就可以退出，不完整的输出由 readResult 报错
+	s.children.release()
+	if err := s.children.start(cmds...); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func openCrossFlexibleStream(req Request, cfg Config) (*crossStream, error) {
+
+	// 分配共享内存之前先检查子进程的可执行文件
+	bin, err := cfg.WorkerPath(WorkerCrossFlexible)
+	if err != nil {
+		return nil, err
+	}
+
+	// 子进程按块的偏移读取源文件，io.Reader 的明文先全部放进内存文件，
+	// 子进程通过 ExtraFiles 继承它，按 /dev/fd 下的路径打开
+	var input *os.File
+	if req.Source != nil {
+		if req.Size <= 0 {
+			return nil, fmt.Errorf("%w: encrypting an io.Reader with several enclaves needs its size", ErrInvalidOptions)
+		}
+		if input, err = spoolAnonShm("input", req.Source, req.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	// Convert Go int to C int
+	cFileSize := C.longlong(req.Size)
+
+	cFileSize = C.long_alignedFileSize(cFileSize)
+	cBlocksNums := C.long_alignedFileSize_blocksnums(cFileSize)
+
+	// 创建共享内存片段
+	shmsize := C.sizeof_MultiProcessCrossFlexibleSHMBuffer + (int64(cBlocksNums) * 4) + int64(cFileSize)
+	// MultiProcessCrossReadFlexible 用 int 表示共享内存的长度
+	cShmsize, err := cInt(shmsize, "shared memory size")
+	if err != nil {
+		closeInput(input)
+		return nil, err
+	}
+	shm, err := longcreateShm(shmsize)
+	if err != nil {
+		closeInput(input)
+		return nil, err
+	}
+
+	flexible := req.Flexible
+	// MAXNUM 10
+	C.fixFlexibleNum(unsafe.Pointer(&flexible))
+
+	s := &crossStream{
+		streamCounter: streamCounter{want: req.Size},
+		shmaddr:       shm,
+		shmsize:       shmsize,
+		cShmsize:      cShmsize,
+		input:         input,
+		flexible:      flexible,
+	}
+
+	// 启动keystone之前先初始化内存空间
+	C.flexiblecrossInitSHM(unsafe.Pointer(s.shmaddr.crossFlexibleHeader()), cBlocksNums)
+
+	cmds := make([]*exec.Cmd, flexible)
+	for numflexible := 0; numflexible < flexible; numflexible++ {
+		path := req.Path
+		var extra []*os.File
+		if input != nil {
+			// 输入文件是子进程中的文件描述符 3
+			extra = []*os.File{input}
+			path = "/dev/fd/3"
+		}
+		cmds[numflexible] = exec.Command(bin, cfg.workerArgs(WorkerCrossFlexible,
+			fmt.Sprintf("%d", req.IsAES),
+			fmt.Sprintf("%d", shmsize),
+			path,
+			fmt.Sprintf("%d", numflexible),
+			fmt.Sprintf("%d", flexible),
+		)...)
+		cmds[numflexible].ExtraFiles = extra
+	}
+	// 输出全部留在共享内存中，子进程写完就可以退出，不完整的输出由 readResult 报错
+	s.children.release()
+	if err := s.children.start(cmds...); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// closeInput 关闭放明文的内存文件，f 可以为 nil
+func closeInput(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
+
+func (s *crossStream) ReadBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+	var result C.int
+	// 交给c语言函数处理
+	if s.flexible == 0 {
+		result = C.MultiProcessCrossRead(s.shmaddr.Ptr(), s.cShmsize, unsafe.Pointer(&p[0]), C.int(len(p)), &readLen)
+	} else {
+		result = C.MultiProcessCrossReadFlexible(s.shmaddr.Ptr(), s.cShmsize, unsafe.Pointer(&p[0]), C.int(len(p)), &readLen)
+	}
+	return s.readResult(int(readLen), int(result))
+}
+
+func (s *crossStream) WriteBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("cross stream is read only")
+}
+
+func (s *crossStream) WaitReady() error {
+	if s.flexible == 0 {
+		C.crosswaitKeystoneReady(s.shmaddr.Ptr())
+	} else {
+		C.flexiblecrosswaitKeystoneReady(s.shmaddr.Ptr(), C.int(s.flexible))
+	}
+	return nil
+}
+
+func (s *crossStream) WaitDone() error { return nil }
+
+func (s *crossStream) Abort() error {
+	s.children.kill()
+	return nil
+}
+
+func (s *crossStream) Close() error {
+	s.children.kill()
+	closeInput(s.input)
+	defer detachShm(s.shmaddr)
+	defer longremoveShm(s.shmsize)
+	return nil
+}
+
+// ==================================================================================
+//				Multi-process Keystone Decrypt
+// ==================================================================================
+
+func dispathSetLength(size uint64) {
+	C.dispathSetLength(C.ulonglong(size))
+}
+
+func dispathGetLength() uint64 {
+	var fileSize uint64
+	C.dispathGetLength((*C.ulonglong)(unsafe.Pointer(&fileSize)))
+	return fileSize
+}
+
+// 获取递增的engine_id函数
+func getDispathEngineSeq() uint64 {
+	return uint64(C.getDispathEngineSeq())
+}
+
+// 创建一个新的共享内存段
+func dispath_longcreateShm(size int64, en_id int) (ShmRegion, error) {
+	shmaddr := C.dispath_long_create_shareMemory(C.longlong(withTrailer(size)), C.int(en_id))
+	return stampedShmRegion(shmaddr, size, fmt.Sprintf("dispath_long_create_shareMemory(%d, %d)", withTrailer(size), en_id))
+}
+
+// 断开连接共享内存
+func dispath_detachShm(shm []Shmsm, flexible int) error {
+
+	for i := 0; i < flexible; i++ {
+		C.dispath_detach_shareMemory(shm[i].shmaddr.Ptr())
+	}
+
+	return nil
+}
+
+// 删除共享内存段
+func dispath_longremoveShm(shm []Shmsm, flexible int) error {
+
+	for i := 0; i < flexible; i++ {
+		C.dispath_long_removeShm(C.longlong(shm[i].shmsize), C.int(i))
+	}
+
+	return nil
+}
+
+type dispatchStream struct {
+	children   // enclave 子进程
+	shmsm      []Shmsm
+	blockcount int64
+	blockbytes int64
+	flexible   int
+	size       int64 // 文件大小
+	written    int64 // 已经交给 enclave 的字节数
+}
+
+func openDispatchStream(req Request, cfg Config) (*dispatchStream, error) {
+
+	// 分配共享内存之前先检查子进程的可执行文件
+	bin, err := cfg.WorkerPath(WorkerDispatch)
+	if err != nil {
+		return nil, err
+	}
+
+	flexible := req.Flexible
+	fileSize := uint64(req.Size)
+
+	// MAXNUM <= 10
+	C.fixFlexibleNum(unsafe.Pointer(&flexible))
+
+	s := &dispatchStream{
+		shmsm:    make([]Shmsm, flexible),
+		flexible: flexible,
+		size:     req.Size,
+	}
+
+	var eblock int64
+	var seblock int64
+	C.dispath_blocks(C.ulonglong(fileSize), unsafe.Pointer(&eblock), unsafe.Pointer(&seblock), C.int(flexible))
+
+	var shmsize int64
+	// 创建共享内存片段
+	if seblock == 0 {
+		for i := 0; i < flexible; i++ {
+			// 每个enclave的共享内存的大小，调度器与enclave之间
+			if i == (flexible - 1) {
+				if eblock == 0 {
+					shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer
+				} else {
+					shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer + (eblock-1)*(4+262144) + (int64)(4+(fileSize&0x3ffff))
+				}
+
+			} else {
+				shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer + eblock*(4+262144)
+			}
+
+			// 每一个enclave与dispath之间都有一个共享内存
+			shm, err := dispath_longcreateShm(shmsize, i)
+			if err != nil {
+				// 删除已经创建的共享内存
+				s.flexible = i
+				s.Close()
+				return nil, err
+			}
+			s.shmsm[i] = Shmsm{
+				shmaddr: shm,
+				shmsize: shmsize,
+			}
+			// 启动keystone之前先初始化内存空间
+			C.dispath_InitSHM(unsafe.Pointer(s.shmsm[i].shmaddr.dispatchHeader()), C.longlong(eblock))
+		}
+	} else {
+		for i := 0; i < flexible; i++ {
+			var snumber int64
+			var snumber_size int64
+			if seblock > 1 {
+				snumber = 1
+				snumber_size = 4 + 262144
+			} else if seblock == 1 {
+				snumber = 1
+				snumber_size = (int64)(4 + (fileSize & 0x3ffff))
+			} else {
+				snumber = 0
+				snumber_size = 0
+			}
+			seblock -= 1
+			// 每个enclave的共享内存的大小，调度器与enclave之间
+			shmsize = C.sizeof_MultiProcessTEEDispatchSHMBuffer + eblock*(4+262144) + snumber_size
+			// 每一个enclave与dispath之间都有一个共享内存
+			shm, err := dispath_longcreateShm(shmsize, i)
+			if err != nil {
+				// 删除已经创建的共享内存
+				s.flexible = i
+				s.Close()
+				return nil, err
+			}
+			s.shmsm[i] = Shmsm{
+				shmaddr: shm,
+				shmsize: shmsize,
+			}
+
+			// 启动keystone之前先初始化内存空间
+			C.dispath_InitSHM(unsafe.Pointer(s.shmsm[i].shmaddr.dispatchHeader()), C.longlong(eblock+snumber))
+		}
+	}
+
+	// 获取当前ms_group的 engine_id
+	dispathEngineSeq := getDispathEngineSeq()
+
+	cmds := make([]*exec.Cmd, flexible)
+	for numflexible := 0; numflexible < flexible; numflexible++ {
+		cmds[numflexible] = exec.Command(bin, cfg.workerArgs(WorkerDispatch,
+			fmt.Sprintf("%d", req.IsAES),
+			fmt.Sprintf("%d", shmsize),
+			fmt.Sprintf("%d", numflexible),
+			fmt.Sprintf("%d", flexible),
+			fmt.Sprintf("%d", dispathEngineSeq),
+		)...)
+	}
+	// 空文件没有输入，子进程可以直接退出
+	if s.size == 0 {
+		s.children.release()
+	}
+	if err := s.children.start(cmds...); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *dispatchStream) ReadBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("dispatch stream is write only")
+}
+
+// WriteBlock 记录交给 enclave 的字节数，WaitDone 用它判断输入是否完整
+func (s *dispatchStream) WriteBlock(p []byte) (int, error) {
+	if s.written+int64(len(p)) >= s.size {
+		s.children.release()
+	}
+	n, err := s.writeBlock(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// writeBlock 按 262144 字节的块轮流分发给各个 enclave
+func (s *dispatchStream) writeBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+
+	var sbytes int64 = int64(262144 - (s.blockbytes + int64(len(p))))
+
+	var bnumber int64
+
+	bnumber = s.blockcount % int64(s.flexible)
+
+	if sbytes >= 0 {
+		result := C.dispath_data_block_4096(s.shmsm[bnumber].shmaddr.Ptr(), C.longlong(s.shmsm[bnumber].shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
+		s.blockbytes = s.blockbytes + int64(len(p))
+		if sbytes == 0 {
+			s.blockbytes = 0
+			s.blockcount++
+		}
+		if result <= 0 {
+			return writeResult(int(readLen), int(result))
+		}
+	} else {
+		var syx int = int(262144 - s.blockbytes)
+		result := C.dispath_data_block_4096(s.shmsm[bnumber].shmaddr.Ptr(), C.longlong(s.shmsm[bnumber].shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(syx), &readLen)
+		if result <= 0 {
+			return writeResult(int(readLen), int(result))
+		}
+		s.blockcount++
+
+		bnumber = s.blockcount % int64(s.flexible)
+		var readLen1 C.int = 0
+		result = C.dispath_data_block_4096(s.shmsm[bnumber].shmaddr.Ptr(), C.longlong(s.shmsm[bnumber].shmsize), (*C.char)(unsafe.Pointer(&p[syx])), C.int(len(p)-syx), &readLen1)
+
+		s.blockbytes = int64(len(p) - syx)
+		readLen = readLen + readLen1
+		if result <= 0 {
+			return writeResult(int(readLen), int(result))
+		}
+	}
+
+	return int(readLen), nil
+}
+
+func (s *dispatchStream) WaitReady() error {
+	for i := 0; i < s.flexible; i++ {
+		for {
+			if C.dispathwaitKeystoneReady(s.shmsm[i].shmaddr.Ptr()) == 1 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (s *dispatchStream) WaitDone() error {
+	if err := shortWrite(s.written, s.size); err != nil {
+		s.children.kill()
+		return err
+	}
+	for i := 0; i < s.flexible; i++ {
+		for {
+			if C.dispathwaitKeystoneReady(s.shmsm[i].shmaddr.Ptr()) == 2 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (s *dispatchStream) Abort() error {
+	s.children.kill()
+	return nil
+}
+
+func (s *dispatchStream) Close() error {
+	s.children.kill()
+	defer dispath_detachShm(s.shmsm, s.flexible)
+	defer dispath_longremoveShm(s.shmsm, s.flexible)
+	return nil
+}
+
+// ==================================================================================
+//				Multi-process Keystone Decrypt secure dispatch
+// ==================================================================================
+
+// 创建一个新的共享内存段
+func secure_dispatch_ulonglongcreateShm(shmsize uint64) (ShmRegion, error) {
+	shmaddr := C.secure_dispatch_ulnoglong_create_shareMemory(C.ulonglong(shmsize + shmTrailerSize))
+	return stampedShmRegionU(shmaddr, shmsize, fmt.Sprintf("secure_dispatch_ulnoglong_create_shareMemory(%d)", shmsize+shmTrailerSize))
+}
+
+type secureDispatchStream struct {
+	children           // enclave 子进程
+	shmaddr  ShmRegion // 共享内存的地址
+	shmsize  uint64    // 共享内存的长度
+	blockNum uint64
+	flexible int
+	size     int64 // 文件大小
+	written  int64 // 已经交给 enclave 的字节数
+}
+
+func openSecureDispatchStream(req Request, cfg Config) (*secureDispatchStream, error) {
+
+	// 分配共享内存之前先检查子进程的可执行文件
+	bin, err := cfg.WorkerPath(WorkerSecureDispatch)
+	if err != nil {
+		return nil, err
+	}
+
+	flexible := req.Flexible
+	// MAXNUM <= 10
+	C.fixFlexibleNum(unsafe.Pointer(&flexible))
+
+	// 创建共享内存片段
+	var blockNum uint64
+	shmsize := uint64(C.MultiProcessTEESecureDispatchGetSHMSize(C.ulonglong(req.Size), unsafe.Pointer(&blockNum), C.int(flexible)))
+	shmaddr, err := secure_dispatch_ulonglongcreateShm(shmsize)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &secureDispatchStream{
+		shmaddr:  shmaddr,
+		shmsize:  shmsize,
+		blockNum: blockNum,
+		flexible: flexible,
+		size:     req.Size,
+	}
+
+	C.secure_dispacth_initSHM(s.shmaddr.Ptr(), C.ulonglong(blockNum), C.int(flexible))
+
+	// 获取当前ms_group的 engine_id
+	dispatchEngineSeq := getDispathEngineSeq()
+
+	cmds := make([]*exec.Cmd, flexible)
+	for numflexible := 0; numflexible < flexible; numflexible++ {
+		cmds[numflexible] = exec.Command(bin, cfg.workerArgs(WorkerSecureDispatch,
+			fmt.Sprintf("%d", req.IsAES),
+			fmt.Sprintf("%d", shmsize),
+			fmt.Sprintf("%d", numflexible),
+			fmt.Sprintf("%d", flexible),
+			fmt.Sprintf("%d", dispatchEngineSeq),
+		)...)
+	}
+	// 空文件没有输入，子进程可以直接退出
+	if s.size == 0 {
+		s.children.release()
+	}
+	if err := s.children.start(cmds...); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *secureDispatchStream) ReadBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("secure dispatch stream is write only")
+}
+
+func (s *secureDispatchStream) WriteBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+	if s.written+int64(len(p)) >= s.size {
+		s.children.release()
+	}
+
+	result := C.secure_dispatch_write(s.shmaddr.Ptr(), C.longlong(s.shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen, C.int(s.flexible))
+	s.written += int64(readLen)
+
+	return writeResult(int(readLen), int(result))
+}
+
+func (s *secureDispatchStream) WaitReady() error {
+	C.secure_dispatch_waitKeystoneReady(s.shmaddr.Ptr(), C.int(s.flexible))
+	return nil
+}
+
+func (s *secureDispatchStream) WaitDone() error {
+	if err := shortWrite(s.written, s.size); err != nil {
+		s.children.kill()
+		return err
+	}
+	C.secure_dispatch_waitKeystoneDone(s.shmaddr.Ptr(), C.int(s.flexible))
+	return nil
+}
+
+func (s *secureDispatchStream) Abort() error {
+	s.children.kill()
+	return nil
+}
+
+func (s *secureDispatchStream) Close() error {
+	s.children.kill()
+	// 断开连接共享内存
+	defer C.secure_dispatch_detach_shareMemory(s.shmaddr.Ptr())
+	// 删除共享内存段
+	defer C.secure_dispatch_ulnoglong_remove_shareMemory(C.ulonglong(s.shmsize))
+	return nil
+}
+
+// ==================================================================================
+//				The new dir Multi-process Keystone Decrypt secure dispatch
+// ==================================================================================
+
+// 创建一个新的共享内存段
+func the_new_secure_dispatch_ulonglongcreateShm_just_call(shmsize uint64) (ShmRegion, error) {
+	shmaddr := C.the_new_dir_secure_dispatch_ulnoglong_create_shareMemory_just_call(C.ulonglong(shmsize + shmTrailerSize))
+	return stampedShmRegionU(shmaddr, shmsize, fmt.Sprintf("the_new_dir_secure_dispatch_ulnoglong_create_shareMemory_just_call(%d)", shmsize+shmTrailerSize))
+}
+
+// dirSecureDispatchSession 只启动一次 enclave，之后逐个文件分发
+type dirSecureDispatchSession struct {
+	children            // enclave 子进程
+	shmaddr   ShmRegion // 共享内存的地址
+	shmsize   uint64    // 共享内存的长度
+	fileCount int64
+	flexible  int
+}
+
+func openDirSecureDispatchSession(req Request, cfg Config) (*dirSecureDispatchSession, error) {
+
+	// 分配共享内存之前先检查子进程的可执行文件
+	bin, err := cfg.WorkerPath(WorkerDirSecureDispatch)
+	if err != nil {
+		return nil, err
+	}
+
+	flexible := req.Flexible
+	// MAXNUM <= 10
+	C.fixFlexibleNum(unsafe.Pointer(&flexible))
+
+	// 创建共享内存片段
+	shmsize := uint64(C.TheNewDirMultiProcessTEESecureDispatchGetSHMSizeJustCall(C.int(flexible)))
+	shmaddr, err := the_new_secure_dispatch_ulonglongcreateShm_just_call(shmsize)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &dirSecureDispatchSession{
+		shmaddr:  shmaddr,
+		shmsize:  shmsize,
+		flexible: flexible,
+	}
+
+	C.the_new_secure_dispacth_initSHM_just_call(ss.shmaddr.Ptr(), C.int(flexible))
+
+	// 获取当前ms_group的 engine_id
+	dispatchEngineSeq := getDispathEngineSeq()
+
+	cmds := make([]*exec.Cmd, flexible)
+	for numflexible := 0; numflexible < flexible; numflexible++ {
+		cmds[numflexible] = exec.Command(bin, cfg.workerArgs(WorkerDirSecureDispatch,
+			fmt.Sprintf("%d", req.IsAES),
+			fmt.Sprintf("%d", shmsize),
+			fmt.Sprintf("%d", numflexible),
+			fmt.Sprintf("%d", flexible),
+			fmt.Sprintf("%d", dispatchEngineSeq),
+		)...)
+	}
+	if err := ss.children.start(cmds...); err != nil {
+		// libipfs_keystone.a 没有删除 just call 共享内存的函数，只能断开连接
+		C.the_new_secure_dispatch_detach_shareMemory(ss.shmaddr.Ptr())
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+func (ss *dirSecureDispatchSession) WaitReady() error {
+	C.the_new_secure_dispatch_waitKeystoneReady_just_call(ss.shmaddr.Ptr(), C.int(ss.flexible))
+	return nil
+}
+
+func (ss *dirSecureDispatchSession) NextEncrypt(path string, size int64) (Stream, error) {
+	return nil, fmt.Errorf("secure dispatch session only decrypts")
+}
+
+// nextDecrypt 设置下一个文件的大小，C 代码返回该文件的共享内存
+func (ss *dirSecureDispatchSession) NextDecrypt(size uint64) (Stream, error) {
+	var blockNum uint64
+	// 长度 0 结束会话，子进程处理完最后一个文件就退出
+	if size == 0 {
+		ss.children.release()
+	}
+	shmsize := size
+	shmaddr := C.thenewdirsecuredispathSetLength(ss.shmaddr.Ptr(), unsafe.Pointer(&blockNum), unsafe.Pointer(&shmsize), C.int(ss.flexible))
+
+	if shmsize == 0 {
+		ss.fileCount = 0
+		return nil, nil
+	}
+	shm, err := newShmRegionU(shmaddr, shmsize, fmt.Sprintf("thenewdirsecuredispathSetLength(%d)", size))
+	if err != nil {
+		return nil, err
+	}
+	ss.fileCount++
+
+	return &dirSecureDispatchStream{
+		ss:               ss,
+		shmaddr:          shm,
+		shmsize:          shmsize,
+		shmaddr_justcall: ss.shmaddr,
+		flexible:         ss.flexible,
+		blockNum:         blockNum,
+		fileCount:        ss.fileCount,
+		size:             int64(size),
+	}, nil
+}
+
+func (ss *dirSecureDispatchSession) Abort() error {
+	ss.children.kill()
+	return nil
+}
+
+func (ss *dirSecureDispatchSession) End() error {
+	_, err := ss.NextDecrypt(0)
+	return err
+}
+
+type dirSecureDispatchStream struct {
+	ss               *dirSecureDispatchSession
+	shmaddr          ShmRegion // 共享内存的地址
+	shmsize          uint64    // 共享内存的长度
+	shmaddr_justcall ShmRegion
+	fileCount        int64
+	blockNum         uint64
+	flexible         int
+	size             int64 // 文件大小
+	written          int64 // 已经交给 enclave 的字节数
+}
+
+func (s *dirSecureDispatchStream) ReadBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("secure dispatch stream is write only")
+}
+
+func (s *dirSecureDispatchStream) WriteBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+
+	result := C.the_new_secure_dispatch_write(s.shmaddr.Ptr(), C.longlong(s.shmsize), (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen, C.int(s.flexible))
+	s.written += int64(readLen)
+
+	return writeResult(int(readLen), int(result))
+}
+
+func (s *dirSecureDispatchStream) WaitReady() error {
+	C.the_new_secure_dispatch_wait_transfer_keystone_ready(s.shmaddr_justcall.Ptr(), C.int(s.flexible))
+	return nil
+}
+
+func (s *dirSecureDispatchStream) WaitDone() error {
+	// 子进程属于会话，它们在等这个文件剩下的数据，整个会话都不能继续
+	if err := shortWrite(s.written, s.size); err != nil {
+		s.ss.Abort()
+		return err
+	}
+	C.the_new_secure_dispatch_wait_transfer_keystoneDone(s.shmaddr_justcall.Ptr(), C.int(s.flexible))
+	return nil
+}
+
+// 子进程属于会话，中止一个文件就中止整个会话
+func (s *dirSecureDispatchStream) Abort() error { return s.ss.Abort() }
+
+func (s *dirSecureDispatchStream) Workers() []WorkerStatus  { return s.ss.Workers() }
+func (s *dirSecureDispatchStream) Crashed() <-chan struct{} { return s.ss.Crashed() }
+func (s *dirSecureDispatchStream) CrashErr() error          { return s.ss.CrashErr() }
+
+func (s *dirSecureDispatchStream) Close() error {
+	// 断开连接共享内存
+	defer C.the_new_secure_dispatch_detach_shareMemory(s.shmaddr.Ptr())
+	// 删除共享内存段
+	defer C.the_new_secure_dispatch_ulnoglong_remove_shareMemory(C.ulonglong(s.shmsize), C.longlong(s.fileCount))
+	return nil
+}
+
+// ==================================================================================
+//				The new dir Keystone Decrypt
+// ==================================================================================
+
+// dirRingSession 只启动一次 enclave，之后逐个文件通过同一个 RingBuffer 写入
+type dirRingSession struct {
+	rb       *C.RingBuffer // 指向C语言中的RingBuffer结构
+	kjb      *C.KeystoneJustReady
+	plain    *plainFifo // 解密到 Request.Sink 时 enclave 写明文的管道
+	plainErr error      // freeOnce 之后可读
+	wg       sync.WaitGroup
+	freeOnce sync.Once
+}
+
+func openDirRingSession(req Request) (*dirRingSession, error) {
+
+	// 整个会话的明文依次写进同一个管道
+	var plain *plainFifo
+	if req.Sink != nil {
+		var err error
+		if plain, err = newPlainFifo(req.Sink); err != nil {
+			return nil, err
+		}
+		req.Path = plain.Path()
+	}
+
+	pk, err := cMalloc(C.sizeof_KeystoneJustReady, "KeystoneJustReady")
+	if err != nil {
+		if plain != nil {
+			plain.Close()
+		}
+		return nil, err
+	}
+	kjb := (*C.KeystoneJustReady)(pk)
+
+	pr, err := cMalloc(C.sizeof_RingBuffer, "RingBuffer")
+	if err != nil {
+		cFree(pk)
+		if plain != nil {
+			plain.Close()
+		}
+		return nil, err
+	}
+	rb := (*C.RingBuffer)(pr)
+
+	// Convert Go int to C int
+	cIsAES := C.int(req.IsAES)
+
+	C.init_keystone_just_ready(kjb)
+	C.init_ring_buffer(rb)
+
+	ss := &dirRingSession{
+		kjb:   kjb,
+		rb:    rb,
+		plain: plain,
+	}
+
+	ss.wg.Add(1)
+	go func() {
+		defer ss.wg.Done() // 确保在goroutine结束时调用Done
+		// 输出文件在整个会话中使用，enclave 返回之后释放
+		path := cString(req.Path)
+		defer freeCString(path)
+		C.the_new_dir_ipfs_keystone_de(cIsAES, unsafe.Pointer(path), unsafe.Pointer(kjb), unsafe.Pointer(rb))
+		fmt.Println("the new dir TEE read file done")
+	}()
+
+	return ss, nil
+}
+
+func (ss *dirRingSession) WaitReady() error {
+	C.the_new_dir_keystone_wait_ready(unsafe.Pointer(ss.kjb))
+	return nil
+}
+
+func (ss *dirRingSession) NextEncrypt(path string, size int64) (Stream, error) {
+	return nil, fmt.Errorf("keystone decrypt session only decrypts")
+}
+
+// nextDecrypt 设置下一个文件的大小
+func (ss *dirRingSession) NextDecrypt(size uint64) (Stream, error) {
+	C.thenewdirkeystonedecryptSetLength(unsafe.Pointer(ss.kjb), C.ulonglong(size))
+
+	if size == 0 {
+		return nil, nil
+	}
+	return &dirRingStream{rb: ss.rb, kjb: ss.kjb}, nil
+}
+
+// Abort 停止 RingBuffer，enclave 线程返回之后在后台释放
+func (ss *dirRingSession) Abort() error {
+	C.ring_buffer_stop(ss.rb)
+	go ss.release()
+	return nil
+}
+
+// End 通知 enclave 没有更多文件，等 enclave 线程返回之后释放，返回写明文的 io.Writer 的错误
+func (ss *dirRingSession) End() error {
+	if _, err := ss.NextDecrypt(0); err != nil {
+		return err
+	}
+	return ss.release()
+}
+
+// release 等待 enclave 线程返回，释放 RingBuffer 和 KeystoneJustReady，只执行一次
+func (ss *dirRingSession) release() error {
+	ss.freeOnce.Do(func() {
+		ss.wg.Wait()
+		if ss.plain != nil {
+			ss.plainErr = ss.plain.Close()
+		}
+		cFree(unsafe.Pointer(ss.rb))
+		cFree(unsafe.Pointer(ss.kjb))
+	})
+	return ss.plainErr
+}
+
+type dirRingStream struct {
+	rb  *C.RingBuffer
+	kjb *C.KeystoneJustReady
+}
+
+func (s *dirRingStream) ReadBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("keystone decrypt stream is write only")
+}
+
+func (s *dirRingStream) WriteBlock(p []byte) (int, error) {
+	wrsult := C.ring_buffer_write(s.rb, (*C.char)(unsafe.Pointer(&p[0])), C.size_t(len(p)))
+	// ring_buffer_write 返回写入的长度，缓冲区停止时返回 0
+	return writeResult(int(wrsult), int(wrsult))
+}
+
+func (s *dirRingStream) WaitReady() error {
+	C.the_new_dir_wait_keystone_file_ready(unsafe.Pointer(s.kjb))
+	return nil
+}
+
+func (s *dirRingStream) WaitDone() error {
+	C.ring_buffer_stop(s.rb)
+	fmt.Println("wait TheNewDirTEEFileReader Close")
+	C.the_new_dir_wait_keystone_file_end(s.kjb)
+	return nil
+}
+
+func (s *dirRingStream) Abort() error {
+	C.ring_buffer_stop(s.rb)
+	return nil
+}
+
+// RingBuffer 和 KeystoneJustReady 属于会话，由会话的 End 或 Abort 释放
+func (s *dirRingStream) Close() error { return nil }
+
+// ==================================================================================
+//				The New Dir Multi-process Cross-read Flexible Keystone Encrypt
+// ==================================================================================
+
+// 创建一个新的共享内存段
+func theNewDirlongcreateShm(size int64) (ShmRegion, error) {
+	shmaddr := C.the_new_dir_long_create_shareMemory(C.longlong(withTrailer(size)))
+	return stampedShmRegion(shmaddr, size, fmt.Sprintf("the_new_dir_long_create_shareMemory(%d)", withTrailer(size)))
+}
+
+// 创建一个新的共享内存段
+func theNewDirlongcreateShmofFile(size int64, fileCount int64) (ShmRegion, error) {
+	shmaddr := C.the_new_dir_long_create_shareMemory_of_file(C.longlong(withTrailer(size)), C.longlong(fileCount))
+	return stampedShmRegion(shmaddr, size, fmt.Sprintf("the_new_dir_long_create_shareMemory_of_file(%d, %d)", withTrailer(size), fileCount))
+}
+
+// 删除共享内存段
+func the_new_dir_flexbile_longremoveShm(shmsize int64, fileCount int64) error {
+	C.the_new_dir_flexbile_long_removeShm(C.longlong(shmsize), C.longlong(fileCount))
+
+	return nil
+}
+
+type dirFlexibleSession struct {
+	children            // enclave 子进程
+	path      cPath     // 正在处理的文件路径
+	shmaddr   ShmRegion // 共享内存的地址
+	shmsize   int64     // 共享内存的长度
+	fileCount int64
+	flexible  int
+}
+
+func openDirFlexibleSession(req Request, cfg Config) (*dirFlexibleSession, error) {
+
+	// 分配共享内存之前先检查子进程的可执行文件
+	bin, err := cfg.WorkerPath(WorkerDirCrossFlexible)
+	if err != nil {
+		return nil, err
+	}
+
+	flexible := req.Flexible
+	// MAXNUM 10
+	C.fixFlexibleNum(unsafe.Pointer(&flexible))
+
+	// 创建共享内存片段
+	shmsize := int64(C.sizeof_TheNewDirMultiProcessCrossFlexibleSHMBufferJustCall + (flexible * C.sizeof_int) + (flexible * C.sizeof_longlong))
+	shm, err := theNewDirlongcreateShm(shmsize)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := &dirFlexibleSession{
+		shmaddr:  shm,
+		shmsize:  shmsize,
+		flexible: flexible,
+	}
+
+	// 启动keystone之前先初始化内存空间
+	C.theNewDirflexiblecrossInitSHMJustCall(unsafe.Pointer(ss.shmaddr.dirFlexibleHeader()), C.int(flexible))
+
+	cmds := make([]*exec.Cmd, flexible)
+	for numflexible := 0; numflexible < flexible; numflexible++ {
+		cmds[numflexible] = exec.Command(bin, cfg.workerArgs(WorkerDirCrossFlexible,
+			fmt.Sprintf("%d", req.IsAES),
+			fmt.Sprintf("%d", shmsize),
+			fmt.Sprintf("%d", numflexible),
+			fmt.Sprintf("%d", flexible),
+		)...)
+	}
+	if err := ss.children.start(cmds...); err != nil {
+		// libipfs_keystone.a 没有删除 just call 共享内存的函数，只能断开连接
+		detachShm(ss.shmaddr)
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+func (ss *dirFlexibleSession) WaitReady() error {
+	C.theNewDirflexiblecrosswaitKeystoneReady(ss.shmaddr.Ptr(), C.int(ss.flexible))
+	return nil
+}
+
+// nextEncrypt 为下一个文件创建共享内存，并把文件路径交给 enclave
+func (ss *dirFlexibleSession) NextEncrypt(fpath string, fileSize int64) (Stream, error) {
+
+	cFileSize := C.long_alignedFileSize(C.longlong(fileSize))
+	cBlocksNums := C.long_alignedFileSize_blocksnums(cFileSize)
+
+	// 创建共享内存片段
+	shmsize := C.sizeof_TheNewDirMultiProcessCrossFlexibleSHMBufferReader + int64(cBlocksNums*C.sizeof_int) + int64(cFileSize)
+	// TheNewDirMultiProcessCrossReadFlexible 用 int 表示共享内存的长度
+	cShmsize, err := cInt(shmsize, "shared memory size")
+	if err != nil {
+		return nil, err
+	}
+	shm, err := theNewDirlongcreateShmofFile(shmsize, ss.fileCount+1)
+	if err != nil {
+		return nil, err
+	}
+	ss.fileCount++
+
+	s := &dirFlexibleStream{
+		ss:               ss,
+		streamCounter:    streamCounter{want: fileSize},
+		shmaddr:          shm,
+		shmsize:          shmsize,
+		cShmsize:         cShmsize,
+		fileCount:        ss.fileCount,
+		flexible:         ss.flexible,
+		shmaddr_justcall: ss.shmaddr,
+		path:             ss.path.set(fpath),
+	}
+
+	C.theNewDirflexiblecrosswaitKeystoneTransferFilesReady(ss.shmaddr.Ptr(), C.int(ss.flexible), unsafe.Pointer(s.shmaddr.dirFlexibleFileHeader()), cBlocksNums, cFileSize, unsafe.Pointer(s.path))
+
+	return s, nil
+}
+
+func (ss *dirFlexibleSession) NextDecrypt(size uint64) (Stream, error) {
+	return nil, fmt.Errorf("flexible session only encrypts")
+}
+
+// Abort 杀死子进程之后不会再有人读取路径
+func (ss *dirFlexibleSession) Abort() error {
+	ss.children.kill()
+	ss.path.releaseAll()
+	return nil
+}
+
+func (ss *dirFlexibleSession) End() error {
+	ss.children.release()
+	C.theNewDirflexiblecrosswaitKeystoneTransferFilesReady(ss.shmaddr.Ptr(), C.int(ss.flexible), nil, 0, 0, nil)
+	ss.path.releaseAll()
+	return nil
+}
+
+type dirFlexibleStream struct {
+	ss *dirFlexibleSession
+	streamCounter
+	shmaddr          ShmRegion // 共享内存的地址
+	shmsize          int64     // 共享内存的长度
+	cShmsize         C.int     // 交给读取函数的共享内存长度
+	fileCount        int64
+	flexible         int
+	shmaddr_justcall ShmRegion
+	path             *C.char // 交给 enclave 的文件路径，属于会话
+}
+
+func (s *dirFlexibleStream) ReadBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+	// 交给c语言函数处理
+	result := C.TheNewDirMultiProcessCrossReadFlexible(s.shmaddr.Ptr(), s.cShmsize, unsafe.Pointer(&p[0]), C.int(len(p)), &readLen)
+	return s.readResult(int(readLen), int(result))
+}
+
+func (s *dirFlexibleStream) WriteBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("flexible stream is read only")
+}
+
+func (s *dirFlexibleStream) WaitReady() error { return nil }
+
+func (s *dirFlexibleStream) WaitDone() error {
+	fmt.Println("The New Dir MultiProcess Cross Flexible wait TEEFileReader end")
+	C.theNewDirflexiblecrosswaitKeystoneTransferFilesEnd(s.shmaddr_justcall.Ptr(), C.int(s.flexible))
+	// enclave 已经处理完这个文件
+	s.ss.path.release(s.path)
+	return nil
+}
+
+// 子进程属于会话，中止一个文件就中止整个会话
+func (s *dirFlexibleStream) Abort() error { return s.ss.Abort() }
+
+func (s *dirFlexibleStream) Workers() []WorkerStatus  { return s.ss.Workers() }
+func (s *dirFlexibleStream) Crashed() <-chan struct{} { return s.ss.Crashed() }
+func (s *dirFlexibleStream) CrashErr() error          { return s.ss.CrashErr() }
+
+func (s *dirFlexibleStream) Close() error {
+	defer detachShm(s.shmaddr)
+	defer the_new_dir_flexbile_longremoveShm(s.shmsize, s.fileCount)
+	return nil
+}
+
+// ==================================================================================
+//				The New Dir Keystone Encrypt
+// ==================================================================================
+
+type dirAddSession struct {
+	rb       *C.RingBuffer // 指向C语言中的RingBuffer结构
+	kjb      *C.KeystoneJustReadyAdd
+	wg       sync.WaitGroup
+	path     cPath // 正在处理的文件路径
+	freeOnce sync.Once
+}
+
+func openDirAddSession(req Request) (*dirAddSession, error) {
+
+	pk, err := cMalloc(C.sizeof_KeystoneJustReadyAdd, "KeystoneJustReadyAdd")
+	if err != nil {
+		return nil, err
+	}
+	kjb := (*C.KeystoneJustReadyAdd)(pk)
+
+	pr, err := cMalloc(C.sizeof_RingBuffer, "RingBuffer")
+	if err != nil {
+		cFree(pk)
+		return nil, err
+	}
+	rb := (*C.RingBuffer)(pr)
+
+	// Convert Go int to C int
+	cIsAES := C.int(req.IsAES)
+
+	C.init_keystone_just_ready_add(kjb)
+	C.init_ring_buffer(rb)
+
+	ss := &dirAddSession{
+		kjb: kjb,
+		rb:  rb,
+	}
+
+	ss.wg.Add(1)
+	go func() {
+		defer ss.wg.Done() // 确保在goroutine结束时调用Done
+		C.the_new_dir_ipfs_keystone(cIsAES, unsafe.Pointer(kjb), unsafe.Pointer(rb))
+		fmt.Println("the new dir TEE read file done")
+	}()
+
+	return ss, nil
+}
+
+func (ss *dirAddSession) WaitReady() error {
+	C.the_new_dir_keystone_wait_ready_add(unsafe.Pointer(ss.kjb))
+	return nil
+}
+
+// nextEncrypt 把下一个文件的路径交给 enclave
+func (ss *dirAddSession) NextEncrypt(fpath string, fileSize int64) (Stream, error) {
+	s := &dirAddStream{ss: ss, rb: ss.rb, kjb: ss.kjb, path: ss.path.set(fpath)}
+	s.want = fileSize
+
+	C.theNewDirKeystoneTransferFilesReady(unsafe.Pointer(ss.kjb), C.longlong(fileSize), unsafe.Pointer(s.path))
+
+	return s, nil
+}
+
+func (ss *dirAddSession) NextDecrypt(size uint64) (Stream, error) {
+	return nil, fmt.Errorf("keystone add session only encrypts")
+}
+
+// Abort 之后 enclave 线程可能还在读取路径和缓冲区，等它返回之后在后台释放
+func (ss *dirAddSession) Abort() error {
+	C.ring_buffer_stop(ss.rb)
+	go ss.release()
+	return nil
+}
+
+// End 通知 enclave 没有更多文件，等 enclave 线程返回之后释放
+func (ss *dirAddSession) End() error {
+	C.theNewDirKeystoneTransferFilesReady(unsafe.Pointer(ss.kjb), 0, nil)
+	ss.release()
+	return nil
+}
+
+// release 等待 enclave 线程返回，释放路径、RingBuffer 和 KeystoneJustReadyAdd，只执行一次
+func (ss *dirAddSession) release() {
+	ss.freeOnce.Do(func() {
+		ss.wg.Wait()
+		ss.path.releaseAll()
+		cFree(unsafe.Pointer(ss.rb))
+		cFree(unsafe.Pointer(ss.kjb))
+	})
+}
+
+type dirAddStream struct {
+	streamCounter
+	ss   *dirAddSession
+	rb   *C.RingBuffer
+	kjb  *C.KeystoneJustReadyAdd
+	path *C.char // 交给 enclave 的文件路径，属于会话
+}
+
+func (s *dirAddStream) ReadBlock(p []byte) (int, error) {
+	var readLen C.int = 0
+	result := C.ring_buffer_read(s.rb, (*C.char)(unsafe.Pointer(&p[0])), C.int(len(p)), &readLen)
+	return s.readResult(int(readLen), int(result))
+}
+
+func (s *dirAddStream) WriteBlock(p []byte) (int, error) {
+	return 0, fmt.Errorf("keystone add stream is read only")
+}
+
+func (s *dirAddStream) WaitReady() error { return nil }
+
+func (s *dirAddStream) WaitDone() error {
+	C.the_new_dir_wait_keystone_file_end_add(s.kjb, s.rb)
+	// enclave 已经处理完这个文件
+	s.ss.path.release(s.path)
+	return nil
+}
+
+func (s *dirAddStream) Abort() error {
+	C.ring_buffer_stop(s.rb)
+	return nil
+}
+
+// RingBuffer 和 KeystoneJustReadyAdd 属于会话，由会话的 End 或 Abort 释放
+func (s *dirAddStream) Close() error { return nil }
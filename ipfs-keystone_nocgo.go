@@ -0,0 +1,27 @@
+//go:build !keystone
+
+package ipfsKeystoneTest
+
+// 不使用 -tags keystone 构建时，默认后端和 AES、dispatch 辅助函数都由纯 Go 模拟
+
+func builtinBackend() Backend { return SimBackend{} }
+
+func aesEncrypt(pt []byte, ptLen int, ct []byte) int {
+	return simAESEncrypt(pt, ptLen, ct)
+}
+
+func aesDecrypt(ct []byte, ctLen int, pt []byte) int {
+	return simAESDecrypt(ct, ctLen, pt)
+}
+
+func dispathSetLength(size uint64) {
+	simDispathSetLength(size)
+}
+
+func dispathGetLength() uint64 {
+	return simDispathGetLength()
+}
+
+func getDispathEngineSeq() uint64 {
+	return simGetDispathEngineSeq()
+}
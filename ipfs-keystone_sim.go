@@ -0,0 +1,785 @@
+package ipfsKeystoneTest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	simBlockSize   = 262144  // enclave 每次处理的块大小 256 KiB
+	simRingSize    = 1 << 20 // RingBuffer 的容量
+	simMaxFlexible = 10      // 与 fixFlexibleNum 的上限一致
+)
+
+var (
+	// simKey 对应 libipfs_keystone.a 中编译进去的密钥
+	simKey = []byte{
+		0x69, 0x70, 0x66, 0x73, 0x2d, 0x6b, 0x65, 0x79,
+		0x73, 0x74, 0x6f, 0x6e, 0x65, 0x2d, 0x73, 0x6d,
+	}
+	// simIV 用于 Rv_AES_Encrypt / Rv_AES_Decrypt 的 CBC 模式
+	simIV = make([]byte, aes.BlockSize)
+	// simNonce 是数据流 CTR 计数器的高 8 字节
+	simNonce = []byte{0x69, 0x70, 0x66, 0x73, 0x2d, 0x6b, 0x73, 0x74}
+)
+
+var (
+	simDispathLength uint64 // dispathSetLength 设置的文件大小
+	simEngineSeq     uint64 // engine_id 计数器
+)
+
+// readFunc 把 read 方法适配为 io.Reader
+type readFunc func(p []byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) { return f(p) }
+
+// simFixFlexibleNum 对应 C.fixFlexibleNum，把 enclave 数量限制在 1 到 10
+func simFixFlexibleNum(flexible int) int {
+	if flexible < 1 {
+		return 1
+	}
+	if flexible > simMaxFlexible {
+		return simMaxFlexible
+	}
+	return flexible
+}
+
+// simAlloc 对应 cgo 后端的一次 C 分配（RingBuffer、MultiThreadedBuffer、KeystoneJustReady），创建时计入 cAllocs，
+// release 只减一次，模拟后端的数据流和会话没有释放时 OutstandingCAllocs 同样不为 0
+type simAlloc struct{ released atomic.Bool }
+
+func newSimAlloc() *simAlloc {
+	cAllocs.Add(1)
+	return &simAlloc{}
+}
+
+func (a *simAlloc) release() {
+	if a.released.CompareAndSwap(false, true) {
+		cAllocs.Add(-1)
+	}
+}
+
+// simCryptBlock 用 AES-CTR 变换第 index 块，加密和解密是同一个操作。
+// 计数器从 index*simBlockSize/16 开始，各块拼接起来与整个文件做一次 CTR 相同
+func simCryptBlock(isAES int, index int64, b []byte) {
+	if isAES == 0 {
+		return
+	}
+	block, err := aes.NewCipher(simKey)
+	if err != nil {
+		panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, simNonce)
+	binary.BigEndian.PutUint64(iv[8:], uint64(index)*(simBlockSize/aes.BlockSize))
+	cipher.NewCTR(block, iv).XORKeyStream(b, b)
+}
+
+// SimBackend 用纯 Go 模拟 enclave：RingBuffer、256 KiB 分块和 AES 都在 Go 中实现，
+// 多进程模式用 goroutine 代替子进程，这样没有安装 Keystone 工具链的机器也能编译和测试整个包。
+// 两种构建中都可以使用，不使用 -tags keystone 构建时它是默认后端。零值即可使用
+type SimBackend struct {
+	// DispatchSink 为 dispatch 和 secure dispatch 模式的每条数据流返回明文的去向，
+	// 真实的 enclave 自己决定明文写到哪里，为 nil 时模拟后端丢弃明文
+	DispatchSink func() io.Writer
+}
+
+func (b SimBackend) dispatchSink() io.Writer {
+	if b.DispatchSink == nil {
+		return io.Discard
+	}
+	return b.DispatchSink()
+}
+
+func (SimBackend) OpenEncrypt(req Request) (Stream, error) {
+	if req.Source != nil && req.Mode != ModeSingle && req.Mode != ModeCrossFlexible {
+		return nil, fmt.Errorf("encrypt mode %d cannot read from an io.Reader", req.Mode)
+	}
+	switch req.Mode {
+	case ModeSingle:
+		return openSimRingEncrypt(req)
+	case ModeMultiThreaded, ModeMultiProcess, ModeCross:
+		return openSimFramesEncrypt(req, 2)
+	case ModeCrossFlexible:
+		return openSimFramesEncrypt(req, simFixFlexibleNum(req.Flexible))
+	}
+	return nil, fmt.Errorf("unsupported encrypt mode %d", req.Mode)
+}
+
+func (b SimBackend) OpenDecrypt(req Request) (Stream, error) {
+	switch req.Mode {
+	case ModeSingle:
+		if req.Sink != nil {
+			out := newPlainOutput(req.Sink)
+			return openSimRingDecrypt(req.IsAES, req.FirstBlock, out, out), nil
+		}
+		f, err := os.Create(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return openSimRingDecrypt(req.IsAES, req.FirstBlock, f, f), nil
+	case ModeDispatch, ModeSecureDispatch:
+		return openSimDispatch(req.IsAES, req.Size, simFixFlexibleNum(req.Flexible), b.dispatchSink()), nil
+	}
+	return nil, fmt.Errorf("unsupported decrypt mode %d", req.Mode)
+}
+
+func (b SimBackend) OpenEncryptSession(req Request) (Session, error) {
+	switch req.Mode {
+	case ModeSingle, ModeCrossFlexible:
+		return &simSession{alloc: newSimAlloc(), b: b, req: req}, nil
+	}
+	return nil, fmt.Errorf("unsupported encrypt session mode %d", req.Mode)
+}
+
+func (b SimBackend) OpenDecryptSession(req Request) (Session, error) {
+	switch req.Mode {
+	case ModeSingle:
+		// 会话中的所有文件依次写入同一个输出
+		if req.Sink != nil {
+			return &simSession{alloc: newSimAlloc(), b: b, req: req, out: newPlainOutput(req.Sink)}, nil
+		}
+		f, err := os.Create(req.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &simSession{alloc: newSimAlloc(), b: b, req: req, out: f}, nil
+	case ModeSecureDispatch:
+		return &simSession{alloc: newSimAlloc(), b: b, req: req}, nil
+	}
+	return nil, fmt.Errorf("unsupported decrypt session mode %d", req.Mode)
+}
+
+// ==================================================================================
+//				AES Encrypt
+// ==================================================================================
+
+// simAESEncrypt 用 AES-CBC 和 PKCS#7 填充加密，返回密文长度，ct 不够大时返回 -1
+func simAESEncrypt(pt []byte, ptLen int, ct []byte) int {
+	ctLen := (ptLen/aes.BlockSize + 1) * aes.BlockSize
+	if ptLen < 0 || ptLen > len(pt) || ctLen > len(ct) {
+		return -1
+	}
+	block, err := aes.NewCipher(simKey)
+	if err != nil {
+		return -1
+	}
+
+	buf := make([]byte, ctLen)
+	copy(buf, pt[:ptLen])
+	pad := byte(ctLen - ptLen)
+	for i := ptLen; i < ctLen; i++ {
+		buf[i] = pad
+	}
+	cipher.NewCBCEncrypter(block, simIV).CryptBlocks(ct[:ctLen], buf)
+	return ctLen
+}
+
+// simAESDecrypt 解密 simAESEncrypt 的输出，返回明文长度，pt 短于 ctLen、密文或填充无效时返回 -1
+func simAESDecrypt(ct []byte, ctLen int, pt []byte) int {
+	// 与 C 的 decrypt 相同，去掉填充之前整个密文长度都写入 pt
+	if ctLen <= 0 || ctLen > len(ct) || ctLen%aes.BlockSize != 0 || ctLen > len(pt) {
+		return -1
+	}
+	block, err := aes.NewCipher(simKey)
+	if err != nil {
+		return -1
+	}
+
+	buf := make([]byte, ctLen)
+	cipher.NewCBCDecrypter(block, simIV).CryptBlocks(buf, ct[:ctLen])
+	pad := int(buf[ctLen-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return -1
+	}
+	for _, b := range buf[ctLen-pad:] {
+		if int(b) != pad {
+			return -1
+		}
+	}
+	ptLen := ctLen - pad
+	copy(pt, buf[:ptLen])
+	return ptLen
+}
+
+// ==================================================================================
+//				Multi-process Keystone Decrypt
+// ==================================================================================
+
+func simDispathSetLength(size uint64) {
+	atomic.StoreUint64(&simDispathLength, size)
+}
+
+func simDispathGetLength() uint64 {
+	return atomic.LoadUint64(&simDispathLength)
+}
+
+// 获取递增的engine_id函数
+func simGetDispathEngineSeq() uint64 {
+	return atomic.AddUint64(&simEngineSeq, 1)
+}
+
+// ==================================================================================
+//				Simulated RingBuffer streams
+// ==================================================================================
+
+// simRingEncryptStream 模拟 ipfs_keystone：goroutine 读文件、加密后写入 RingBuffer
+type simRingEncryptStream struct {
+	alloc *simAlloc
+	rb    *ringBuffer
+	in    *plainInput   // 从 Request.Source 读明文时的输入缓冲区
+	done  chan struct{} // enclave goroutine 结束
+}
+
+func openSimRingEncrypt(req Request) (*simRingEncryptStream, error) {
+	var f io.ReadCloser
+	var in *plainInput
+	if req.Source != nil {
+		in = newPlainInput(req.Source, req.Size)
+		f = in
+	} else {
+		var err error
+		if f, err = os.Open(req.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &simRingEncryptStream{
+		alloc: newSimAlloc(),
+		rb:    newRingBuffer(simRingSize),
+		in:    in,
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		defer f.Close()
+
+		buf := make([]byte, simBlockSize)
+		for index := int64(0); ; index++ {
+			n, err := io.ReadFull(f, buf)
+			if n > 0 {
+				simCryptBlock(req.IsAES, index, buf[:n])
+				if _, werr := s.rb.write(buf[:n]); werr != nil {
+					return // 读端已经关闭
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				s.rb.stop()
+				return
+			}
+			if err != nil {
+				s.rb.fail(fmt.Errorf("%w: %w", ErrEnclaveAborted, err))
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *simRingEncryptStream) ReadBlock(p []byte) (int, error) {
+	return s.rb.read(p)
+}
+
+func (s *simRingEncryptStream) WriteBlock(p []byte) (int, error) {
+	return 0, errors.New("encrypt stream is read only")
+}
+
+func (s *simRingEncryptStream) WaitReady() error { return nil }
+
+func (s *simRingEncryptStream) WaitDone() error { return nil }
+
+func (s *simRingEncryptStream) Abort() error {
+	s.rb.fail(ErrBufferStopped)
+	s.stopInput()
+	return nil
+}
+
+// Close 与 cgo 后端一致：停止缓冲区，等 enclave goroutine 返回之后才返回
+func (s *simRingEncryptStream) Close() error {
+	s.rb.stop()
+	s.stopInput()
+	<-s.done
+	s.alloc.release()
+	return nil
+}
+
+// stopInput 让等待 io.Reader 的 enclave goroutine 返回
+func (s *simRingEncryptStream) stopInput() {
+	if s.in != nil {
+		s.in.Close()
+	}
+}
+
+// simRingDecryptStream 模拟 ipfs_keystone_de：Go 写入 RingBuffer，goroutine 解密后写到 sink
+type simRingDecryptStream struct {
+	alloc  *simAlloc
+	rb     *ringBuffer
+	done   chan struct{} // enclave goroutine 结束
+	err    error         // done 关闭后可读
+	closer io.Closer     // 解密结束后关闭 sink，可以为 nil
+}
+
+// first 是写入的第一个块的序号，模拟的 CTR 计数器从这一块开始
+func openSimRingDecrypt(isAES int, first int64, sink io.Writer, closer io.Closer) *simRingDecryptStream {
+	s := &simRingDecryptStream{
+		alloc:  newSimAlloc(),
+		rb:     newRingBuffer(simRingSize),
+		done:   make(chan struct{}),
+		closer: closer,
+	}
+
+	go func() {
+		defer close(s.done)
+
+		buf := make([]byte, simBlockSize)
+		for index := first; ; index++ {
+			n, err := io.ReadFull(readFunc(s.rb.read), buf)
+			if n > 0 {
+				simCryptBlock(isAES, index, buf[:n])
+				if _, werr := sink.Write(buf[:n]); werr != nil {
+					s.err = werr
+					s.rb.fail(werr)
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
+			if err != nil {
+				s.err = err
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *simRingDecryptStream) ReadBlock(p []byte) (int, error) {
+	return 0, errors.New("decrypt stream is write only")
+}
+
+func (s *simRingDecryptStream) WriteBlock(p []byte) (int, error) {
+	return s.rb.write(p)
+}
+
+func (s *simRingDecryptStream) WaitReady() error { return nil }
+
+func (s *simRingDecryptStream) WaitDone() error {
+	s.rb.stop()
+	<-s.done
+	if s.closer != nil {
+		if err := s.closer.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+		s.closer = nil
+	}
+	return s.err
+}
+
+func (s *simRingDecryptStream) Abort() error {
+	s.rb.fail(ErrBufferStopped)
+	return nil
+}
+
+// Close 停止缓冲区，等 enclave goroutine 返回。没有调用 WaitDone 时 sink 也在这里关闭
+func (s *simRingDecryptStream) Close() error {
+	s.rb.stop()
+	<-s.done
+	if s.closer != nil {
+		s.closer.Close()
+		s.closer = nil
+	}
+	s.alloc.release()
+	return nil
+}
+
+// ==================================================================================
+//				Simulated multi-worker streams
+// ==================================================================================
+
+// simFramesEncryptStream 模拟交叉读取：workers 个 goroutine 按块序号轮流加密
+type simFramesEncryptStream struct {
+	alloc  *simAlloc
+	frames *blockFrames
+	in     *plainInput // 从 Request.Source 读明文时的输入缓冲区
+	wg     sync.WaitGroup
+}
+
+func openSimFramesEncrypt(req Request, workers int) (*simFramesEncryptStream, error) {
+	if req.Source != nil {
+		return openSimFramesEncryptSource(req, workers)
+	}
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := fi.Size()
+	n := int((size + simBlockSize - 1) / simBlockSize)
+
+	s := &simFramesEncryptStream{alloc: newSimAlloc(), frames: newBlockFrames(n)}
+
+	for w := 0; w < workers; w++ {
+		s.wg.Add(1)
+		go func(w int) {
+			defer s.wg.Done()
+			for i := w; i < n; i += workers {
+				off := int64(i) * simBlockSize
+				blen := size - off
+				if blen > simBlockSize {
+					blen = simBlockSize
+				}
+				b := make([]byte, blen)
+				if _, err := f.ReadAt(b, off); err != nil {
+					s.frames.fail(fmt.Errorf("%w: %w", ErrEnclaveAborted, err))
+					return
+				}
+				simCryptBlock(req.IsAES, int64(i), b)
+				if !s.frames.put(i, b) {
+					return // 读端已经关闭
+				}
+			}
+		}(w)
+	}
+
+	go func() {
+		s.wg.Wait()
+		f.Close()
+	}()
+
+	return s, nil
+}
+
+// openSimFramesEncryptSource 从 Request.Source 读取 req.Size 字节，按块序号轮流交给
+// workers 个 goroutine 加密。子进程不能随机读取 io.Reader，块由这里顺序分发
+func openSimFramesEncryptSource(req Request, workers int) (*simFramesEncryptStream, error) {
+	if req.Size <= 0 {
+		return nil, fmt.Errorf("%w: encrypting an io.Reader with several enclaves needs its size", ErrInvalidOptions)
+	}
+	n := int((req.Size + simBlockSize - 1) / simBlockSize)
+
+	s := &simFramesEncryptStream{
+		alloc:  newSimAlloc(),
+		frames: newBlockFrames(n),
+		in:     newPlainInput(req.Source, req.Size),
+	}
+
+	chs := make([]chan simBlock, workers)
+	for w := range chs {
+		ch := make(chan simBlock, 1)
+		chs[w] = ch
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			// 读端停止之后继续取走通道中的块，分发的 goroutine 不会阻塞
+			for b := range ch {
+				simCryptBlock(req.IsAES, int64(b.index), b.data)
+				s.frames.put(b.index, b.data)
+			}
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			for _, ch := range chs {
+				close(ch)
+			}
+		}()
+		for i := 0; i < n; i++ {
+			blen := req.Size - int64(i)*simBlockSize
+			if blen > simBlockSize {
+				blen = simBlockSize
+			}
+			b := make([]byte, blen)
+			// 长度不够时 plainInput 返回 ErrSourceLength
+			if _, err := io.ReadFull(s.in, b); err != nil {
+				s.frames.fail(fmt.Errorf("%w: %w", ErrEnclaveAborted, err))
+				return
+			}
+			// io.Reader 比 size 长时 plainInput 同样返回 ErrSourceLength，
+			// 在交出最后一块之前检查，读端不会把截断的输出当作正常结束
+			if i == n-1 {
+				if _, err := s.in.Read(make([]byte, 1)); err != io.EOF {
+					s.frames.fail(fmt.Errorf("%w: %w", ErrEnclaveAborted, err))
+					return
+				}
+			}
+			chs[i%workers] <- simBlock{index: i, data: b}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *simFramesEncryptStream) ReadBlock(p []byte) (int, error) {
+	return s.frames.read(p)
+}
+
+// NextBlock 直接交出 worker 加密好的块
+func (s *simFramesEncryptStream) NextBlock() ([]byte, error) {
+	return s.frames.take()
+}
+
+func (s *simFramesEncryptStream) WriteBlock(p []byte) (int, error) {
+	return 0, errors.New("encrypt stream is read only")
+}
+
+func (s *simFramesEncryptStream) WaitReady() error { return nil }
+
+func (s *simFramesEncryptStream) WaitDone() error { return nil }
+
+func (s *simFramesEncryptStream) Abort() error {
+	s.frames.stop()
+	if s.in != nil {
+		s.in.Close()
+	}
+	return nil
+}
+
+func (s *simFramesEncryptStream) Close() error {
+	s.frames.stop()
+	if s.in != nil {
+		s.in.Close()
+	}
+	s.wg.Wait()
+	s.alloc.release()
+	return nil
+}
+
+type simBlock struct {
+	index int
+	data  []byte
+}
+
+// simDispatchStream 模拟调度器：写入的数据按 256 KiB 分块轮流发给 workers 个 goroutine 解密，
+// 解密后的块按顺序写到 sink
+type simDispatchStream struct {
+	alloc   *simAlloc
+	isAES   int
+	size    int64
+	workers []chan simBlock
+	frames  *blockFrames
+	cur     []byte // 正在填充的块
+	index   int    // cur 的块序号
+	written int64
+	closed  bool // workers 的通道已经关闭
+	wg      sync.WaitGroup
+	done    chan struct{} // 收集 goroutine 结束
+	err     error         // done 关闭后可读
+}
+
+func openSimDispatch(isAES int, size int64, workers int, sink io.Writer) *simDispatchStream {
+	n := int((size + simBlockSize - 1) / simBlockSize)
+
+	s := &simDispatchStream{
+		alloc:   newSimAlloc(),
+		isAES:   isAES,
+		size:    size,
+		workers: make([]chan simBlock, workers),
+		frames:  newBlockFrames(n),
+		done:    make(chan struct{}),
+	}
+	s.cur = make([]byte, 0, s.blockLen(0))
+
+	for w := range s.workers {
+		ch := make(chan simBlock, 1)
+		s.workers[w] = ch
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for b := range ch {
+				simCryptBlock(isAES, int64(b.index), b.data)
+				s.frames.put(b.index, b.data)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(s.done)
+		if _, err := io.Copy(sink, readFunc(s.frames.read)); err != nil {
+			s.err = err
+			s.frames.stop()
+		}
+	}()
+
+	return s
+}
+
+// blockLen 返回第 i 块的长度，最后一块可能不足 256 KiB
+func (s *simDispatchStream) blockLen(i int) int64 {
+	l := s.size - int64(i)*simBlockSize
+	if l > simBlockSize {
+		l = simBlockSize
+	}
+	if l < 0 {
+		l = 0
+	}
+	return l
+}
+
+func (s *simDispatchStream) ReadBlock(p []byte) (int, error) {
+	return 0, errors.New("dispatch stream is write only")
+}
+
+func (s *simDispatchStream) WriteBlock(p []byte) (int, error) {
+	if err := s.stopped(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		if s.closed || s.written >= s.size {
+			return n, fmt.Errorf("write beyond file length %d", s.size)
+		}
+		c := int(s.blockLen(s.index)) - len(s.cur)
+		if c > len(p)-n {
+			c = len(p) - n
+		}
+		s.cur = append(s.cur, p[n:n+c]...)
+		n += c
+		s.written += int64(c)
+		s.sendFull()
+	}
+	return n, nil
+}
+
+// NextSlot 返回正在填充的块中还没有填充的部分，调用方直接读入，省去 WriteBlock 的复制。
+// 最后一块交出之后收集 goroutine 可能已经结束，这时不再需要输入而不是缓冲区已停止
+func (s *simDispatchStream) NextSlot() ([]byte, error) {
+	if s.closed || s.written >= s.size {
+		return nil, nil
+	}
+	if err := s.stopped(); err != nil {
+		return nil, err
+	}
+	return s.cur[len(s.cur):s.blockLen(s.index)], nil
+}
+
+func (s *simDispatchStream) CommitSlot(n int) error {
+	if n < 0 || len(s.cur)+n > int(s.blockLen(s.index)) {
+		return fmt.Errorf("commit %d bytes beyond block %d", n, s.index)
+	}
+	s.cur = s.cur[:len(s.cur)+n]
+	s.written += int64(n)
+	s.sendFull()
+	return nil
+}
+
+// stopped 在收集 goroutine 已经结束时返回不能继续写入的原因
+func (s *simDispatchStream) stopped() error {
+	select {
+	case <-s.done:
+		if s.err != nil {
+			return s.err
+		}
+		return ErrBufferStopped
+	default:
+	}
+	return nil
+}
+
+// sendFull 在当前块填满时交给对应的 worker，开始填充下一块
+func (s *simDispatchStream) sendFull() {
+	if len(s.cur) > 0 && int64(len(s.cur)) == s.blockLen(s.index) {
+		s.workers[s.index%len(s.workers)] <- simBlock{index: s.index, data: s.cur}
+		s.index++
+		s.cur = make([]byte, 0, s.blockLen(s.index))
+	}
+}
+
+func (s *simDispatchStream) WaitReady() error { return nil }
+
+func (s *simDispatchStream) WaitDone() error {
+	s.closeWorkers()
+	if err := shortWrite(s.written, s.size); err != nil {
+		s.frames.fail(err)
+	}
+	<-s.done
+	return s.err
+}
+
+func (s *simDispatchStream) closeWorkers() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, ch := range s.workers {
+		close(ch)
+	}
+	s.wg.Wait()
+}
+
+// Abort 停止收集解密后的块，workers 继续取走通道中的块，阻塞的 WriteBlock 可以返回
+func (s *simDispatchStream) Abort() error {
+	s.frames.stop()
+	return nil
+}
+
+func (s *simDispatchStream) Close() error {
+	s.frames.stop()
+	s.closeWorkers()
+	<-s.done
+	s.alloc.release()
+	return nil
+}
+
+// ==================================================================================
+//				Simulated the new dir sessions
+// ==================================================================================
+
+// simSession 模拟只启动一次的 enclave，每个文件单独创建数据流
+type simSession struct {
+	alloc *simAlloc
+	b     SimBackend
+	req   Request
+	out   io.WriteCloser // 单 enclave 解密会话的输出文件或 plainOutput
+}
+
+func (ss *simSession) WaitReady() error { return nil }
+
+func (ss *simSession) NextEncrypt(path string, size int64) (Stream, error) {
+	req := ss.req
+	req.Path = path
+	req.Size = size
+	return ss.b.OpenEncrypt(req)
+}
+
+func (ss *simSession) NextDecrypt(size uint64) (Stream, error) {
+	if ss.req.Mode == ModeSingle {
+		return openSimRingDecrypt(ss.req.IsAES, 0, ss.out, nil), nil
+	}
+	return openSimDispatch(ss.req.IsAES, int64(size), simFixFlexibleNum(ss.req.Flexible), ss.b.dispatchSink()), nil
+}
+
+// 会话没有自己的 goroutine，每个文件的数据流单独中止，这里只关闭输出
+func (ss *simSession) Abort() error {
+	ss.alloc.release()
+	if ss.out != nil {
+		ss.out.Close()
+	}
+	return nil
+}
+
+func (ss *simSession) End() error {
+	ss.alloc.release()
+	if ss.out != nil {
+		return ss.out.Close()
+	}
+	return nil
+}
@@ -0,0 +1,884 @@
+//go:build !keystone
+
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// 测试使用模拟后端，不需要 Keystone 工具链
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+// writeTemp 把 n 字节随机数据写到临时文件，返回路径和数据
+func writeTemp(t *testing.T, n int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// aeadEncrypt 用 testKey 加密 n 字节随机数据，返回明文和密文
+func aeadEncrypt(t *testing.T, n int) ([]byte, []byte) {
+	t.Helper()
+	path, data := writeTemp(t, n)
+	r, err := NewEncryptReader(path, WithCipher(CipherAESGCM), WithKey(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ct, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, ct
+}
+
+// writeAll 把 p 写进 w 再关闭，返回第一个错误
+func writeAll(w io.WriteCloser, p []byte) error {
+	_, err := w.Write(p)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func TestDispatchCloseReportsLastFrame(t *testing.T) {
+	_, ct := aeadEncrypt(t, 3*DefaultBlockSize+77)
+	bad := append([]byte(nil), ct...)
+	bad[len(bad)-1] ^= 1
+
+	open := map[string]func(size int64) (io.WriteCloser, error){
+		"dispatch": func(size int64) (io.WriteCloser, error) {
+			return NewMultiProcessTEEDispatch(uint64(size), WithCipher(CipherAESGCM), WithKey(testKey), WithWorkers(3))
+		},
+		"open-decrypt": func(size int64) (io.WriteCloser, error) {
+			return OpenDecrypt(WithCipher(CipherAESGCM), WithKey(testKey), WithSize(size), WithWorkers(3))
+		},
+	}
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			w, err := open(int64(len(ct)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writeAll(w, ct); err != nil {
+				t.Fatalf("intact ciphertext: %v", err)
+			}
+
+			w, err = open(int64(len(bad)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ie *IntegrityError
+			if err := writeAll(w, bad); !errors.As(err, &ie) || ie.Block != 3 {
+				t.Fatalf("tampered last frame: %v", err)
+			}
+		})
+	}
+}
+
+func TestDirSecureDispatchCloseReportsLastFrame(t *testing.T) {
+	_, ct := aeadEncrypt(t, DefaultBlockSize+5)
+	bad := append([]byte(nil), ct...)
+	bad[len(bad)-1] ^= 1
+
+	jc, err := NewTheNewDirMultiProcessTEESecureDispatchJustCall(WithCipher(CipherAESGCM), WithKey(testKey), WithWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer TheNewDirSecureDispathSetLength(jc, 0)
+	TheNewDirSecureDispathSetLength(jc, uint64(len(bad)))
+	w, err := TheNewDirSecureDispathWaitTransferKeystoneReady(jc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(w, bad); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("tampered last frame: %v", err)
+	}
+}
+
+func TestDispatchCloseReportsShortInput(t *testing.T) {
+	open := map[string]func() (io.WriteCloser, error){
+		"dispatch": func() (io.WriteCloser, error) {
+			return NewMultiProcessTEEDispatch(1<<20, WithCipher(CipherAES), WithWorkers(2))
+		},
+		"secure-dispatch": func() (io.WriteCloser, error) {
+			return NewMultiProcessTEESecureDispatch(1<<20, WithCipher(CipherAES), WithWorkers(2))
+		},
+	}
+	for name, open := range open {
+		t.Run(name, func(t *testing.T) {
+			w, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writeAll(w, make([]byte, 10)); !errors.Is(err, ErrEnclaveAborted) {
+				t.Fatalf("10 of %d bytes: %v", 1<<20, err)
+			}
+		})
+	}
+}
+
+// failNextBackend 的会话在 NextEncrypt 和 NextDecrypt 时返回 err
+type failNextBackend struct {
+	SimBackend
+	err error
+}
+
+func (b failNextBackend) OpenEncryptSession(req Request) (Session, error) {
+	ss, err := b.SimBackend.OpenEncryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+	return failNextSession{ss, b.err}, nil
+}
+
+func (b failNextBackend) OpenDecryptSession(req Request) (Session, error) {
+	ss, err := b.SimBackend.OpenDecryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+	return failNextSession{ss, b.err}, nil
+}
+
+type failNextSession struct {
+	Session
+	err error
+}
+
+func (ss failNextSession) NextEncrypt(string, int64) (Stream, error) { return nil, ss.err }
+func (ss failNextSession) NextDecrypt(uint64) (Stream, error)        { return nil, ss.err }
+
+func TestDirSetFileReportsNextEncrypt(t *testing.T) {
+	path, data := writeTemp(t, 1000)
+	b := failNextBackend{err: ErrShmCreate}
+
+	add, err := NewTheNewDirTEEFileReaderJustCallADD(WithCipher(CipherAES), WithBackend(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := add.The_New_Dir_Keystone_Set_fileAbsPath(path, int64(len(data))); r != nil || !errors.Is(err, ErrShmCreate) {
+		t.Fatalf("add: %v, %v", r, err)
+	}
+	if r, err := add.The_New_Dir_Keystone_Set_fileAbsPath("", 0); r != nil || err != nil {
+		t.Fatalf("add end: %v, %v", r, err)
+	}
+
+	fl, err := NewTheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall(WithCipher(CipherAES), WithWorkers(3), WithBackend(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := fl.The_New_Dir_MultiProcess_cross_Flexible_Set_fileAbsPath(path, int64(len(data))); r != nil || !errors.Is(err, ErrShmCreate) {
+		t.Fatalf("flexible: %v, %v", r, err)
+	}
+	if r, err := fl.The_New_Dir_MultiProcess_cross_Flexible_Set_fileAbsPath("", 0); r != nil || err != nil {
+		t.Fatalf("flexible end: %v, %v", r, err)
+	}
+}
+
+// failReadySession 的解密数据流在 WaitReady 时返回 err，closed 记录数据流是否被关闭
+type failReadySession struct {
+	Session
+	err    error
+	closed *bool
+}
+
+func (ss failReadySession) NextDecrypt(size uint64) (Stream, error) {
+	s, err := ss.Session.NextDecrypt(size)
+	if err != nil {
+		return nil, err
+	}
+	return failReadyStream{s, ss.err, ss.closed}, nil
+}
+
+type failReadyStream struct {
+	Stream
+	err    error
+	closed *bool
+}
+
+func (s failReadyStream) WaitReady() error { return s.err }
+
+func (s failReadyStream) Close() error {
+	*s.closed = true
+	return s.Stream.Close()
+}
+
+func TestDirSetLengthReportsNextDecrypt(t *testing.T) {
+	b := failNextBackend{err: ErrShmCreate}
+
+	de, err := NewTheNewDirTEEFileReaderJustCall(filepath.Join(t.TempDir(), "out"), WithCipher(CipherAES), WithBackend(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TheNewDirKeystoneDecryptSetLength(de, 1000); !errors.Is(err, ErrShmCreate) {
+		t.Fatalf("set length: %v", err)
+	}
+	if w, err := TheNewDirWaitKeystoneFileReady(de); w != nil || !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("wait ready after failed set length: %v, %v", w, err)
+	}
+	if err := TheNewDirKeystoneDecryptSetLength(de, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sd, err := NewTheNewDirMultiProcessTEESecureDispatchJustCall(WithCipher(CipherAES), WithWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TheNewDirSecureDispathSetLength(sd, 1000); err != nil {
+		t.Fatal(err)
+	}
+	w, err := TheNewDirSecureDispathWaitTransferKeystoneReady(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(w, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := TheNewDirSecureDispathWaitTransferKeystoneReady(sd); w != nil || !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("second wait ready: %v, %v", w, err)
+	}
+
+	// enclave 启动失败时返回错误并关闭数据流
+	ss := sd.ss
+	var closed bool
+	sd.ss = failReadySession{ss, ErrEnclaveAborted, &closed}
+	if err := TheNewDirSecureDispathSetLength(sd, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := TheNewDirSecureDispathWaitTransferKeystoneReady(sd); w != nil || !errors.Is(err, ErrEnclaveAborted) || !closed {
+		t.Fatalf("failed startup: %v, %v, closed %v", w, err, closed)
+	}
+
+	// 会话换成总是失败的后端，上一个文件的读写器不能留下
+	sd.ss = failNextSession{ss, ErrShmCreate}
+	if err := TheNewDirSecureDispathSetLength(sd, 1000); !errors.Is(err, ErrShmCreate) {
+		t.Fatalf("set length: %v", err)
+	}
+	if w, err := TheNewDirSecureDispathWaitTransferKeystoneReady(sd); w != nil || !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("wait ready after failed set length: %v, %v", w, err)
+	}
+	if err := TheNewDirSecureDispathSetLength(sd, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseDuringBlockedRead(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithCipher(CipherAES)},
+		{WithCipher(CipherAESGCM), WithKey(testKey)},
+	} {
+		// 数据源不返回数据，Read 一直阻塞在 RingBuffer 中
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		r, err := EncryptStream(pr, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := r.Read(make([]byte, 4096))
+			readErr <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		closed := make(chan error, 1)
+		go func() { closed <- r.Close() }()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close blocked behind Read")
+		}
+		if err := <-readErr; err == nil {
+			t.Fatal("Read returned no error after Close")
+		}
+		if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrBufferStopped) {
+			t.Fatalf("Read after Close: %v", err)
+		}
+	}
+}
+
+// waitNoCAllocs 等待 OutstandingCAllocs 回到 0。中止过的数据流在被取消的调用返回之后在后台释放
+func waitNoCAllocs(t *testing.T, what string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for OutstandingCAllocs() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %d C allocations outstanding", what, OutstandingCAllocs())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// stallReadyBackend 的会话在 release 关闭之前不会就绪
+type stallReadyBackend struct {
+	SimBackend
+	release chan struct{}
+}
+
+func (b stallReadyBackend) OpenEncryptSession(req Request) (Session, error) {
+	ss, err := b.SimBackend.OpenEncryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+	return stallReadySession{ss, b.release}, nil
+}
+
+type stallReadySession struct {
+	Session
+	release chan struct{}
+}
+
+func (ss stallReadySession) WaitReady() error {
+	<-ss.release
+	return ss.Session.WaitReady()
+}
+
+func TestNoCAllocsLeaked(t *testing.T) {
+	waitNoCAllocs(t, "before")
+	path, data := writeTemp(t, 3*DefaultBlockSize+11)
+
+	// 读完再关闭
+	r, err := NewEncryptReader(path, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	var pt bytes.Buffer
+	w, err := NewDecryptWriterTo(&pt, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(w, ct); err != nil || !bytes.Equal(pt.Bytes(), data) {
+		t.Fatal(err)
+	}
+	waitNoCAllocs(t, "read and write to the end")
+
+	// 没有读完就关闭
+	r, err = NewEncryptReader(path, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Read(make([]byte, 10))
+	r.Close()
+	cr, err := NewMultiProcessCrossTEEFileReader(path, int64(len(data)), WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.Close()
+	mr, err := NewMultiThreadedTEEFileReader(path, int64(len(data)), WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Read(make([]byte, 10))
+	mr.Close()
+	d, err := NewMultiProcessTEEDispatch(uint64(len(ct)), WithCipher(CipherAES), WithWorkers(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(d, ct[:100])
+	waitNoCAllocs(t, "early Close")
+
+	// Read 阻塞时关闭
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	sr, err := EncryptStream(pr, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sr.Read(make([]byte, 10))
+	time.Sleep(10 * time.Millisecond)
+	sr.Close()
+	waitNoCAllocs(t, "Close during Read")
+
+	// ctx 结束时中止
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err = NewDecryptWriterToContext(ctx, io.Discard, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := w.WriteContext(ctx, ct); !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	w.Close()
+	waitNoCAllocs(t, "aborted writer")
+
+	// 会话：每个文件的数据流关闭，最后 End
+	out := filepath.Join(t.TempDir(), "out")
+	de, err := NewTheNewDirTEEFileReaderJustCall(out, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	add, err := NewTheNewDirTEEFileReaderJustCallADD(WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		ar, err := add.The_New_Dir_Keystone_Set_fileAbsPath(path, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			ar.Read(make([]byte, 10))
+			ar.Close()
+			continue
+		}
+		act, err := io.ReadAll(ar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ar.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := TheNewDirKeystoneDecryptSetLength(de, uint64(len(act))); err != nil {
+			t.Fatal(err)
+		}
+		dw, err := TheNewDirWaitKeystoneFileReady(de)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeAll(dw, act); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := add.The_New_Dir_Keystone_Set_fileAbsPath("", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := TheNewDirKeystoneDecryptSetLength(de, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitNoCAllocs(t, "sessions")
+
+	// 会话在就绪之前 ctx 超时，被 Abort
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = NewTheNewDirTEEFileReaderJustCallADDContext(ctx, WithCipher(CipherAES), WithBackend(stallReadyBackend{release: release}))
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal(err)
+	}
+	waitNoCAllocs(t, "aborted session")
+}
+
+// pt 必须能放下整个密文，与 C 的 decrypt 相同，即使明文更短
+func TestAESDecryptNeedsCiphertextLength(t *testing.T) {
+	pt := make([]byte, 20)
+	rand.Read(pt)
+	ct := make([]byte, 32)
+	if n := Rv_AES_Encrypt(pt, len(pt), ct); n != len(ct) {
+		t.Fatalf("encrypt returned %d", n)
+	}
+
+	if n := Rv_AES_Decrypt(ct, len(ct), make([]byte, len(pt))); n != -1 {
+		t.Fatalf("decrypt into %d bytes returned %d", len(pt), n)
+	}
+	out := make([]byte, len(ct))
+	if n := Rv_AES_Decrypt(ct, len(ct), out); n != len(pt) || !bytes.Equal(out[:n], pt) {
+		t.Fatalf("decrypt into %d bytes returned %d", len(out), n)
+	}
+}
+
+// closeErrBackend 的加密数据流在 Close 时返回 err
+type closeErrBackend struct {
+	SimBackend
+	err error
+}
+
+func (b closeErrBackend) OpenEncrypt(req Request) (Stream, error) {
+	s, err := b.SimBackend.OpenEncrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	return closeErrStream{s, b.err}, nil
+}
+
+type closeErrStream struct {
+	Stream
+	err error
+}
+
+func (s closeErrStream) Close() error {
+	s.Stream.Close()
+	return s.err
+}
+
+func TestReaderCloseReportsStreamError(t *testing.T) {
+	const n = 3 * DefaultBlockSize
+	path, _ := writeTemp(t, n)
+	opts := []Option{WithCipher(CipherAES), WithBackend(closeErrBackend{err: ErrEnclaveAborted})}
+
+	for name, open := range map[string]func() (io.ReadCloser, error){
+		"single":         func() (io.ReadCloser, error) { return NewTEEFileReader(path, opts...) },
+		"multi-threaded": func() (io.ReadCloser, error) { return NewMultiThreadedTEEFileReader(path, n, opts...) },
+		"multi-process":  func() (io.ReadCloser, error) { return NewMultiProcessTEEFileReader(path, n, opts...) },
+		"cross":          func() (io.ReadCloser, error) { return NewMultiProcessCrossTEEFileReader(path, n, opts...) },
+		"flexible":       func() (io.ReadCloser, error) { return NewMultiProcessCrossTEEFileFlexibleReader(path, n, opts...) },
+	} {
+		r, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := io.ReadAll(r); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := r.Close(); !errors.Is(err, ErrEnclaveAborted) {
+			t.Fatalf("%s: Close: %v", name, err)
+		}
+		// 第二次 Close 不再报告
+		if err := r.Close(); err != nil {
+			t.Fatalf("%s: second Close: %v", name, err)
+		}
+	}
+}
+
+// copyOnlyBackend 的数据流不实现 blockReader 和 blockWriter，WriteTo 和 ReadFrom 走整块复制，
+// 与 cgo 后端的数据流相同
+type copyOnlyBackend struct {
+	SimBackend
+}
+
+func (b copyOnlyBackend) OpenEncrypt(req Request) (Stream, error) {
+	s, err := b.SimBackend.OpenEncrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Stream }{s}, nil
+}
+
+func (b copyOnlyBackend) OpenDecrypt(req Request) (Stream, error) {
+	s, err := b.SimBackend.OpenDecrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Stream }{s}, nil
+}
+
+// shortWriter 每次只写入一半
+type shortWriter struct{ bytes.Buffer }
+
+func (w *shortWriter) Write(p []byte) (int, error) { return w.Buffer.Write(p[:len(p)/2]) }
+
+func TestFlexibleWriteTo(t *testing.T) {
+	const n = 4*DefaultBlockSize + 99
+	path, _ := writeTemp(t, n)
+	r, err := NewEncryptReader(path, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string]Backend{"blocks": SimBackend{}, "copy": copyOnlyBackend{}} {
+		t.Run(name, func(t *testing.T) {
+			open := func() *MultiProcessCrossTEEFileFlexibleReader {
+				r, err := NewMultiProcessCrossTEEFileFlexibleReader(path, n, WithCipher(CipherAES), WithWorkers(3), WithBackend(b))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return r
+			}
+
+			// 先用 Read 读出一部分，WriteTo 从块的中间继续
+			r := open()
+			head := make([]byte, 1000)
+			if _, err := io.ReadFull(r, head); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			m, err := io.Copy(&out, r)
+			if err != nil || m != int64(len(want)-len(head)) {
+				t.Fatalf("io.Copy = %d, %v", m, err)
+			}
+			if !bytes.Equal(append(head, out.Bytes()...), want) {
+				t.Fatal("WriteTo output differs from ReadAll")
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.WriteTo(io.Discard); err != ErrBufferStopped {
+				t.Fatalf("WriteTo after Close: %v", err)
+			}
+
+			r = open()
+			defer r.Close()
+			var sw shortWriter
+			if m, err := r.WriteTo(&sw); err != io.ErrShortWrite || m != int64(sw.Len()) {
+				t.Fatalf("short writer: %d, %v", m, err)
+			}
+		})
+	}
+}
+
+func TestDispatchReadFrom(t *testing.T) {
+	path, data := writeTemp(t, 3*DefaultBlockSize+5)
+	r, err := NewEncryptReader(path, WithCipher(CipherAES))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string]func(io.Writer) Backend{
+		"blocks": func(w io.Writer) Backend { return SimBackend{DispatchSink: func() io.Writer { return w }} },
+		"copy": func(w io.Writer) Backend {
+			return copyOnlyBackend{SimBackend{DispatchSink: func() io.Writer { return w }}}
+		},
+	} {
+		open := map[string]func(size int, b Backend) (io.WriteCloser, error){
+			"dispatch": func(size int, b Backend) (io.WriteCloser, error) {
+				return NewMultiProcessTEEDispatch(uint64(size), WithCipher(CipherAES), WithWorkers(3), WithBackend(b))
+			},
+			"secure-dispatch": func(size int, b Backend) (io.WriteCloser, error) {
+				return NewMultiProcessTEESecureDispatch(uint64(size), WithCipher(CipherAES), WithWorkers(3), WithBackend(b))
+			},
+		}
+		for mode, open := range open {
+			t.Run(name+"/"+mode, func(t *testing.T) {
+				var pt bytes.Buffer
+				w, err := open(len(ct), b(&pt))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// 先用 Write 写入一部分，ReadFrom 从块的中间继续；HalfReader 让读取不按块对齐
+				if _, err := w.Write(ct[:5]); err != nil {
+					t.Fatal(err)
+				}
+				m, err := w.(io.ReaderFrom).ReadFrom(iotest.HalfReader(bytes.NewReader(ct[5:])))
+				if err != nil || m != int64(len(ct)-5) {
+					t.Fatalf("ReadFrom = %d, %v", m, err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(pt.Bytes(), data) {
+					t.Fatal("plaintext differs")
+				}
+				if _, err := w.(io.ReaderFrom).ReadFrom(bytes.NewReader(ct)); err != ErrBufferStopped {
+					t.Fatalf("ReadFrom after Close: %v", err)
+				}
+
+				// 输入不够时 ReadFrom 在 io.EOF 返回，Close 报告缺少的数据
+				w, err = open(len(ct), b(io.Discard))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m, err := w.(io.ReaderFrom).ReadFrom(bytes.NewReader(ct[:100])); err != nil || m != 100 {
+					t.Fatalf("short reader: %d, %v", m, err)
+				}
+				if err := w.Close(); !errors.Is(err, ErrEnclaveAborted) {
+					t.Fatalf("Close after short input: %v", err)
+				}
+
+				// 读取错误原样返回
+				w, err = open(len(ct), b(io.Discard))
+				if err != nil {
+					t.Fatal(err)
+				}
+				errRead := errors.New("read failed")
+				if _, err := w.(io.ReaderFrom).ReadFrom(io.MultiReader(bytes.NewReader(ct[:10]), iotest.ErrReader(errRead))); err != errRead {
+					t.Fatalf("failing reader: %v", err)
+				}
+				w.Close()
+
+				// 输入超过 fileSize 时报错
+				w, err = open(10, b(io.Discard))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.(io.ReaderFrom).ReadFrom(bytes.NewReader(make([]byte, 20))); err == nil {
+					t.Fatal("ReadFrom accepted more than fileSize bytes")
+				}
+				w.Close()
+			})
+		}
+	}
+}
+
+// countingBackend 记录 OpenDecrypt 的次数和一次交给 enclave 的最大密文长度
+type countingBackend struct {
+	SimBackend
+	runs    *int
+	maxSize *int64
+}
+
+func (b countingBackend) OpenDecrypt(req Request) (Stream, error) {
+	*b.runs++
+	*b.maxSize = max(*b.maxSize, req.Size)
+	return b.SimBackend.OpenDecrypt(req)
+}
+
+func TestDecryptReaderAt(t *testing.T) {
+	const (
+		n     = 5*DefaultBlockSize + 100
+		cache = 2
+	)
+	path, data := writeTemp(t, n)
+	ks, err := OpenLocalKeyStore(filepath.Join(t.TempDir(), "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphers := map[string]struct {
+		opts  []Option
+		frame int64 // 一块密文的长度
+	}{
+		"aes":      {[]Option{WithCipher(CipherAES)}, DefaultBlockSize},
+		"aead":     {[]Option{WithCipher(CipherAESGCM), WithKey(testKey)}, AEADFrameSize},
+		"envelope": {[]Option{WithCipher(CipherAESGCM), WithKeyManager(ks)}, AEADFrameSize},
+	}
+	// 依次在同一个 DecryptReaderAt 上执行，runs 是这一步启动的 enclave 数
+	steps := []struct {
+		name     string
+		off, len int64
+		n        int
+		err      error
+		runs     int
+	}{
+		{"inside block", 10, 100, 100, nil, 1},
+		{"cache hit", 20, 50, 50, nil, 0},
+		{"across boundary", DefaultBlockSize - 10, 20, 20, nil, 1},
+		// 6 块每次解密 2 块，第 0、1 块在缓存中
+		{"whole file", 0, n, n, nil, 2},
+		// 第 0 块已经被第 2 到 5 块挤出缓存
+		{"evicted", 0, 1, 1, nil, 1},
+		{"past EOF", n - 10, 100, 10, io.EOF, 0},
+		{"at EOF", n, 1, 0, io.EOF, 0},
+		{"empty", 3, 0, 0, nil, 0},
+	}
+
+	for name, c := range ciphers {
+		t.Run(name, func(t *testing.T) {
+			er, err := NewEncryptReader(path, c.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct, err := io.ReadAll(er)
+			er.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name == "envelope" {
+				if id, err := EnvelopeKeyID(ct); err != nil || id != ks.CurrentKeyID() {
+					t.Fatalf("envelope key ID %q, %v", id, err)
+				}
+			}
+
+			var runs int
+			var maxSize int64
+			b := countingBackend{runs: &runs, maxSize: &maxSize}
+			r, err := NewDecryptReaderAt(bytes.NewReader(ct), int64(len(ct)), append(c.opts, WithBackend(b), WithCacheBlocks(cache))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != n {
+				t.Fatalf("Size = %d, want %d", r.Size(), n)
+			}
+			for _, st := range steps {
+				before := runs
+				p := make([]byte, st.len)
+				got, err := r.ReadAt(p, st.off)
+				if got != st.n || err != st.err {
+					t.Fatalf("%s: ReadAt = %d, %v, want %d, %v", st.name, got, err, st.n, st.err)
+				}
+				if !bytes.Equal(p[:got], data[st.off:st.off+int64(got)]) {
+					t.Fatalf("%s: plaintext differs", st.name)
+				}
+				if runs-before != st.runs {
+					t.Fatalf("%s: %d enclave runs, want %d", st.name, runs-before, st.runs)
+				}
+			}
+			if limit := cache * c.frame; maxSize > limit {
+				t.Fatalf("one run decrypted %d bytes, more than %d blocks", maxSize, cache)
+			}
+
+			// Read 和 Seek 共用一个位置
+			for _, sk := range []struct {
+				off    int64
+				whence int
+				pos    int64
+				n      int
+				err    error
+			}{
+				{DefaultBlockSize - 3, io.SeekStart, DefaultBlockSize - 3, 10, nil},
+				{5, io.SeekCurrent, DefaultBlockSize + 12, 10, nil},
+				{-5, io.SeekEnd, n - 5, 5, nil},
+				{n + 10, io.SeekStart, n + 10, 0, io.EOF},
+			} {
+				pos, err := r.Seek(sk.off, sk.whence)
+				if err != nil || pos != sk.pos {
+					t.Fatalf("Seek(%d, %d) = %d, %v, want %d", sk.off, sk.whence, pos, err, sk.pos)
+				}
+				p := make([]byte, 10)
+				got, err := r.Read(p)
+				if got != sk.n || err != sk.err || !bytes.Equal(p[:got], data[min(pos, n):min(pos, n)+int64(got)]) {
+					t.Fatalf("Read at %d = %d, %v, want %d, %v", pos, got, err, sk.n, sk.err)
+				}
+			}
+			if _, err := r.Seek(-1, io.SeekStart); err == nil {
+				t.Fatal("Seek to a negative position succeeded")
+			}
+			if _, err := r.Seek(0, 42); err == nil {
+				t.Fatal("Seek with an invalid whence succeeded")
+			}
+			if _, err := r.ReadAt(make([]byte, 1), -1); err == nil {
+				t.Fatal("ReadAt at a negative offset succeeded")
+			}
+
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.ReadAt(make([]byte, 1), 0); err != ErrBufferStopped {
+				t.Fatalf("ReadAt after Close: %v", err)
+			}
+		})
+	}
+}
+
+// 篡改的帧在 ReadAt 时报告，读取其他块不受影响
+func TestDecryptReaderAtIntegrity(t *testing.T) {
+	data, ct := aeadEncrypt(t, 3*DefaultBlockSize)
+	ct[AEADFrameSize+100] ^= 1
+	r, err := NewDecryptReaderAt(bytes.NewReader(ct), int64(len(ct)), WithCipher(CipherAESGCM), WithKey(testKey), WithCacheBlocks(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var ie *IntegrityError
+	if _, err := r.ReadAt(make([]byte, 10), DefaultBlockSize+5); !errors.As(err, &ie) || ie.Block != 1 {
+		t.Fatalf("tampered block: %v", err)
+	}
+	p := make([]byte, 10)
+	if _, err := r.ReadAt(p, 2*DefaultBlockSize); err != nil || !bytes.Equal(p, data[2*DefaultBlockSize:][:10]) {
+		t.Fatalf("intact block: %v", err)
+	}
+}
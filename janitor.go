@@ -0,0 +1,178 @@
+package ipfsKeystoneTest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// ==================================================================================
+//				Stale shared memory janitor
+// ==================================================================================
+
+// 父进程在创建和删除 System V 共享内存之间崩溃时，共享内存段会一直留在内核中直到重启。
+// 共享内存的开头是 C 程序使用的头部结构体，所以父进程创建共享内存时多申请 shmTrailerSize
+// 字节，在末尾写入魔数、创建者的 PID 和进程启动时间。Janitor 按这个尾部找出本库创建的
+// 共享内存段，创建者已经退出的就是孤儿，可以删除
+
+const (
+	shmTrailerSize    = 64
+	shmTrailerVersion = 1
+)
+
+// shmTrailerMagic 标记本库创建的共享内存段
+var shmTrailerMagic = [8]byte{'I', 'P', 'F', 'S', 'K', 'S', 'H', 'M'}
+
+// shmTrailer 是写在共享内存末尾的记录，按小端序编码：
+// 魔数 8 字节，版本 4 字节，保留 4 字节，之后每项 8 字节
+type shmTrailer struct {
+	PID     int64
+	Start   uint64 // 创建者进程的启动时间（/proc/<pid>/stat 第 22 项），0 表示未知
+	Created int64  // 创建时间，Unix 纳秒
+	Size    int64  // 交给 C 程序使用的长度，不包括尾部
+}
+
+// encode 把尾部写入 b，b 的长度是 shmTrailerSize
+func (t shmTrailer) encode(b []byte) {
+	le := binary.LittleEndian
+	copy(b[0:8], shmTrailerMagic[:])
+	le.PutUint32(b[8:], shmTrailerVersion)
+	le.PutUint32(b[12:], 0)
+	le.PutUint64(b[16:], uint64(t.PID))
+	le.PutUint64(b[24:], t.Start)
+	le.PutUint64(b[32:], uint64(t.Created))
+	le.PutUint64(b[40:], uint64(t.Size))
+}
+
+var (
+	selfStartOnce sync.Once
+	selfStart     uint64
+)
+
+// withTrailer 返回加上尾部之后实际创建的长度
+func withTrailer(size int64) int64 { return size + shmTrailerSize }
+
+// stampShm 在 r 的最后 shmTrailerSize 字节写入尾部，返回去掉尾部之后的共享内存
+func stampShm(r ShmRegion) ShmRegion {
+	size := r.size - shmTrailerSize
+	selfStartOnce.Do(func() { selfStart = procStartTime(os.Getpid()) })
+	t := shmTrailer{
+		PID:     int64(os.Getpid()),
+		Start:   selfStart,
+		Created: time.Now().UnixNano(),
+		Size:    size,
+	}
+	t.encode(unsafe.Slice((*byte)(unsafe.Add(r.addr, size)), shmTrailerSize))
+	return ShmRegion{addr: r.addr, size: size}
+}
+
+// parseShmTrailer 解析共享内存最后 shmTrailerSize 字节，不是本库写入的返回 false
+func parseShmTrailer(b []byte) (shmTrailer, bool) {
+	le := binary.LittleEndian
+	if len(b) != shmTrailerSize || [8]byte(b[0:8]) != shmTrailerMagic || le.Uint32(b[8:]) != shmTrailerVersion {
+		return shmTrailer{}, false
+	}
+	return shmTrailer{
+		PID:     int64(le.Uint64(b[16:])),
+		Start:   le.Uint64(b[24:]),
+		Created: int64(le.Uint64(b[32:])),
+		Size:    int64(le.Uint64(b[40:])),
+	}, true
+}
+
+// SysVSegment 描述本库创建的一个 System V 共享内存段
+type SysVSegment struct {
+	ID       int       // shmid
+	Key      int       // 创建时使用的键值
+	Size     int64     // 共享内存段的长度，包括尾部
+	OwnerPID int       // 创建共享内存的父进程
+	Created  time.Time // 创建时间
+	Attached int       // 当前连接的进程数
+	Orphan   bool      // 创建者已经退出
+}
+
+func (s SysVSegment) String() string {
+	state := "live"
+	if s.Orphan {
+		state = "orphan"
+	}
+	return fmt.Sprintf("shmid=%d key=%#x size=%d owner=%d attached=%d created=%s %s",
+		s.ID, s.Key, s.Size, s.OwnerPID, s.Attached, s.Created.Format(time.RFC3339), state)
+}
+
+// ErrJanitorUnsupported 表示当前平台不能枚举 System V 共享内存
+var ErrJanitorUnsupported = errors.New("ipfs-keystone: shared memory janitor is not supported on this platform")
+
+// Janitor 查找并删除本库遗留的共享内存段，零值可以直接使用
+type Janitor struct {
+	// DryRun 为 true 时 Clean 只报告孤儿，不删除
+	DryRun bool
+	// Logf 不为 nil 时记录删除的共享内存段和遇到的错误
+	Logf func(format string, args ...any)
+}
+
+// Scan 列出本库创建的所有共享内存段。没有读权限或者没有尾部的共享内存段被跳过
+func (j *Janitor) Scan() ([]SysVSegment, error) {
+	return scanSysVSegments()
+}
+
+// Clean 删除创建者已经退出的共享内存段，返回删除（DryRun 时是将要删除）的共享内存段。
+// 仍有子进程连接的共享内存段在最后一个进程断开后由内核回收
+func (j *Janitor) Clean() ([]SysVSegment, error) {
+	segs, err := j.Scan()
+	if err != nil {
+		return nil, err
+	}
+	var removed []SysVSegment
+	var errs []error
+	for _, s := range segs {
+		if !s.Orphan {
+			continue
+		}
+		if !j.DryRun {
+			if err := removeShmID(s.ID); err != nil {
+				j.logf("remove %v: %v", s, err)
+				errs = append(errs, fmt.Errorf("remove shmid %d: %w", s.ID, err))
+				continue
+			}
+			j.logf("removed %v", s)
+		}
+		removed = append(removed, s)
+	}
+	return removed, errors.Join(errs...)
+}
+
+func (j *Janitor) logf(format string, args ...any) {
+	if j.Logf != nil {
+		j.Logf(format, args...)
+	}
+}
+
+// CleanStaleShm 删除本库遗留的共享内存段，适合在守护进程启动时调用
+func CleanStaleShm() ([]SysVSegment, error) {
+	var j Janitor
+	return j.Clean()
+}
+
+// stampedShmRegion 检查 C 函数按 withTrailer(size) 创建的共享内存并写入尾部，
+// 返回长度为 size 的 ShmRegion
+func stampedShmRegion(addr unsafe.Pointer, size int64, what string) (ShmRegion, error) {
+	r, err := newShmRegion(addr, withTrailer(size), what)
+	if err != nil {
+		return ShmRegion{}, err
+	}
+	return stampShm(r), nil
+}
+
+// stampedShmRegionU 与 stampedShmRegion 相同，长度是 unsigned long long
+func stampedShmRegionU(addr unsafe.Pointer, size uint64, what string) (ShmRegion, error) {
+	if size > math.MaxInt64-shmTrailerSize {
+		return ShmRegion{}, shmCreateError(fmt.Errorf("%s: size %d overflows int64", what, size))
+	}
+	return stampedShmRegion(addr, int64(size), what)
+}
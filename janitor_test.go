@@ -0,0 +1,52 @@
+package ipfsKeystoneTest
+
+import (
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestShmTrailer(t *testing.T) {
+	want := shmTrailer{PID: 1234, Start: 5678, Created: 1700000000123456789, Size: 1 << 40}
+	b := make([]byte, shmTrailerSize)
+	want.encode(b)
+	if got, ok := parseShmTrailer(b); !ok || got != want {
+		t.Fatalf("parseShmTrailer = %+v, %v, want %+v", got, ok, want)
+	}
+
+	for name, mutate := range map[string]func([]byte) []byte{
+		"magic":   func(b []byte) []byte { b[0] = 'X'; return b },
+		"version": func(b []byte) []byte { b[8] = shmTrailerVersion + 1; return b },
+		"short":   func(b []byte) []byte { return b[:shmTrailerSize-1] },
+		"long":    func(b []byte) []byte { return append(b, 0) },
+		"zero":    func(b []byte) []byte { return make([]byte, shmTrailerSize) },
+	} {
+		b := make([]byte, shmTrailerSize)
+		want.encode(b)
+		if _, ok := parseShmTrailer(mutate(b)); ok {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// stampShm 只写最后 shmTrailerSize 字节，返回的共享内存不包括尾部
+func TestStampShm(t *testing.T) {
+	const size = 100
+	buf := make([]byte, withTrailer(size))
+	for i := range buf[:size] {
+		buf[i] = 0xAA
+	}
+	r := stampShm(ShmRegion{addr: unsafe.Pointer(&buf[0]), size: int64(len(buf))})
+	if r.Ptr() != unsafe.Pointer(&buf[0]) || r.Size() != size {
+		t.Fatalf("region = %p, %d", r.Ptr(), r.Size())
+	}
+	for i, c := range buf[:size] {
+		if c != 0xAA {
+			t.Fatalf("byte %d overwritten", i)
+		}
+	}
+	tr, ok := parseShmTrailer(buf[size:])
+	if !ok || tr.Size != size || tr.PID != int64(os.Getpid()) || tr.Created == 0 {
+		t.Fatalf("trailer = %+v, %v", tr, ok)
+	}
+}
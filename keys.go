@@ -0,0 +1,199 @@
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ==================================================================================
+//				Envelope Encryption
+// ==================================================================================
+
+// libipfs_keystone 的 AES 使用编译在库中的密钥，所有文件共用一个密钥。信封加密在它上面
+// 为每个文件生成新的数据密钥作为 CipherAESGCM 的密钥，数据密钥由 KeyManager 的主密钥包装后
+// 放在密文开头的信封头中，解密时根据信封头中的主密钥 ID 取回数据密钥
+
+// KeyManager 生成和解开数据密钥，LocalKeyStore 是默认的实现
+type KeyManager interface {
+	// GenerateDataKey 返回新的数据密钥、用当前主密钥包装后的数据密钥和主密钥的 ID
+	GenerateDataKey() (key, wrapped []byte, keyID string, err error)
+	// UnwrapDataKey 用 keyID 对应的主密钥解开 wrapped，没有这个主密钥时返回 ErrKeyNotFound
+	UnwrapDataKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeyRotator 由支持主密钥轮换的 KeyManager 实现，Rewrap 使用它。LocalKeyStore 实现了它
+type KeyRotator interface {
+	KeyManager
+	// CurrentKeyID 返回当前用于包装数据密钥的主密钥 ID
+	CurrentKeyID() string
+	// WrapDataKey 用当前主密钥包装已有的数据密钥
+	WrapDataKey(key []byte) (wrapped []byte, keyID string, err error)
+	// Rotate 生成新的主密钥并设为当前主密钥，旧的主密钥仍然可以解开数据密钥
+	Rotate() (keyID string, err error)
+}
+
+var (
+	// ErrKeyNotFound 表示 KeyManager 中没有信封头指定的主密钥
+	ErrKeyNotFound = errors.New("ipfs-keystone: master key not found")
+	// ErrEnvelope 表示信封头无效，或者包装的数据密钥无法解开
+	ErrEnvelope = errors.New("ipfs-keystone: invalid envelope header")
+)
+
+const (
+	// EnvelopeHeaderSize 是信封头的长度，信封头之后是 CipherAESGCM 的帧。
+	// 长度固定，解密时不读信封头就能算出明文长度
+	EnvelopeHeaderSize = 256
+	// MaxKeyIDSize 是主密钥 ID 的最大长度
+	MaxKeyIDSize = 64
+
+	envelopeFixed = 8 // magic、版本、ID 长度和包装密钥长度
+)
+
+var envelopeMagic = [4]byte{'I', 'K', 'E', 'K'}
+
+const envelopeVersion = 1
+
+// 信封头的格式，整数都是大端序，其余字节为 0：
+//
+//	magic[4] version[1] idLen[1] wrappedLen[2] keyID[idLen] wrapped[wrappedLen]
+
+// dataKeySize 是数据密钥的长度，使用 AES-256-GCM
+const dataKeySize = 32
+
+// newEnvelope 生成新的数据密钥，返回它的 blockAEAD 和信封头
+func newEnvelope(km KeyManager) (*blockAEAD, []byte, error) {
+	key, wrapped, keyID, err := km.GenerateDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := encodeEnvelope(keyID, wrapped)
+	if err != nil {
+		return nil, nil, err
+	}
+	a, err := newBlockAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, header, nil
+}
+
+func encodeEnvelope(keyID string, wrapped []byte) ([]byte, error) {
+	if keyID == "" || len(keyID) > MaxKeyIDSize {
+		return nil, fmt.Errorf("%w: key ID of %d bytes", ErrEnvelope, len(keyID))
+	}
+	if envelopeFixed+len(keyID)+len(wrapped) > EnvelopeHeaderSize {
+		return nil, fmt.Errorf("%w: wrapped key of %d bytes does not fit", ErrEnvelope, len(wrapped))
+	}
+	h := make([]byte, EnvelopeHeaderSize)
+	copy(h, envelopeMagic[:])
+	h[4] = envelopeVersion
+	h[5] = byte(len(keyID))
+	binary.BigEndian.PutUint16(h[6:], uint16(len(wrapped)))
+	n := copy(h[envelopeFixed:], keyID)
+	copy(h[envelopeFixed+n:], wrapped)
+	return h, nil
+}
+
+// parseEnvelope 返回信封头中的主密钥 ID 和包装后的数据密钥
+func parseEnvelope(h []byte) (string, []byte, error) {
+	if len(h) < EnvelopeHeaderSize {
+		return "", nil, fmt.Errorf("%w: %d of %d bytes", ErrEnvelope, len(h), EnvelopeHeaderSize)
+	}
+	h = h[:EnvelopeHeaderSize]
+	if !bytes.Equal(h[:4], envelopeMagic[:]) {
+		return "", nil, fmt.Errorf("%w: bad magic", ErrEnvelope)
+	}
+	if h[4] != envelopeVersion {
+		return "", nil, fmt.Errorf("%w: version %d", ErrEnvelope, h[4])
+	}
+	idLen := int(h[5])
+	wrappedLen := int(binary.BigEndian.Uint16(h[6:]))
+	end := envelopeFixed + idLen + wrappedLen
+	if idLen == 0 || idLen > MaxKeyIDSize || end > EnvelopeHeaderSize {
+		return "", nil, fmt.Errorf("%w: key ID of %d bytes, wrapped key of %d bytes", ErrEnvelope, idLen, wrappedLen)
+	}
+	for _, b := range h[end:] {
+		if b != 0 {
+			return "", nil, fmt.Errorf("%w: non-zero padding", ErrEnvelope)
+		}
+	}
+	keyID := string(h[envelopeFixed : envelopeFixed+idLen])
+	wrapped := append([]byte(nil), h[envelopeFixed+idLen:end]...)
+	return keyID, wrapped, nil
+}
+
+// openEnvelope 解析信封头并取回数据密钥
+func openEnvelope(km KeyManager, h []byte) (*blockAEAD, error) {
+	keyID, wrapped, err := parseEnvelope(h)
+	if err != nil {
+		return nil, err
+	}
+	key, err := km.UnwrapDataKey(keyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockAEAD(key)
+}
+
+// EnvelopeKeyID 返回密文开头的信封头中的主密钥 ID
+func EnvelopeKeyID(header []byte) (string, error) {
+	keyID, _, err := parseEnvelope(header)
+	return keyID, err
+}
+
+// ==================================================================================
+//				Default KeyManager
+// ==================================================================================
+
+const envKeyDir = "IPFS_KEYSTONE_KEY_DIR"
+
+var (
+	keyManagerMu      sync.Mutex
+	defaultKeyManager KeyManager
+)
+
+// DefaultKeyDir 返回默认的 LocalKeyStore 目录：IPFS_KEYSTONE_KEY_DIR，
+// 没有设置时为用户配置目录下的 ipfs-keystone/keys
+func DefaultKeyDir() (string, error) {
+	if dir := os.Getenv(envKeyDir); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ipfs-keystone", "keys"), nil
+}
+
+// DefaultKeyManager 返回没有 WithKey 和 WithKeyManager 时 CipherAESGCM 使用的 KeyManager。
+// 第一次调用时打开 DefaultKeyDir 中的 LocalKeyStore，目录中没有主密钥时生成一个
+func DefaultKeyManager() (KeyManager, error) {
+	keyManagerMu.Lock()
+	defer keyManagerMu.Unlock()
+	if defaultKeyManager != nil {
+		return defaultKeyManager, nil
+	}
+	dir, err := DefaultKeyDir()
+	if err != nil {
+		return nil, err
+	}
+	ks, err := OpenLocalKeyStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	defaultKeyManager = ks
+	return ks, nil
+}
+
+// SetDefaultKeyManager 设置之后新建的读写器使用的默认 KeyManager，km 为 nil 时
+// 下次使用时重新打开 DefaultKeyDir
+func SetDefaultKeyManager(km KeyManager) {
+	keyManagerMu.Lock()
+	defer keyManagerMu.Unlock()
+	defaultKeyManager = km
+}
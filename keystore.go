@@ -0,0 +1,278 @@
+package ipfsKeystoneTest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// ==================================================================================
+//				Local Key Store
+// ==================================================================================
+
+// LocalKeyStore 把主密钥保存在一个目录中：每个主密钥是一个 <ID>.key 文件，内容是 32 字节的
+// AES-256 密钥，current 文件记录当前用于包装新数据密钥的 ID。目录权限为 0700，文件为 0600。
+// 数据密钥用主密钥以 AES-GCM 包装，主密钥 ID 作为附加数据，信封头中的 ID 被替换时无法解开
+type LocalKeyStore struct {
+	dir     string
+	mu      sync.Mutex
+	current string
+	keys    map[string]cipher.AEAD // 已经读入的主密钥
+}
+
+const (
+	masterKeySize  = 32
+	keyFileSuffix  = ".key"
+	currentKeyFile = "current"
+)
+
+// OpenLocalKeyStore 打开 dir 中的主密钥，目录不存在时创建，没有当前主密钥时生成一个
+func OpenLocalKeyStore(dir string) (*LocalKeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ks := &LocalKeyStore{dir: dir, keys: make(map[string]cipher.AEAD)}
+
+	b, err := os.ReadFile(filepath.Join(dir, currentKeyFile))
+	switch {
+	case err == nil:
+		ks.current = strings.TrimSpace(string(b))
+		if _, err := ks.master(ks.current); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		if _, err := ks.newMasterKey(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Dir 返回保存主密钥的目录
+func (ks *LocalKeyStore) Dir() string { return ks.dir }
+
+// CurrentKeyID 返回当前用于包装新数据密钥的主密钥 ID
+func (ks *LocalKeyStore) CurrentKeyID() string {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.current
+}
+
+// GenerateDataKey 实现 KeyManager
+func (ks *LocalKeyStore) GenerateDataKey() ([]byte, []byte, string, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, keyID, err := ks.WrapDataKey(key)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return key, wrapped, keyID, nil
+}
+
+// WrapDataKey 实现 KeyRotator，用当前主密钥包装 key
+func (ks *LocalKeyStore) WrapDataKey(key []byte) ([]byte, string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	m, err := ks.master(ks.current)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := wrapKey(m, ks.current, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, ks.current, nil
+}
+
+// Rotate 实现 KeyRotator：生成新的主密钥并设为当前主密钥。旧的主密钥文件保留，
+// 还没有 Rewrap 的文件仍然可以解密，全部 Rewrap 之后可以删除旧的 <ID>.key
+func (ks *LocalKeyStore) Rotate() (string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.newMasterKey()
+}
+
+// UnwrapDataKey 实现 KeyManager
+func (ks *LocalKeyStore) UnwrapDataKey(keyID string, wrapped []byte) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	m, err := ks.master(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(m, keyID, wrapped)
+}
+
+// master 返回 ID 为 keyID 的主密钥，第一次使用时从文件读入。调用方持有 mu
+func (ks *LocalKeyStore) master(keyID string) (cipher.AEAD, error) {
+	if m, ok := ks.keys[keyID]; ok {
+		return m, nil
+	}
+	if !validKeyID(keyID) {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, keyID)
+	}
+	b, err := os.ReadFile(filepath.Join(ks.dir, keyID+keyFileSuffix))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %q in %s", ErrKeyNotFound, keyID, ks.dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != masterKeySize {
+		return nil, fmt.Errorf("ipfs-keystone: master key %q has %d bytes, want %d", keyID, len(b), masterKeySize)
+	}
+	m, err := newKeyWrapper(b)
+	if err != nil {
+		return nil, err
+	}
+	ks.keys[keyID] = m
+	return m, nil
+}
+
+// newMasterKey 生成新的主密钥并设为当前主密钥，返回它的 ID。调用方持有 mu 或者还没有共享 ks
+func (ks *LocalKeyStore) newMasterKey() (string, error) {
+	key := make([]byte, masterKeySize)
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	keyID := hex.EncodeToString(id)
+
+	// O_EXCL 避免覆盖已有的主密钥，它包装的数据密钥会永远无法解开
+	f, err := os.OpenFile(filepath.Join(ks.dir, keyID+keyFileSuffix), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	// 目录项也要落盘，否则断电之后 current 可能指向不存在的 <ID>.key
+	if err := syncDir(ks.dir); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(filepath.Join(ks.dir, currentKeyFile), []byte(keyID+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	m, err := newKeyWrapper(key)
+	if err != nil {
+		return "", err
+	}
+	ks.keys[keyID] = m
+	ks.current = keyID
+	return keyID, nil
+}
+
+// validKeyID 只接受 newMasterKey 生成的 ID，信封头中的 ID 不能指向目录之外的文件
+func validKeyID(keyID string) bool {
+	if keyID == "" || len(keyID) > MaxKeyIDSize {
+		return false
+	}
+	for _, c := range keyID {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic 先写临时文件再改名，崩溃时不会留下写了一半的文件。改名之后同步目录，
+// 返回时新的内容已经落盘
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir 把目录中新建和改名的目录项写到磁盘。Windows 不能同步目录，改名由文件系统的日志保证
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func newKeyWrapper(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey 返回 nonce || AES-GCM(key)，keyID 作为附加数据
+func wrapKey(m cipher.AEAD, keyID string, key []byte) ([]byte, error) {
+	nonce := make([]byte, m.NonceSize(), m.NonceSize()+len(key)+m.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return m.Seal(nonce, nonce, key, []byte(keyID)), nil
+}
+
+func unwrapKey(m cipher.AEAD, keyID string, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < m.NonceSize()+m.Overhead() {
+		return nil, fmt.Errorf("%w: wrapped key of %d bytes", ErrEnvelope, len(wrapped))
+	}
+	n := m.NonceSize()
+	key, err := m.Open(nil, wrapped[:n], wrapped[n:], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key does not unwrap with master key %q", ErrEnvelope, keyID)
+	}
+	return key, nil
+}
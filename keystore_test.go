@@ -0,0 +1,202 @@
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalKeyStoreRotateReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	ks, err := OpenLocalKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := ks.CurrentKeyID()
+	if !validKeyID(id1) {
+		t.Fatalf("current key ID %q", id1)
+	}
+	key1, wrapped1, kid, err := ks.GenerateDataKey()
+	if err != nil || kid != id1 || len(key1) != dataKeySize {
+		t.Fatalf("GenerateDataKey: %q, %d bytes, %v", kid, len(key1), err)
+	}
+
+	id2, err := ks.Rotate()
+	if err != nil || id2 == id1 || ks.CurrentKeyID() != id2 {
+		t.Fatalf("Rotate = %q, %v, current %q", id2, err, ks.CurrentKeyID())
+	}
+	key2, wrapped2, kid, err := ks.GenerateDataKey()
+	if err != nil || kid != id2 {
+		t.Fatalf("GenerateDataKey after Rotate: %q, %v", kid, err)
+	}
+
+	if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("key dir: %v", err)
+	}
+	for _, name := range []string{id1 + keyFileSuffix, id2 + keyFileSuffix, currentKeyFile} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || fi.Mode().Perm() != 0600 {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, currentKeyFile)); err != nil || strings.TrimSpace(string(b)) != id2 {
+		t.Fatalf("current file %q, %v", b, err)
+	}
+
+	// 重新打开之后当前主密钥不变，旧主密钥包装的数据密钥仍然可以解开
+	ks, err = OpenLocalKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.CurrentKeyID() != id2 {
+		t.Fatalf("reopened current key %q, want %q", ks.CurrentKeyID(), id2)
+	}
+	if key, err := ks.UnwrapDataKey(id1, wrapped1); err != nil || !bytes.Equal(key, key1) {
+		t.Fatalf("unwrap with the rotated-out key: %v", err)
+	}
+	if key, err := ks.UnwrapDataKey(id2, wrapped2); err != nil || !bytes.Equal(key, key2) {
+		t.Fatalf("unwrap with the current key: %v", err)
+	}
+}
+
+func TestLocalKeyStoreUnwrapErrors(t *testing.T) {
+	dir := t.TempDir()
+	ks, err := OpenLocalKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1 := ks.CurrentKeyID()
+	_, wrapped, _, err := ks.GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个主密钥换一个 ID 保存，只有附加数据不同
+	const alias = "00000000000000aa"
+	b, err := os.ReadFile(filepath.Join(dir, id1+keyFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, alias+keyFileSuffix), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		id      string
+		wrapped []byte
+		err     error
+	}{
+		{"unknown ID", "0123456789abcdef", wrapped, ErrKeyNotFound},
+		{"path in ID", "../" + id1, wrapped, ErrKeyNotFound},
+		{"empty ID", "", wrapped, ErrKeyNotFound},
+		{"other master key", id2, wrapped, ErrEnvelope},
+		{"same key, swapped ID", alias, wrapped, ErrEnvelope},
+		{"truncated", id1, wrapped[:10], ErrEnvelope},
+		{"tampered", id1, append(append([]byte(nil), wrapped[:len(wrapped)-1]...), wrapped[len(wrapped)-1]^1), ErrEnvelope},
+	} {
+		if key, err := ks.UnwrapDataKey(c.id, c.wrapped); !errors.Is(err, c.err) || key != nil {
+			t.Errorf("%s: %v, want %v", c.name, err, c.err)
+		}
+	}
+	if _, err := ks.UnwrapDataKey(id1, wrapped); err != nil {
+		t.Fatalf("intact wrapped key: %v", err)
+	}
+}
+
+func TestEnvelopeHeader(t *testing.T) {
+	ks, err := OpenLocalKeyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, h, err := newEnvelope(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != EnvelopeHeaderSize {
+		t.Fatalf("header of %d bytes", len(h))
+	}
+	if id, err := EnvelopeKeyID(h); err != nil || id != ks.CurrentKeyID() {
+		t.Fatalf("EnvelopeKeyID = %q, %v", id, err)
+	}
+	// 从信封头取回的数据密钥加密的帧能被原来的 blockAEAD 打开
+	b, err := openEnvelope(ks, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := b.seal(nil, 0, true, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := a.open(nil, 0, true, frame); err != nil || string(pt) != "data" {
+		t.Fatalf("frame from the unwrapped key: %q, %v", pt, err)
+	}
+
+	id, wrapped, err := parseEnvelope(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		mutate func(h []byte) []byte
+		err    error
+	}{
+		{"bad magic", func(h []byte) []byte { h[0] = 'X'; return h }, ErrEnvelope},
+		{"bad version", func(h []byte) []byte { h[4] = envelopeVersion + 1; return h }, ErrEnvelope},
+		{"short", func(h []byte) []byte { return h[:EnvelopeHeaderSize-1] }, ErrEnvelope},
+		{"empty ID", func(h []byte) []byte { h[5] = 0; return h }, ErrEnvelope},
+		{"long ID", func(h []byte) []byte { h[5] = MaxKeyIDSize + 1; return h }, ErrEnvelope},
+		{"wrapped key past the header", func(h []byte) []byte {
+			binary.BigEndian.PutUint16(h[6:], EnvelopeHeaderSize)
+			return h
+		}, ErrEnvelope},
+		{"non-zero padding", func(h []byte) []byte { h[EnvelopeHeaderSize-1] = 1; return h }, ErrEnvelope},
+		// ID 被换成另一个不存在的主密钥
+		{"unknown key ID", func(h []byte) []byte {
+			h, _ = encodeEnvelope("0123456789abcdef", wrapped)
+			return h
+		}, ErrKeyNotFound},
+	} {
+		bad := c.mutate(append([]byte(nil), h...))
+		if _, err := openEnvelope(ks, bad); !errors.Is(err, c.err) {
+			t.Errorf("%s: %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	// 信封头中的 ID 换成轮换之后的主密钥，数据密钥无法解开
+	id2, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped, err := encodeEnvelope(id2, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openEnvelope(ks, swapped); !errors.Is(err, ErrEnvelope) {
+		t.Fatalf("swapped key ID: %v", err)
+	}
+	if _, err := openEnvelope(ks, h); err != nil {
+		t.Fatalf("original header after Rotate (key %q): %v", id, err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		id      string
+		wrapped []byte
+	}{
+		{"empty ID", "", wrapped},
+		{"long ID", strings.Repeat("a", MaxKeyIDSize+1), wrapped},
+		{"wrapped key too large", id, make([]byte, EnvelopeHeaderSize)},
+	} {
+		if _, err := encodeEnvelope(c.id, c.wrapped); !errors.Is(err, ErrEnvelope) {
+			t.Errorf("encodeEnvelope %s: %v", c.name, err)
+		}
+	}
+}
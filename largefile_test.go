@@ -0,0 +1,137 @@
+//go:build !keystone && largefile
+
+// 这些测试把多个 2-4 GiB 的数据流推过三种模式，默认不运行：go test -tags largefile
+
+package ipfsKeystoneTest
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 2 GiB 和 4 GiB 附近的文件大小，C.int 和 uint32 的长度在这里溢出
+var boundarySizes = []int64{
+	1<<31 - 1, 1 << 31, 1<<31 + 1,
+	1<<32 - 1, 1 << 32, 1<<32 + 1,
+}
+
+// sparseFile 创建长度为 size 的稀疏文件，在边界附近和文件末尾写入非零字节，
+// 块的顺序或偏移出错时明文的校验和不同
+func sparseFile(t *testing.T, size int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "large")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Skipf("sparse file of %d bytes: %v", size, err)
+	}
+	for i, off := range []int64{0, 1<<31 - 1, 1 << 31, 1<<32 - 1, 1 << 32, size - 1} {
+		if off < size {
+			if _, err := f.WriteAt([]byte{byte(i + 1)}, off); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return path
+}
+
+func newCRC() hash.Hash64 { return crc64.New(crc64.MakeTable(crc64.ECMA)) }
+
+// fileCRC 返回文件内容的校验和
+func fileCRC(t *testing.T, path string) uint64 {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h := newCRC()
+	if _, err := io.Copy(h, f); err != nil {
+		t.Fatal(err)
+	}
+	return h.Sum64()
+}
+
+// copyCRC 把 r 的内容复制到 w，返回复制的长度和内容的校验和
+func copyCRC(w io.Writer, r io.Reader) (int64, uint64, error) {
+	h := newCRC()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	return n, h.Sum64(), err
+}
+
+func TestBoundarySizesRoundTrip(t *testing.T) {
+	for _, size := range boundarySizes {
+		size := size
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			path := sparseFile(t, size)
+			want := fileCRC(t, path)
+
+			// single：单 enclave 加密，单 enclave 解密
+			r, err := NewEncryptReader(path, WithCipher(CipherAES))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt := newCRC()
+			w, err := NewDecryptWriterTo(pt, WithCipher(CipherAES), WithSize(size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, ct, err := copyCRC(w, r)
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			r.Close()
+			if err != nil || n != size {
+				t.Fatalf("single: %d of %d bytes: %v", n, size, err)
+			}
+			if pt.Sum64() != want {
+				t.Fatal("single: plaintext differs")
+			}
+
+			// cross：多个 enclave 交叉读取，密文与单 enclave 相同
+			cr, err := NewMultiProcessCrossTEEFileReader(path, size, WithCipher(CipherAES))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, got, err := copyCRC(io.Discard, cr)
+			cr.Close()
+			if err != nil || n != size {
+				t.Fatalf("cross: %d of %d bytes: %v", n, size, err)
+			}
+			if got != ct {
+				t.Fatal("cross: ciphertext differs from single")
+			}
+
+			// dispatch：密文轮流分发给多个 enclave 解密
+			r, err = NewEncryptReader(path, WithCipher(CipherAES))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			pt.Reset()
+			sim := SimBackend{DispatchSink: func() io.Writer { return pt }}
+			d, err := NewMultiProcessTEEDispatch(uint64(size), WithCipher(CipherAES), WithWorkers(3), WithBackend(sim))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err = io.Copy(d, r)
+			if cerr := d.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil || n != size {
+				t.Fatalf("dispatch: %d of %d bytes: %v", n, size, err)
+			}
+			if pt.Sum64() != want {
+				t.Fatal("dispatch: plaintext differs")
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package ipfsKeystoneTest
+
+import "sync/atomic"
+
+// cAllocs 统计还没有释放的 C 字符串、RingBuffer、MultiThreadedBuffer 和 KeystoneJustReady。
+// 模拟后端为模拟的 RingBuffer 和会话计数，没有 Keystone 工具链也能检查泄漏
+var cAllocs atomic.Int64
+
+// OutstandingCAllocs 返回还没有释放的 C 分配数量，供测试检查泄漏：
+// 所有读写器关闭、会话 End 之后应该回到 0，Abort 的会话在 enclave 线程返回之后回到 0
+func OutstandingCAllocs() int64 {
+	return cAllocs.Load()
+}
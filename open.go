@@ -0,0 +1,283 @@
+package ipfsKeystoneTest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// shmHeaderReserve 是估计共享内存大小时给每段共享内存的头部预留的字节数
+	shmHeaderReserve = 4096
+	// maxCIntSize 是 libipfs_keystone.a 中用 int 表示长度的接口能处理的最大长度，
+	// 多线程模式的文件和 flexible 多进程模式的共享内存不能超过它
+	maxCIntSize = math.MaxInt32
+)
+
+// TEEReader 是加密读取器的公共接口，构造函数返回指针，读取器不能按值复制
+type TEEReader interface {
+	io.ReadCloser
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+// TEEWriter 是解密写入器的公共接口，Close 等待 enclave 处理完已经写入的密文
+type TEEWriter interface {
+	io.WriteCloser
+	WriteContext(ctx context.Context, p []byte) (int, error)
+}
+
+// WorkerReporter 由启动 enclave 子进程的读写器实现
+type WorkerReporter interface {
+	Workers() []WorkerStatus
+}
+
+var (
+	_ TEEReader         = (*EncryptReader)(nil)
+	_ TEEReader         = (*TEEFileReader)(nil)
+	_ TEEReader         = (*MultiThreadedTEEFileReader)(nil)
+	_ TEEReader         = (*MultiProcessTEEFileReader)(nil)
+	_ TEEReader         = (*MultiProcessCrossTEEFileReader)(nil)
+	_ TEEReader         = (*MultiProcessCrossTEEFileFlexibleReader)(nil)
+	_ TEEReader         = (*TheNewDirMultiProcessCrossTEEFileFlexibleReader)(nil)
+	_ TEEReader         = (*TheNewDirTEEFileReaderADD)(nil)
+	_ TEEWriter         = (*MultiProcessTEEDispatch)(nil)
+	_ TEEWriter         = (*MultiProcessTEESecureDispatch)(nil)
+	_ TEEWriter         = (*TheNewDirMultiProcessTEESecureDispatch)(nil)
+	_ TEEWriter         = (*TheNewDirTEEFileReader)(nil)
+	_ TEEWriter         = (*DecryptWriter)(nil)
+	_ io.WriterTo       = (*MultiProcessCrossTEEFileFlexibleReader)(nil)
+	_ io.WriterTo       = (*TheNewDirMultiProcessCrossTEEFileFlexibleReader)(nil)
+	_ io.ReaderFrom     = (*MultiProcessTEEDispatch)(nil)
+	_ io.ReaderFrom     = (*MultiProcessTEESecureDispatch)(nil)
+	_ io.ReaderFrom     = (*TheNewDirMultiProcessTEESecureDispatch)(nil)
+	_ io.ReaderAt       = (*DecryptReaderAt)(nil)
+	_ io.ReadSeekCloser = (*DecryptReaderAt)(nil)
+	_ WorkerReporter    = (*MultiProcessTEEFileReader)(nil)
+	_ WorkerReporter    = (*MultiProcessCrossTEEFileReader)(nil)
+	_ WorkerReporter    = (*MultiProcessCrossTEEFileFlexibleReader)(nil)
+	_ WorkerReporter    = (*MultiProcessTEEDispatch)(nil)
+	_ WorkerReporter    = (*MultiProcessTEESecureDispatch)(nil)
+	_ WorkerReporter    = (*TheNewDirMultiProcessTEESecureDispatchJustCall)(nil)
+	_ WorkerReporter    = (*TheNewDirMultiProcessCrossTEEFileFlexibleReaderJustCall)(nil)
+)
+
+// blockCount 返回 size 字节的文件分成的块数
+func blockCount(size int64) int64 {
+	return (size + DefaultBlockSize - 1) / DefaultBlockSize
+}
+
+// crossShmSize 估计 flexible 多进程模式需要的共享内存：整个文件、每块 4 字节的长度和头部
+func crossShmSize(size int64) int64 {
+	return size + blockCount(size)*4 + shmHeaderReserve
+}
+
+// dispatchShmSize 估计 dispatch 模式需要的共享内存：每个 enclave 一段，每块前面有 4 字节的长度
+func dispatchShmSize(size int64, workers int) int64 {
+	return blockCount(size)*(4+DefaultBlockSize) + int64(workers)*shmHeaderReserve
+}
+
+// chooseEncryptMode 根据文件大小、Workers 和可用的共享内存（小于 0 表示未知）选择加密模式，
+// 返回模式和 enclave 数量：
+//   - 不到两块的文件或者 Workers 为 1 使用单 enclave 模式
+//   - Workers 为 0 或 2 时使用多线程模式，它不需要共享内存和子进程
+//   - 否则共享内存放得下整个文件时使用 flexible 多进程模式，放不下时退回多线程模式
+//   - 超过 maxCIntSize 的文件只能使用单 enclave 模式
+func chooseEncryptMode(size int64, workers int, shm int64) (Mode, int) {
+	fitsThreaded := blockCount(size)*DefaultBlockSize <= maxCIntSize
+	switch {
+	case workers == 1 || blockCount(size) < 2:
+		return ModeSingle, 1
+	case workers <= 2 && fitsThreaded:
+		return ModeMultiThreaded, 2
+	}
+
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+	need := crossShmSize(size)
+	if need <= maxCIntSize && (shm < 0 || need <= shm) {
+		return ModeCrossFlexible, workers
+	}
+	if fitsThreaded {
+		return ModeMultiThreaded, 2
+	}
+	return ModeSingle, 1
+}
+
+// chooseDecryptMode 选择解密模式：知道密文长度、至少两块并且共享内存放得下时使用 dispatch 模式，
+// 否则在有输出文件或 io.Writer 时（canSingle）使用单 enclave 模式。两种模式都不能使用时返回 ErrInvalidOptions
+func chooseDecryptMode(size int64, workers int, canSingle bool, shm int64) (Mode, int, error) {
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+	canDispatch := size > 0 && workers != 1 && (shm < 0 || dispatchShmSize(size, workers) <= shm)
+
+	switch {
+	case canDispatch && (blockCount(size) >= 2 || !canSingle):
+		return ModeDispatch, workers, nil
+	case canSingle:
+		return ModeSingle, 1, nil
+	}
+	if size > 0 && workers != 1 {
+		return 0, 0, fmt.Errorf("%w: dispatch needs %d bytes of shared memory, %d available, and no output file for single mode",
+			ErrInvalidOptions, dispatchShmSize(size, workers), shm)
+	}
+	return 0, 0, fmt.Errorf("%w: decrypt needs an output file or a size", ErrInvalidOptions)
+}
+
+// OpenEncrypt 加密 path，根据文件大小、Workers 和可用的共享内存选择单 enclave、多线程
+// 或 flexible 多进程模式，从返回的 TEEReader 读出密文
+func OpenEncrypt(path string, opts ...Option) (TEEReader, error) {
+	return OpenEncryptContext(context.Background(), path, opts...)
+}
+
+// OpenEncryptContext 与 OpenEncrypt 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func OpenEncryptContext(ctx context.Context, path string, opts ...Option) (TEEReader, error) {
+	o := applyOptions(opts)
+	if err := o.Validate(ModeCrossFlexible); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	mode, workers := chooseEncryptMode(size, o.Workers, availableShm())
+	opts = append(opts[:len(opts):len(opts)], WithWorkers(workers))
+
+	switch mode {
+	case ModeSingle:
+		r, err := NewEncryptReaderContext(ctx, path, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	case ModeMultiThreaded:
+		r, err := NewMultiThreadedTEEFileReaderContext(ctx, path, size, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	r, err := NewMultiProcessCrossTEEFileFlexibleReaderContext(ctx, path, size, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// chooseStreamEncryptMode 为 EncryptStream 选择模式：长度未知、不到两块或者 Workers 为 1 时
+// 使用单 enclave 模式，明文边读边加密；否则共享内存放得下密文和明文时使用 flexible 多进程模式，
+// 子进程需要随机读取，明文先全部读进内存
+func chooseStreamEncryptMode(size int64, workers int, shm int64) (Mode, int) {
+	if size <= 0 || workers == 1 || blockCount(size) < 2 {
+		return ModeSingle, 1
+	}
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+	need := crossShmSize(size)
+	if need <= maxCIntSize && (shm < 0 || need+size <= shm) {
+		return ModeCrossFlexible, workers
+	}
+	return ModeSingle, 1
+}
+
+// EncryptStream 加密从 r 读出的明文，不需要源文件，从返回的 TEEReader 读出密文。
+// 没有用 WithSize 设置长度时使用单 enclave 模式，明文经过输入环形缓冲区交给 enclave；
+// 设置了长度并且 Workers 不为 1 时可以使用 flexible 多进程模式。设置了长度时 r 的长度
+// 必须相同，否则读出密文时返回 ErrSourceLength
+func EncryptStream(r io.Reader, opts ...Option) (TEEReader, error) {
+	return EncryptStreamContext(context.Background(), r, opts...)
+}
+
+// EncryptStreamContext 与 EncryptStream 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func EncryptStreamContext(ctx context.Context, r io.Reader, opts ...Option) (TEEReader, error) {
+	if r == nil {
+		return nil, fmt.Errorf("%w: nil plaintext reader", ErrInvalidOptions)
+	}
+	o := applyOptions(opts)
+	if err := o.Validate(ModeCrossFlexible); err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, ctxError(ctx)
+	}
+
+	mode, workers := chooseStreamEncryptMode(o.Size, o.Workers, availableShm())
+	opts = append(opts[:len(opts):len(opts)], WithWorkers(workers))
+
+	b, req, err := newRequest(mode, opts)
+	if err != nil {
+		return nil, err
+	}
+	req.Source = r
+	req.Size = o.Size
+
+	s, err := b.OpenEncrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	if mode == ModeSingle {
+		return &EncryptReader{s: newCtxStream(s)}, nil
+	}
+
+	reader := &MultiProcessCrossTEEFileFlexibleReader{
+		s:      newCtxStream(s),
+		readCh: make(chan struct{}, 1),
+	}
+	if err := reader.s.WaitReadyContext(ctx); err != nil {
+		reader.s.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// OpenDecrypt 返回写入密文的 TEEWriter。设置了 WithPlaintextWriter 时使用单 enclave 模式，
+// 明文写到这个 io.Writer；设置了 WithSize（或者 DispathSetLength）并且共享内存足够时使用
+// dispatch 模式，明文由 enclave 输出；否则使用单 enclave 模式，明文写到 WithOutput 设置的文件
+func OpenDecrypt(opts ...Option) (TEEWriter, error) {
+	return OpenDecryptContext(context.Background(), opts...)
+}
+
+// OpenDecryptContext 与 OpenDecrypt 相同，ctx 结束时停止 enclave、杀死子进程并释放资源
+func OpenDecryptContext(ctx context.Context, opts ...Option) (TEEWriter, error) {
+	o := applyOptions(opts)
+	validate := ModeDispatch
+	if o.Sink != nil {
+		validate = ModeSingle
+	}
+	if err := o.Validate(validate); err != nil {
+		return nil, err
+	}
+	size := o.Size
+	if size == 0 {
+		size = int64(dispathGetLength())
+	}
+
+	// dispatch 模式的明文由 enclave 输出，交给 io.Writer 只能使用单 enclave 模式
+	mode, workers := ModeSingle, 1
+	if o.Sink == nil {
+		var err error
+		if mode, workers, err = chooseDecryptMode(size, o.Workers, o.Output != "", availableShm()); err != nil {
+			return nil, err
+		}
+	}
+	opts = append(opts[:len(opts):len(opts)], WithWorkers(workers))
+
+	if mode == ModeSingle {
+		w, err := NewDecryptWriterContext(ctx, o.Output, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	w, err := NewMultiProcessTEEDispatchContext(ctx, uint64(size), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,165 @@
+//go:build !keystone
+
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestChooseEncryptMode(t *testing.T) {
+	const b = DefaultBlockSize
+	for _, tc := range []struct {
+		size    int64
+		workers int
+		shm     int64
+		mode    Mode
+		n       int
+	}{
+		{0, 0, -1, ModeSingle, 1},
+		{b, 0, -1, ModeSingle, 1},
+		{b + 1, 0, -1, ModeMultiThreaded, 2},
+		{3 * b, 1, -1, ModeSingle, 1},
+		{3 * b, 2, -1, ModeMultiThreaded, 2},
+		{3 * b, 4, -1, ModeCrossFlexible, 4},
+		{3 * b, 4, crossShmSize(3 * b), ModeCrossFlexible, 4},
+		{3 * b, 4, crossShmSize(3*b) - 1, ModeMultiThreaded, 2},
+		{1 << 30, 0, -1, ModeMultiThreaded, 2},
+		{1 << 30, 4, -1, ModeCrossFlexible, 4},
+		// 超过 C int 的文件多线程和 flexible 模式都放不下
+		{1 << 31, 0, -1, ModeSingle, 1},
+		{1 << 31, 4, -1, ModeSingle, 1},
+		{1 << 32, 4, -1, ModeSingle, 1},
+	} {
+		mode, n := chooseEncryptMode(tc.size, tc.workers, tc.shm)
+		if mode != tc.mode || n != tc.n {
+			t.Errorf("chooseEncryptMode(%d, %d, %d) = %v, %d, want %v, %d", tc.size, tc.workers, tc.shm, mode, n, tc.mode, tc.n)
+		}
+	}
+}
+
+func TestChooseStreamEncryptMode(t *testing.T) {
+	const b = DefaultBlockSize
+	for _, tc := range []struct {
+		size    int64
+		workers int
+		shm     int64
+		mode    Mode
+		n       int
+	}{
+		{0, 4, -1, ModeSingle, 1},
+		{b, 4, -1, ModeSingle, 1},
+		{3 * b, 1, -1, ModeSingle, 1},
+		{3 * b, 0, -1, ModeCrossFlexible, DefaultWorkers},
+		{3 * b, 4, -1, ModeCrossFlexible, 4},
+		// 明文也要放进共享内存
+		{3 * b, 4, crossShmSize(3*b) + 3*b, ModeCrossFlexible, 4},
+		{3 * b, 4, crossShmSize(3 * b), ModeSingle, 1},
+		{1 << 31, 4, -1, ModeSingle, 1},
+	} {
+		mode, n := chooseStreamEncryptMode(tc.size, tc.workers, tc.shm)
+		if mode != tc.mode || n != tc.n {
+			t.Errorf("chooseStreamEncryptMode(%d, %d, %d) = %v, %d, want %v, %d", tc.size, tc.workers, tc.shm, mode, n, tc.mode, tc.n)
+		}
+	}
+}
+
+func TestChooseDecryptMode(t *testing.T) {
+	const b = DefaultBlockSize
+	for _, tc := range []struct {
+		size      int64
+		workers   int
+		canSingle bool
+		shm       int64
+		mode      Mode
+		n         int
+		err       error
+	}{
+		{0, 0, true, -1, ModeSingle, 1, nil},
+		{0, 0, false, -1, 0, 0, ErrInvalidOptions},
+		{b, 0, true, -1, ModeSingle, 1, nil},
+		{b, 0, false, -1, ModeDispatch, DefaultWorkers, nil},
+		{3 * b, 0, true, -1, ModeDispatch, DefaultWorkers, nil},
+		{3 * b, 1, true, -1, ModeSingle, 1, nil},
+		{3 * b, 1, false, -1, 0, 0, ErrInvalidOptions},
+		{3 * b, 4, true, dispatchShmSize(3*b, 4), ModeDispatch, 4, nil},
+		{3 * b, 4, true, dispatchShmSize(3*b, 4) - 1, ModeSingle, 1, nil},
+		{3 * b, 4, false, dispatchShmSize(3*b, 4) - 1, 0, 0, ErrInvalidOptions},
+	} {
+		mode, n, err := chooseDecryptMode(tc.size, tc.workers, tc.canSingle, tc.shm)
+		if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) || mode != tc.mode || n != tc.n {
+			t.Errorf("chooseDecryptMode(%d, %d, %v, %d) = %v, %d, %v, want %v, %d, %v",
+				tc.size, tc.workers, tc.canSingle, tc.shm, mode, n, err, tc.mode, tc.n, tc.err)
+		}
+	}
+}
+
+// OpenEncrypt 选择的每种模式都返回相同的密文，OpenDecrypt 的 dispatch 和单 enclave 模式都能解密
+func TestOpenEncryptModes(t *testing.T) {
+	const n = 3*DefaultBlockSize + 100
+	path, data := writeTemp(t, n)
+
+	var want []byte
+	for _, tc := range []struct {
+		workers int
+		check   func(TEEReader) bool
+	}{
+		{1, func(r TEEReader) bool { _, ok := r.(*EncryptReader); return ok }},
+		{2, func(r TEEReader) bool { _, ok := r.(*MultiThreadedTEEFileReader); return ok }},
+		{4, func(r TEEReader) bool {
+			// 共享内存不够时退回多线程模式
+			switch r.(type) {
+			case *MultiProcessCrossTEEFileFlexibleReader, *MultiThreadedTEEFileReader:
+				return true
+			}
+			return false
+		}},
+	} {
+		r, err := OpenEncrypt(path, WithCipher(CipherAES), WithWorkers(tc.workers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tc.check(r) {
+			t.Errorf("workers %d: got %T", tc.workers, r)
+		}
+		ct, err := io.ReadAll(r)
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatalf("workers %d: %v", tc.workers, err)
+		}
+		if want == nil {
+			want = ct
+		} else if !bytes.Equal(ct, want) {
+			t.Fatalf("workers %d: ciphertext differs", tc.workers)
+		}
+	}
+
+	var pt bytes.Buffer
+	w, err := OpenDecrypt(WithCipher(CipherAES), WithPlaintextWriter(&pt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.(*DecryptWriter); !ok {
+		t.Fatalf("plaintext writer: got %T", w)
+	}
+	if err := writeAll(w, want); err != nil || !bytes.Equal(pt.Bytes(), data) {
+		t.Fatalf("single decrypt: %v", err)
+	}
+	w, err = OpenDecrypt(WithCipher(CipherAES), WithSize(int64(len(want))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.(*MultiProcessTEEDispatch); !ok {
+		t.Fatalf("sized decrypt: got %T", w)
+	}
+	if err := writeAll(w, want); err != nil {
+		t.Fatalf("dispatch decrypt: %v", err)
+	}
+	if _, err := OpenDecrypt(WithCipher(CipherAES)); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("no size and no output: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package ipfsKeystoneTest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Cipher 选择 enclave 使用的加密算法
+type Cipher int
+
+const (
+	CipherNone Cipher = iota // 不加密，对应旧接口的 isAES = 0
+	CipherAES                // AES，对应旧接口的 isAES = 1
+	// CipherAESGCM 在 enclave 的 AES 之外给每个 256 KiB 的块加上 AES-GCM 的 nonce 和认证标签，
+	// 块序号作为附加数据。密钥由 WithKey 设置，或者由 KeyManager 为每个文件生成
+	CipherAESGCM
+)
+
+func (c Cipher) String() string {
+	switch c {
+	case CipherNone:
+		return "none"
+	case CipherAES:
+		return "aes"
+	case CipherAESGCM:
+		return "aes-gcm"
+	}
+	return fmt.Sprintf("Cipher(%d)", int(c))
+}
+
+// aead 判断是否在 enclave 的输出上加认证标签
+func (c Cipher) aead() bool { return c == CipherAESGCM }
+
+// isAES 返回传给 C 函数的 isAES 参数，CipherAESGCM 时 enclave 使用 AES
+func (c Cipher) isAES() int {
+	if c == CipherNone {
+		return 0
+	}
+	return 1
+}
+
+const (
+	// DefaultBlockSize 是 enclave 每次处理的块大小
+	DefaultBlockSize = 262144
+	// MaxWorkers 是多 enclave 模式最多的 enclave 数量，与 fixFlexibleNum 的上限一致
+	MaxWorkers = 10
+	// DefaultWorkers 是多 enclave 模式没有设置 Workers 时的 enclave 数量
+	DefaultWorkers = 2
+	// DefaultCacheBlocks 是 DecryptReaderAt 默认缓存的明文块数，共 4 MiB
+	DefaultCacheBlocks = 16
+)
+
+// ErrInvalidOptions 表示 Options 中有不支持的值
+var ErrInvalidOptions = errors.New("ipfs-keystone: invalid options")
+
+// Options 汇总读写器的参数
+type Options struct {
+	Cipher      Cipher
+	Key         []byte     // CipherAESGCM 的密钥，16、24 或 32 字节
+	KeyManager  KeyManager // CipherAESGCM 的信封加密，Key 和 KeyManager 都为 nil 时使用 DefaultKeyManager
+	Workers     int        // enclave 数量，0 表示使用模式的默认值
+	BlockSize   int        // 块大小，0 表示 DefaultBlockSize，enclave 目前只支持 DefaultBlockSize
+	Config      *Config    // 子进程的位置和参数，为 nil 时使用 DefaultConfig()
+	Backend     Backend    // 为 nil 时使用 DefaultBackend()
+	Output      string     // OpenDecrypt 单 enclave 模式写出明文的文件
+	Sink        io.Writer  // 单 enclave 解密时接收明文，设置后不使用输出文件
+	CacheBlocks int        // DecryptReaderAt 缓存的明文块数，0 表示 DefaultCacheBlocks
+	Size        int64      // OpenDecrypt 输入的密文长度，0 表示使用 DispathSetLength 设置的长度；EncryptStream 输入的明文长度，0 表示未知
+}
+
+// Option 修改 Options
+type Option func(*Options)
+
+// WithCipher 设置加密算法，默认为 CipherNone
+func WithCipher(c Cipher) Option {
+	return func(o *Options) { o.Cipher = c }
+}
+
+// WithKey 设置 CipherAESGCM 使用的 AES 密钥
+func WithKey(key []byte) Option {
+	return func(o *Options) { o.Key = key }
+}
+
+// WithKeyManager 使用 CipherAESGCM 和信封加密：每个文件使用新的数据密钥，
+// 由 km 的主密钥包装后写在密文开头，解密时由 km 根据主密钥 ID 取回
+func WithKeyManager(km KeyManager) Option {
+	return func(o *Options) {
+		o.Cipher = CipherAESGCM
+		o.KeyManager = km
+	}
+}
+
+// WithWorkers 设置 enclave 数量，超出 1 到 MaxWorkers 时构造函数返回 ErrInvalidOptions
+func WithWorkers(n int) Option {
+	return func(o *Options) { o.Workers = n }
+}
+
+// WithBlockSize 设置块大小
+func WithBlockSize(n int) Option {
+	return func(o *Options) { o.BlockSize = n }
+}
+
+// WithConfig 设置子进程的位置和参数
+func WithConfig(c Config) Option {
+	return func(o *Options) { o.Config = &c }
+}
+
+// WithBackend 设置使用的后端
+func WithBackend(b Backend) Option {
+	return func(o *Options) { o.Backend = b }
+}
+
+// WithOutput 设置 OpenDecrypt 在单 enclave 模式下写出明文的文件
+func WithOutput(path string) Option {
+	return func(o *Options) { o.Output = path }
+}
+
+// WithPlaintextWriter 让单 enclave 解密把明文写到 w，明文经过内存中的第二个环形缓冲区，
+// 不写临时文件。只有单 enclave 模式支持，dispatch 模式的明文由 enclave 输出
+func WithPlaintextWriter(w io.Writer) Option {
+	return func(o *Options) { o.Sink = w }
+}
+
+// WithSize 设置 OpenDecrypt 输入的密文长度或 EncryptStream 输入的明文长度，
+// dispatch 模式和 flexible 多进程模式需要提前知道长度
+func WithSize(n int64) Option {
+	return func(o *Options) { o.Size = n }
+}
+
+// WithCacheBlocks 设置 DecryptReaderAt 缓存最近解密的多少个块
+func WithCacheBlocks(n int) Option {
+	return func(o *Options) { o.CacheBlocks = n }
+}
+
+// applyOptions 按顺序应用 opts
+func applyOptions(opts []Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// modeWorkers 返回固定 enclave 数量的模式使用的数量，可以设置数量的模式返回 0
+func modeWorkers(mode Mode) int {
+	switch mode {
+	case ModeSingle:
+		return 1
+	case ModeMultiThreaded, ModeMultiProcess, ModeCross:
+		return 2
+	}
+	return 0
+}
+
+// Validate 检查 mode 模式下 Options 是否有效
+func (o Options) Validate(mode Mode) error {
+	if o.Cipher != CipherNone && o.Cipher != CipherAES && o.Cipher != CipherAESGCM {
+		return fmt.Errorf("%w: unknown cipher %v", ErrInvalidOptions, o.Cipher)
+	}
+	if o.Cipher.aead() {
+		if o.Key != nil && o.KeyManager != nil {
+			return fmt.Errorf("%w: both a key and a key manager", ErrInvalidOptions)
+		}
+		if n := len(o.Key); o.Key != nil && n != 16 && n != 24 && n != 32 {
+			return fmt.Errorf("%w: %v needs a 16, 24 or 32 byte key, got %d bytes", ErrInvalidOptions, o.Cipher, n)
+		}
+	} else if o.Key != nil || o.KeyManager != nil {
+		return fmt.Errorf("%w: cipher %v does not take a key", ErrInvalidOptions, o.Cipher)
+	}
+	if o.BlockSize != 0 && o.BlockSize != DefaultBlockSize {
+		return fmt.Errorf("%w: block size %d, enclave only supports %d", ErrInvalidOptions, o.BlockSize, DefaultBlockSize)
+	}
+	if o.CacheBlocks < 0 {
+		return fmt.Errorf("%w: cache blocks %d", ErrInvalidOptions, o.CacheBlocks)
+	}
+	if o.Size < 0 {
+		return fmt.Errorf("%w: size %d", ErrInvalidOptions, o.Size)
+	}
+	if o.Sink != nil && mode != ModeSingle {
+		return fmt.Errorf("%w: only the single enclave mode can decrypt to an io.Writer", ErrInvalidOptions)
+	}
+	if fixed := modeWorkers(mode); fixed != 0 {
+		if o.Workers != 0 && o.Workers != fixed {
+			return fmt.Errorf("%w: mode uses %d workers, got %d", ErrInvalidOptions, fixed, o.Workers)
+		}
+		return nil
+	}
+	if o.Workers < 0 || o.Workers > MaxWorkers {
+		return fmt.Errorf("%w: workers %d out of range 1..%d", ErrInvalidOptions, o.Workers, MaxWorkers)
+	}
+	return nil
+}
+
+// newRequest 应用 opts，检查之后返回使用的后端和请求，调用方再填写 Path 和 Size
+func newRequest(mode Mode, opts []Option) (Backend, Request, error) {
+	o := applyOptions(opts)
+	if err := o.Validate(mode); err != nil {
+		return nil, Request{}, err
+	}
+
+	workers := o.Workers
+	if fixed := modeWorkers(mode); fixed != 0 {
+		workers = fixed
+	} else if workers == 0 {
+		workers = DefaultWorkers
+	}
+
+	b := o.Backend
+	if b == nil {
+		b = DefaultBackend()
+	}
+	if o.Cipher.aead() {
+		ab, err := newAEADBackend(b, o)
+		if err != nil {
+			return nil, Request{}, err
+		}
+		b = ab
+	}
+	return b, Request{Mode: mode, IsAES: o.Cipher.isAES(), Sink: o.Sink, Flexible: workers, Config: o.Config}, nil
+}
+
+// legacyOptions 把旧接口的 isAES 转换为 Option，非 0 都视为 AES
+func legacyOptions(isAES int) []Option {
+	if isAES == 0 {
+		return []Option{WithCipher(CipherNone)}
+	}
+	return []Option{WithCipher(CipherAES)}
+}
+
+// legacyFlexibleOptions 用于带 flexible 参数的旧接口，保留旧接口的行为：
+// 像 fixFlexibleNum 一样把 flexible 限制在 1 到 MaxWorkers，而不是返回错误
+func legacyFlexibleOptions(isAES int, flexible int) []Option {
+	if flexible < 1 {
+		flexible = 1
+	}
+	if flexible > MaxWorkers {
+		flexible = MaxWorkers
+	}
+	return append(legacyOptions(isAES), WithWorkers(flexible))
+}
@@ -0,0 +1,62 @@
+package ipfsKeystoneTest
+
+import (
+	"fmt"
+	"io"
+)
+
+// plainInput 是加密输入的环形缓冲区：goroutine 从调用方的 io.Reader 读出明文写入缓冲区，
+// enclave 一侧通过 Read 取出。读得慢的 enclave 通过缓冲区写满阻塞 io.Reader
+type plainInput struct {
+	rb *ringBuffer
+}
+
+// newPlainInput 开始从 r 读取明文。size 大于 0 时检查 r 的长度正好是 size，
+// 不一致时 Read 在数据取完后返回 ErrSourceLength
+func newPlainInput(r io.Reader, size int64) *plainInput {
+	in := &plainInput{rb: newRingBuffer(DefaultBlockSize)}
+
+	go func() {
+		var got int64
+		buf := make([]byte, DefaultBlockSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				got += int64(n)
+				if size > 0 && got > size {
+					in.rb.fail(fmt.Errorf("%w: source is longer than %d bytes", ErrSourceLength, size))
+					return
+				}
+				if _, werr := in.rb.write(buf[:n]); werr != nil {
+					return // enclave 一侧已经关闭
+				}
+			}
+			if err == io.EOF {
+				if size > 0 && got < size {
+					in.rb.fail(fmt.Errorf("%w: source has %d of %d bytes", ErrSourceLength, got, size))
+					return
+				}
+				in.rb.stop()
+				return
+			}
+			if err != nil {
+				in.rb.fail(err)
+				return
+			}
+		}
+	}()
+
+	return in
+}
+
+// Read 由 enclave 一侧调用，明文读完时返回 io.EOF，io.Reader 出错时返回它的错误
+func (in *plainInput) Read(p []byte) (int, error) {
+	return in.rb.read(p)
+}
+
+// Close 停止缓冲区。goroutine 可能阻塞在 io.Reader 的 Read 中，Close 不等它返回，
+// 它在 Read 返回之后发现缓冲区已经停止就结束
+func (in *plainInput) Close() error {
+	in.rb.fail(ErrBufferStopped)
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package ipfsKeystoneTest
+
+import (
+	"errors"
+	"io"
+)
+
+// inputFifo 需要命名管道，其他平台不支持把 io.Reader 交给只会按路径读取的 enclave
+type inputFifo struct{}
+
+func newInputFifo(r io.Reader, size int64) (*inputFifo, error) {
+	return nil, errors.New("encrypting from an io.Reader needs named pipes")
+}
+
+func (f *inputFifo) Path() string { return "" }
+
+func (f *inputFifo) Err() error { return nil }
+
+func (f *inputFifo) Stop() {}
+
+func (f *inputFifo) Close() error { return nil }
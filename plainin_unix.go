@@ -0,0 +1,94 @@
+//go:build unix
+
+package ipfsKeystoneTest
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// inputFifo 让只会按路径读明文的 enclave 从命名管道读取，goroutine 把 plainInput 中的明文
+// 写进管道，写完后关闭写端，enclave 读到文件结束
+type inputFifo struct {
+	dir  string
+	path string
+	w    *os.File // 管道的写端
+	keep *os.File // 保持管道有一个读端，enclave 还没有打开管道时打开写端和写入都不会失败
+	in   *plainInput
+	done chan struct{} // 写管道的 goroutine 结束
+	mu   sync.Mutex
+	err  error // io.Reader 或管道返回的错误
+}
+
+func newInputFifo(r io.Reader, size int64) (*inputFifo, error) {
+	dir, err := os.MkdirTemp("", "ipfs-keystone-input-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "plaintext")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+
+	// 非阻塞打开读端不需要等待写端，之后打开写端也不会阻塞
+	keep, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	w, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		keep.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	f := &inputFifo{
+		dir:  dir,
+		path: path,
+		w:    w,
+		keep: keep,
+		in:   newPlainInput(r, size),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(f.done)
+		_, err := io.Copy(w, f.in)
+		f.mu.Lock()
+		f.err = err
+		f.mu.Unlock()
+		// 关闭写端之后 enclave 读到文件结束，错误在这之前记录
+		w.Close()
+	}()
+
+	return f, nil
+}
+
+// Path 返回交给 enclave 的源文件路径
+func (f *inputFifo) Path() string { return f.path }
+
+// Err 返回 io.Reader 的错误。enclave 读到文件结束之后调用，明文不完整时不为 nil
+func (f *inputFifo) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Stop 停止读取 io.Reader，管道中剩余的明文读完之后 enclave 读到文件结束
+func (f *inputFifo) Stop() { f.in.Close() }
+
+// Close 在 enclave 返回之后调用：停止读取 io.Reader，关闭管道的两端让写管道的 goroutine 返回，
+// 然后删除管道
+func (f *inputFifo) Close() error {
+	f.Stop()
+	f.w.Close()
+	<-f.done
+	f.keep.Close()
+	os.RemoveAll(f.dir)
+	return nil
+}
@@ -0,0 +1,58 @@
+package ipfsKeystoneTest
+
+import (
+	"io"
+)
+
+// plainOutput 是解密输出的第二个环形缓冲区：enclave 一侧写入明文，drain goroutine 取出后
+// 写到调用方的 io.Writer。明文只经过内存，写得慢的 io.Writer 通过缓冲区写满阻塞 enclave
+type plainOutput struct {
+	rb   *ringBuffer
+	done chan struct{} // drain goroutine 结束
+	err  error         // io.Writer 返回的错误，done 关闭后可读
+}
+
+func newPlainOutput(w io.Writer) *plainOutput {
+	o := &plainOutput{
+		rb:   newRingBuffer(DefaultBlockSize),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(o.done)
+		buf := make([]byte, DefaultBlockSize)
+		for {
+			n, err := o.rb.read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					o.err = werr
+					o.rb.fail(werr) // enclave 一侧的写入返回错误
+					return
+				}
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				if err != ErrBufferStopped {
+					o.err = err
+				}
+				return
+			}
+		}
+	}()
+
+	return o
+}
+
+// Write 由 enclave 一侧调用，缓冲区满时阻塞。io.Writer 出错之后返回 ErrBufferStopped
+func (o *plainOutput) Write(p []byte) (int, error) {
+	return o.rb.write(p)
+}
+
+// Close 表示明文已经全部写入，等 drain goroutine 把剩余的明文写完，返回 io.Writer 的错误
+func (o *plainOutput) Close() error {
+	o.rb.stop()
+	<-o.done
+	return o.err
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package ipfsKeystoneTest
+
+import (
+	"errors"
+	"io"
+)
+
+// plainFifo 需要命名管道，其他平台不支持把 enclave 的明文交给 io.Writer
+type plainFifo struct{}
+
+func newPlainFifo(w io.Writer) (*plainFifo, error) {
+	return nil, errors.New("decrypting to an io.Writer needs named pipes")
+}
+
+func (p *plainFifo) Path() string { return "" }
+
+func (p *plainFifo) Close() error { return nil }
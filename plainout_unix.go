@@ -0,0 +1,79 @@
+//go:build unix
+
+package ipfsKeystoneTest
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// plainFifo 让只会按路径写明文的 enclave 把明文写进命名管道，goroutine 从管道读出后交给
+// plainOutput。管道的数据只在内核缓冲区中，不会写到磁盘
+type plainFifo struct {
+	dir  string
+	path string
+	r    *os.File // 管道的读端
+	keep *os.File // 保持管道有一个写端，enclave 还没有打开或者已经关闭管道时读端都不会读到 EOF
+	out  *plainOutput
+	done chan struct{} // 读管道的 goroutine 结束
+}
+
+func newPlainFifo(w io.Writer) (*plainFifo, error) {
+	dir, err := os.MkdirTemp("", "ipfs-keystone-plain-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "plaintext")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+
+	// 非阻塞打开读端不需要等待写端，之后打开写端也不会阻塞
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	keep, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	p := &plainFifo{
+		dir:  dir,
+		path: path,
+		r:    r,
+		keep: keep,
+		out:  newPlainOutput(w),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+		if _, err := io.Copy(p.out, r); err != nil {
+			// io.Writer 出错之后继续读空管道，enclave 不会阻塞在写满的管道上
+			io.Copy(io.Discard, r)
+		}
+	}()
+
+	return p, nil
+}
+
+// Path 返回交给 enclave 的输出路径
+func (p *plainFifo) Path() string { return p.path }
+
+// Close 在 enclave 返回之后调用：关闭保留的写端，等管道中的明文读完并写到 io.Writer，
+// 删除管道，返回 io.Writer 的错误
+func (p *plainFifo) Close() error {
+	p.keep.Close()
+	<-p.done
+	p.r.Close()
+	err := p.out.Close()
+	os.RemoveAll(p.dir)
+	return err
+}
@@ -0,0 +1,338 @@
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ==================================================================================
+//				Random-access Keystone Decrypt
+// ==================================================================================
+
+// 密文按 DefaultBlockSize 分块，每块单独加密，长度与明文相同，第 i 块的明文只取决于第 i 块的密文。
+// DecryptReaderAt 只解密覆盖读取范围的块：连续的未缓存块交给单个 enclave 一次解密，
+// 明文通过 Request.Sink 回到内存，最近使用的块留在缓存中，HTTP Range 请求和视频拖动不需要解密整个文件。
+// CipherAESGCM 的每一帧对应一块，DecryptReaderAt 自己验证读到的帧，再把帧的内容交给 enclave
+
+// DecryptReaderAt 随机读取密文对应的明文，实现 io.ReaderAt、io.ReadSeeker 和 io.Closer。
+// ReadAt 可以并发调用，Read 和 Seek 共用一个读取位置
+type DecryptReaderAt struct {
+	src     io.ReaderAt // 密文
+	base    int64       // 信封头的长度，帧从这里开始
+	srcSize int64       // 不含信封头的密文长度
+	size    int64       // 明文长度，不使用 CipherAESGCM 时与密文长度相同
+	aead    *blockAEAD  // CipherAESGCM 时验证帧，否则为 nil
+	b       Backend
+	req     Request
+	mu      sync.Mutex // 保护 cache 和 closed，解密时也持有，同一时间只有一个 enclave
+	cache   *blockCache
+	run     int64 // 一次交给 enclave 的最多块数，等于缓存的块数
+	pos     int64 // Read 和 Seek 的位置
+	posMu   sync.Mutex
+	closed  bool
+}
+
+// NewDecryptReaderAt 返回从 src 随机读取明文的 DecryptReaderAt，size 是密文长度
+func NewDecryptReaderAt(src io.ReaderAt, size int64, opts ...Option) (*DecryptReaderAt, error) {
+	if src == nil {
+		return nil, fmt.Errorf("%w: nil ciphertext reader", ErrInvalidOptions)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("%w: size %d", ErrInvalidOptions, size)
+	}
+	o := applyOptions(opts)
+	if o.Sink != nil || o.Output != "" {
+		return nil, fmt.Errorf("%w: DecryptReaderAt returns the plaintext itself", ErrInvalidOptions)
+	}
+	b, req, err := newRequest(ModeSingle, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &DecryptReaderAt{src: src, srcSize: size, size: size, b: b, req: req}
+	if ab, ok := b.(*aeadBackend); ok {
+		plain, err := ab.plainSize(size)
+		if err != nil {
+			return nil, err
+		}
+		r.size, r.aead, r.b = plain, ab.a, ab.Backend
+		if ab.km != nil {
+			h := make([]byte, EnvelopeHeaderSize)
+			if n, err := src.ReadAt(h, 0); n < len(h) {
+				if err == nil || errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, fmt.Errorf("read envelope header: %w", err)
+			}
+			if r.aead, err = openEnvelope(ab.km, h); err != nil {
+				return nil, err
+			}
+			r.base = EnvelopeHeaderSize
+			r.srcSize = size - EnvelopeHeaderSize
+		}
+	}
+
+	n := o.CacheBlocks
+	if n == 0 {
+		n = DefaultCacheBlocks
+	}
+	r.cache = newBlockCache(n)
+	r.run = int64(n)
+	return r, nil
+}
+
+// Size 返回明文长度
+func (r *DecryptReaderAt) Size() int64 { return r.size }
+
+// ReadAt 实现 io.ReaderAt
+func (r *DecryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext 与 ReadAt 相同，ctx 结束时停止正在解密的 enclave 并返回 ctx 的错误
+func (r *DecryptReaderAt) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("ipfs-keystone: negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+	if end == off {
+		return 0, nil
+	}
+
+	// 每次最多处理 r.run 块，复制到 p 之后再处理后面的块，
+	// 大的读取不会把整个范围的密文和明文同时放在内存中
+	n := 0
+	for first := off / DefaultBlockSize; off+int64(n) < end; first += r.run {
+		last := min(first+r.run-1, (end-1)/DefaultBlockSize)
+		blocks, err := r.blocks(ctx, first, last)
+		if err != nil {
+			return n, err
+		}
+		for i, b := range blocks {
+			start := off + int64(n) - (first+int64(i))*DefaultBlockSize
+			n += copy(p[n:], b[start:])
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// blocks 返回第 first 到 last 块的明文，没有缓存的连续块一起解密
+func (r *DecryptReaderAt) blocks(ctx context.Context, first, last int64) ([][]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrBufferStopped
+	}
+
+	out := make([][]byte, last-first+1)
+	for i := first; i <= last; {
+		if b, ok := r.cache.get(i); ok {
+			out[i-first] = b
+			i++
+			continue
+		}
+		j := i
+		for j < last {
+			if _, ok := r.cache.peek(j + 1); ok {
+				break
+			}
+			j++
+		}
+		run, err := r.decryptRun(ctx, i, j)
+		if err != nil {
+			return nil, err
+		}
+		for k, b := range run {
+			out[i-first+int64(k)] = b
+			r.cache.put(i+int64(k), b)
+		}
+		i = j + 1
+	}
+	return out, nil
+}
+
+// decryptRun 读出第 first 到 last 块的密文，交给单个 enclave 解密，返回每一块的明文
+func (r *DecryptReaderAt) decryptRun(ctx context.Context, first, last int64) ([][]byte, error) {
+	blockSize := int64(DefaultBlockSize)
+	if r.aead != nil {
+		blockSize = AEADFrameSize
+	}
+	off := first * blockSize
+	end := (last + 1) * blockSize
+	if end > r.srcSize {
+		end = r.srcSize
+	}
+	ct := make([]byte, end-off)
+	if n, err := r.src.ReadAt(ct, r.base+off); n < len(ct) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read ciphertext at %d: %w", r.base+off+int64(n), err)
+	}
+	if r.aead != nil {
+		var err error
+		if ct, err = r.openFrames(ct, first); err != nil {
+			return nil, err
+		}
+	}
+
+	var pt bytes.Buffer
+	pt.Grow(len(ct))
+	req := r.req
+	req.Sink = &pt
+	req.FirstBlock = first
+	req.Size = int64(len(ct))
+
+	st, err := r.b.OpenDecrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	s := newCtxStream(st)
+	_, err = s.WriteContext(ctx, ct)
+	if werr := s.WaitDone(); err == nil {
+		err = werr
+	}
+	s.Close()
+	if err != nil {
+		return nil, err
+	}
+	if pt.Len() != len(ct) {
+		return nil, fmt.Errorf("%w: decrypted %d of %d bytes at block %d", ErrEnclaveAborted, pt.Len(), len(ct), first)
+	}
+
+	plain := pt.Bytes()
+	run := make([][]byte, 0, last-first+1)
+	for len(plain) > 0 {
+		n := min(len(plain), DefaultBlockSize)
+		run = append(run, plain[:n:n])
+		plain = plain[n:]
+	}
+	return run, nil
+}
+
+// openFrames 验证从第 first 块开始的帧，返回帧的内容
+func (r *DecryptReaderAt) openFrames(frames []byte, first int64) ([]byte, error) {
+	lastBlock := aeadBlockCount(r.srcSize) - 1
+	out := make([]byte, 0, len(frames))
+	for i := first; len(frames) > 0; i++ {
+		n := min(len(frames), AEADFrameSize)
+		var err error
+		if out, err = r.aead.open(out, i, i == lastBlock, frames[:n]); err != nil {
+			return nil, err
+		}
+		frames = frames[n:]
+	}
+	return out, nil
+}
+
+// Read 实现 io.Reader，从当前位置读取
+func (r *DecryptReaderAt) Read(p []byte) (int, error) {
+	r.posMu.Lock()
+	defer r.posMu.Unlock()
+
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek 实现 io.Seeker，可以移动到明文末尾之后，之后的 Read 返回 io.EOF
+func (r *DecryptReaderAt) Seek(offset int64, whence int) (int64, error) {
+	r.posMu.Lock()
+	defer r.posMu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("ipfs-keystone: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("ipfs-keystone: negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close 丢弃缓存的明文，之后的读取返回 ErrBufferStopped。不关闭 src
+func (r *DecryptReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	r.cache = newBlockCache(0)
+	return nil
+}
+
+// blockCache 按最近使用的顺序保留 max 个明文块
+type blockCache struct {
+	max   int
+	order *list.List // 元素是 *cachedBlock，最近使用的在前面
+	items map[int64]*list.Element
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+func newBlockCache(max int) *blockCache {
+	return &blockCache{max: max, order: list.New(), items: make(map[int64]*list.Element)}
+}
+
+// get 返回第 i 块并标记为最近使用
+func (c *blockCache) get(i int64) ([]byte, bool) {
+	e, ok := c.items[i]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBlock).data, true
+}
+
+// peek 返回第 i 块，不改变使用顺序
+func (c *blockCache) peek(i int64) ([]byte, bool) {
+	e, ok := c.items[i]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*cachedBlock).data, true
+}
+
+// put 放入第 i 块，超过 max 时丢弃最久没有使用的块
+func (c *blockCache) put(i int64, b []byte) {
+	if c.max <= 0 {
+		return
+	}
+	if e, ok := c.items[i]; ok {
+		e.Value.(*cachedBlock).data = b
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[i] = c.order.PushFront(&cachedBlock{index: i, data: b})
+	for c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*cachedBlock).index)
+	}
+}
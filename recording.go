@@ -0,0 +1,379 @@
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Op 是录制事件的类型，对应 Stream 的各个方法
+type Op string
+
+const (
+	OpReadBlock  Op = "read"
+	OpWriteBlock Op = "write"
+	OpWaitReady  Op = "wait_ready"
+	OpWaitDone   Op = "wait_done"
+	OpClose      Op = "close"
+)
+
+// Event 是一次 Stream 调用及其结果
+type Event struct {
+	Op   Op
+	Data []byte `json:",omitempty"` // ReadBlock 读到的数据，WriteBlock 写入的数据
+	N    int    `json:",omitempty"`
+	Err  string `json:",omitempty"` // io.EOF 记录为 "EOF"
+}
+
+// RecordedStream 是一条数据流上依次发生的调用
+type RecordedStream struct {
+	Request Request
+	Decrypt bool
+	Events  []Event
+}
+
+// Recording 按打开顺序保存 RecordingBackend 创建的数据流，包括会话中的每个文件
+type Recording struct {
+	mu      sync.Mutex
+	Streams []*RecordedStream
+}
+
+// Save 把录制结果以 JSON 写入 w
+func (rec *Recording) Save(w io.Writer) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return json.NewEncoder(w).Encode(rec.Streams)
+}
+
+// LoadRecording 读取 Save 写出的录制结果
+func LoadRecording(r io.Reader) (*Recording, error) {
+	rec := &Recording{}
+	if err := json.NewDecoder(r).Decode(&rec.Streams); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *Recording) add(req Request, decrypt bool) *RecordedStream {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rs := &RecordedStream{Request: req, Decrypt: decrypt}
+	rec.Streams = append(rec.Streams, rs)
+	return rs
+}
+
+func (rec *Recording) event(rs *RecordedStream, ev Event) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rs.Events = append(rs.Events, ev)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// stringErr 还原录制的错误，包装了哨兵错误的仍然可以用 errors.Is 判断
+func stringErr(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, e := range []error{io.EOF, ErrEnclaveAborted, ErrIntegrity, ErrBufferStopped, ErrTimeout, ErrShmCreate, ErrChildStart} {
+		if s == e.Error() {
+			return e
+		}
+		if rest, ok := strings.CutPrefix(s, e.Error()+":"); ok {
+			return fmt.Errorf("%w:%s", e, rest)
+		}
+	}
+	return errors.New(s)
+}
+
+// ==================================================================================
+//				Recording backend
+// ==================================================================================
+
+// RecordingBackend 把调用转发给 Backend，并把每条数据流的调用和结果记录到 Recording
+type RecordingBackend struct {
+	Backend   Backend
+	Recording *Recording
+}
+
+// NewRecordingBackend 创建一个录制 b 的后端
+func NewRecordingBackend(b Backend) *RecordingBackend {
+	return &RecordingBackend{Backend: b, Recording: &Recording{}}
+}
+
+func (b *RecordingBackend) wrap(s Stream, req Request, decrypt bool) Stream {
+	return &recordingStream{s: s, rec: b.Recording, rs: b.Recording.add(req, decrypt)}
+}
+
+func (b *RecordingBackend) OpenEncrypt(req Request) (Stream, error) {
+	s, err := b.Backend.OpenEncrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	return b.wrap(s, req, false), nil
+}
+
+func (b *RecordingBackend) OpenDecrypt(req Request) (Stream, error) {
+	s, err := b.Backend.OpenDecrypt(req)
+	if err != nil {
+		return nil, err
+	}
+	return b.wrap(s, req, true), nil
+}
+
+func (b *RecordingBackend) OpenEncryptSession(req Request) (Session, error) {
+	ss, err := b.Backend.OpenEncryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingSession{ss: ss, b: b, req: req}, nil
+}
+
+func (b *RecordingBackend) OpenDecryptSession(req Request) (Session, error) {
+	ss, err := b.Backend.OpenDecryptSession(req)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingSession{ss: ss, b: b, req: req}, nil
+}
+
+type recordingSession struct {
+	ss  Session
+	b   *RecordingBackend
+	req Request
+}
+
+func (ss *recordingSession) WaitReady() error { return ss.ss.WaitReady() }
+
+func (ss *recordingSession) NextEncrypt(path string, size int64) (Stream, error) {
+	s, err := ss.ss.NextEncrypt(path, size)
+	if err != nil || s == nil {
+		return s, err
+	}
+	req := ss.req
+	req.Path = path
+	req.Size = size
+	return ss.b.wrap(s, req, false), nil
+}
+
+func (ss *recordingSession) NextDecrypt(size uint64) (Stream, error) {
+	s, err := ss.ss.NextDecrypt(size)
+	if err != nil || s == nil {
+		return s, err
+	}
+	req := ss.req
+	req.Size = int64(size)
+	return ss.b.wrap(s, req, true), nil
+}
+
+func (ss *recordingSession) End() error { return ss.ss.End() }
+
+func (ss *recordingSession) Abort() error { return ss.ss.Abort() }
+
+func (ss *recordingSession) Workers() []WorkerStatus { return sessionWorkers(ss.ss) }
+
+type recordingStream struct {
+	s   Stream
+	rec *Recording
+	rs  *RecordedStream
+}
+
+func (s *recordingStream) ReadBlock(p []byte) (int, error) {
+	n, err := s.s.ReadBlock(p)
+	s.rec.event(s.rs, Event{Op: OpReadBlock, Data: append([]byte(nil), p[:n]...), N: n, Err: errString(err)})
+	return n, err
+}
+
+func (s *recordingStream) WriteBlock(p []byte) (int, error) {
+	n, err := s.s.WriteBlock(p)
+	s.rec.event(s.rs, Event{Op: OpWriteBlock, Data: append([]byte(nil), p...), N: n, Err: errString(err)})
+	return n, err
+}
+
+func (s *recordingStream) WaitReady() error {
+	err := s.s.WaitReady()
+	s.rec.event(s.rs, Event{Op: OpWaitReady, Err: errString(err)})
+	return err
+}
+
+func (s *recordingStream) WaitDone() error {
+	err := s.s.WaitDone()
+	s.rec.event(s.rs, Event{Op: OpWaitDone, Err: errString(err)})
+	return err
+}
+
+// Abort 由取消触发，不记录，回放时取消同样只影响调用方
+func (s *recordingStream) Abort() error { return s.s.Abort() }
+
+func (s *recordingStream) Workers() []WorkerStatus {
+	if m, ok := s.s.(workerMonitor); ok {
+		return m.Workers()
+	}
+	return nil
+}
+
+func (s *recordingStream) Crashed() <-chan struct{} {
+	if m, ok := s.s.(workerMonitor); ok {
+		return m.Crashed()
+	}
+	return nil
+}
+
+func (s *recordingStream) CrashErr() error {
+	if m, ok := s.s.(workerMonitor); ok {
+		return m.CrashErr()
+	}
+	return nil
+}
+
+func (s *recordingStream) Close() error {
+	err := s.s.Close()
+	s.rec.event(s.rs, Event{Op: OpClose, Err: errString(err)})
+	return err
+}
+
+// ==================================================================================
+//				Replay backend
+// ==================================================================================
+
+// ReplayBackend 按打开顺序回放 Recording 中的数据流，不需要 enclave。
+// ReadBlock 返回录制时读到的数据，WriteBlock 返回录制时的结果
+type ReplayBackend struct {
+	mu        sync.Mutex
+	Recording *Recording
+	next      int
+}
+
+// NewReplayBackend 创建一个回放 rec 的后端
+func NewReplayBackend(rec *Recording) *ReplayBackend {
+	return &ReplayBackend{Recording: rec}
+}
+
+func (b *ReplayBackend) pop(decrypt bool) (Stream, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.next >= len(b.Recording.Streams) {
+		return nil, fmt.Errorf("replay: no more recorded streams")
+	}
+	rs := b.Recording.Streams[b.next]
+	if rs.Decrypt != decrypt {
+		return nil, fmt.Errorf("replay: stream %d was recorded with decrypt=%v", b.next, rs.Decrypt)
+	}
+	b.next++
+	return &replayStream{rs: rs}, nil
+}
+
+func (b *ReplayBackend) OpenEncrypt(req Request) (Stream, error) {
+	return b.pop(false)
+}
+
+func (b *ReplayBackend) OpenDecrypt(req Request) (Stream, error) {
+	return b.pop(true)
+}
+
+func (b *ReplayBackend) OpenEncryptSession(req Request) (Session, error) {
+	return &replaySession{b: b}, nil
+}
+
+func (b *ReplayBackend) OpenDecryptSession(req Request) (Session, error) {
+	return &replaySession{b: b}, nil
+}
+
+type replaySession struct {
+	b *ReplayBackend
+}
+
+func (ss *replaySession) WaitReady() error { return nil }
+
+func (ss *replaySession) NextEncrypt(path string, size int64) (Stream, error) {
+	return ss.b.pop(false)
+}
+
+func (ss *replaySession) NextDecrypt(size uint64) (Stream, error) {
+	return ss.b.pop(true)
+}
+
+func (ss *replaySession) End() error { return nil }
+
+func (ss *replaySession) Abort() error { return nil }
+
+type replayStream struct {
+	rs         *RecordedStream
+	next       int
+	pending    []byte // 上一次 ReadBlock 没有取完的数据
+	pendingErr error  // 录制时和 pending 一起返回的错误，pending 取完时返回
+}
+
+// expect 取出下一个事件，数据类的调用顺序必须与录制时一致
+func (s *replayStream) expect(op Op) (Event, error) {
+	if s.next >= len(s.rs.Events) {
+		return Event{}, fmt.Errorf("replay: unexpected %s after end of recording", op)
+	}
+	ev := s.rs.Events[s.next]
+	if ev.Op != op {
+		return Event{}, fmt.Errorf("replay: unexpected %s, recording has %s", op, ev.Op)
+	}
+	s.next++
+	return ev, nil
+}
+
+// lifecycle 回放 WaitReady、WaitDone、Close，录制中没有对应事件时直接返回 nil
+func (s *replayStream) lifecycle(op Op) error {
+	if s.next < len(s.rs.Events) && s.rs.Events[s.next].Op == op {
+		ev := s.rs.Events[s.next]
+		s.next++
+		return stringErr(ev.Err)
+	}
+	return nil
+}
+
+func (s *replayStream) ReadBlock(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		ev, err := s.expect(OpReadBlock)
+		if err != nil {
+			return 0, err
+		}
+		if len(ev.Data) == 0 {
+			return 0, stringErr(ev.Err)
+		}
+		s.pending, s.pendingErr = ev.Data, stringErr(ev.Err)
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	if len(s.pending) == 0 {
+		err := s.pendingErr
+		s.pendingErr = nil
+		return n, err
+	}
+	return n, nil
+}
+
+// WriteBlock 回放写入，写入的数据必须与录制时相同
+func (s *replayStream) WriteBlock(p []byte) (int, error) {
+	ev, err := s.expect(OpWriteBlock)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(p, ev.Data) {
+		return 0, fmt.Errorf("replay: event %d: wrote %d bytes that differ from the %d recorded", s.next-1, len(p), len(ev.Data))
+	}
+	return ev.N, stringErr(ev.Err)
+}
+
+func (s *replayStream) WaitReady() error { return s.lifecycle(OpWaitReady) }
+
+func (s *replayStream) WaitDone() error { return s.lifecycle(OpWaitDone) }
+
+func (s *replayStream) Abort() error { return nil }
+
+func (s *replayStream) Close() error { return s.lifecycle(OpClose) }
@@ -0,0 +1,126 @@
+//go:build !keystone
+
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// saveLoad 保存再读回录制结果，和写到文件再读取一样
+func saveLoad(t *testing.T, rec *Recording) *Recording {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := rec.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRecording(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+func TestRecordingWithSink(t *testing.T) {
+	_, ct := aeadEncrypt(t, DefaultBlockSize+9)
+
+	rec := NewRecordingBackend(SimBackend{})
+	var pt bytes.Buffer
+	w, err := NewDecryptWriterTo(&pt, WithCipher(CipherAESGCM), WithKey(testKey), WithBackend(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(w, ct); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := saveLoad(t, rec.Recording)
+	w, err = NewDecryptWriterTo(&bytes.Buffer{}, WithCipher(CipherAESGCM), WithKey(testKey), WithBackend(NewReplayBackend(loaded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeAll(w, ct); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+}
+
+func TestRecordingWithSource(t *testing.T) {
+	data := bytes.Repeat([]byte("ipfs-keystone"), 30000)
+
+	rec := NewRecordingBackend(SimBackend{})
+	r, err := EncryptStream(bytes.NewReader(data), WithCipher(CipherAES), WithBackend(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := saveLoad(t, rec.Recording)
+	r, err = EncryptStream(bytes.NewReader(data), WithCipher(CipherAES), WithBackend(NewReplayBackend(loaded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if !bytes.Equal(got, ct) {
+		t.Fatal("replayed ciphertext differs")
+	}
+}
+
+func TestReplayDataWithError(t *testing.T) {
+	rec := &Recording{Streams: []*RecordedStream{
+		{Events: []Event{
+			{Op: OpReadBlock, Data: []byte("hello"), N: 5, Err: "EOF"},
+			{Op: OpClose},
+		}},
+		{Decrypt: true, Events: []Event{
+			{Op: OpWriteBlock, Data: []byte("abc"), N: 3},
+			{Op: OpWriteBlock, Data: []byte("def"), N: 2, Err: ErrBufferStopped.Error()},
+		}},
+	}}
+	b := NewReplayBackend(saveLoad(t, rec))
+
+	s, err := b.OpenEncrypt(Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 3)
+	if n, err := s.ReadBlock(p); n != 3 || err != nil {
+		t.Fatalf("first read: %d, %v", n, err)
+	}
+	if n, err := s.ReadBlock(p); n != 2 || err != io.EOF || string(p[:n]) != "lo" {
+		t.Fatalf("last read: %d, %v", n, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = b.OpenDecrypt(Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.WriteBlock([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("first write: %d, %v", n, err)
+	}
+	if n, err := s.WriteBlock([]byte("def")); n != 2 || !errors.Is(err, ErrBufferStopped) {
+		t.Fatalf("second write: %d, %v", n, err)
+	}
+
+	b = NewReplayBackend(rec)
+	b.OpenEncrypt(Request{})
+	s, err = b.OpenDecrypt(Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteBlock([]byte("abd")); err == nil {
+		t.Fatal("write that differs from the recording succeeded")
+	}
+}
@@ -0,0 +1,406 @@
+package ipfsKeystoneTest
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ==================================================================================
+//				Master Key Rewrap
+// ==================================================================================
+
+// Rewrap 用 km 的当前主密钥重新包装 f 开头信封头中的数据密钥，只改写信封头，帧不变。
+// 信封头的长度固定，原地写回。已经使用当前主密钥时不写入，返回 false
+func Rewrap(km KeyRotator, f interface {
+	io.ReaderAt
+	io.WriterAt
+}) (bool, error) {
+	h := make([]byte, EnvelopeHeaderSize)
+	if n, err := f.ReadAt(h, 0); n < len(h) {
+		if err == nil || errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, fmt.Errorf("read envelope header: %w", err)
+	}
+	keyID, wrapped, err := parseEnvelope(h)
+	if err != nil {
+		return false, err
+	}
+	if keyID == km.CurrentKeyID() {
+		return false, nil
+	}
+
+	key, err := km.UnwrapDataKey(keyID, wrapped)
+	if err != nil {
+		return false, err
+	}
+	wrapped, newID, err := km.WrapDataKey(key)
+	if err != nil {
+		return false, err
+	}
+	if newID == keyID {
+		return false, nil
+	}
+	nh, err := encodeEnvelope(newID, wrapped)
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.WriteAt(nh, 0); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RewrapFile 对文件 path 执行 Rewrap 并同步到磁盘。信封头只有 256 字节，在一个扇区之内，
+// 写到一半崩溃的概率很小；需要保证时先复制文件
+func RewrapFile(km KeyRotator, path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	changed, err := Rewrap(km, f)
+	if err == nil && changed {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return changed, err
+}
+
+// ==================================================================================
+//				Re-encrypt Job
+// ==================================================================================
+
+// ReencryptStore 是重新加密任务读写密文的地方，名字可以是文件路径，也可以是 IPFS 的 CID
+type ReencryptStore interface {
+	// Open 返回 name 的密文和长度，长度未知时为 0
+	Open(name string) (io.ReadCloser, int64, error)
+	// Replace 保存从 r 读出的新密文，返回新的名字（CID 会变化，文件路径通常不变）。
+	// r 返回错误时不能替换原来的内容
+	Replace(name string, r io.Reader) (string, error)
+}
+
+// ReencryptProgress 在每一项处理完或者跳过之后报告给 ReencryptJob.Progress
+type ReencryptProgress struct {
+	Name    string
+	NewName string
+	Index   int   // 这一项在 Names 中的位置
+	Total   int   // Names 的长度
+	Done    int   // 已经完成的项数，包括以前运行时完成的
+	Skipped bool  // 检查点中已经完成，这次没有处理
+	Bytes   int64 // 新密文的长度
+	Err     error
+}
+
+// ReencryptJob 把 Names 中的每一项依次经过单 enclave 解密，再经过 EncryptStream 加密，
+// 明文只在两个 enclave 之间的管道中。用来在 Rotate 之后为每个文件换新的数据密钥，
+// 或者从 CipherAES 迁移到 CipherAESGCM。
+//
+// 设置了 Checkpoint 时，每完成一项就把它追加到这个文件并同步，再次运行时跳过已经完成的项，
+// 中断的任务可以继续；正在处理的一项从头开始。Store.Replace 读到新密文结束之前，先在检查点中
+// 写入这一项旧密文的 SHA-256；在 Replace 之后、完成记录之前中断时，再次运行发现内容已经不是
+// 旧密文，直接记为完成，不会用 DecryptOptions 解密新密文
+type ReencryptJob struct {
+	Store          ReencryptStore
+	Names          []string
+	DecryptOptions []Option // 读旧密文的选项，不需要 WithSize
+	EncryptOptions []Option // 写新密文的选项
+	Checkpoint     string   // 检查点文件，为空时不能继续中断的任务
+	// ContinueOnError 为 true 时出错的项不写入检查点，继续处理下一项，Run 最后返回所有错误
+	ContinueOnError bool
+	Progress        func(ReencryptProgress)
+}
+
+// checkpointEntry 是检查点文件中的一行。OldSum 不为空的是 Replace 之前写入的意图记录
+type checkpointEntry struct {
+	Name    string `json:"name"`
+	NewName string `json:"new_name"`
+	OldSum  string `json:"old_sha256,omitempty"` // 旧密文的 SHA-256
+}
+
+// Run 执行任务，ctx 结束时停止正在处理的 enclave 并返回 ctx 的错误
+func (j *ReencryptJob) Run(ctx context.Context) error {
+	if j.Store == nil {
+		return fmt.Errorf("%w: nil re-encrypt store", ErrInvalidOptions)
+	}
+	done, intents, err := loadCheckpoint(j.Checkpoint)
+	if err != nil {
+		return err
+	}
+	var cp *os.File
+	if j.Checkpoint != "" {
+		if cp, err = os.OpenFile(j.Checkpoint, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+		defer cp.Close()
+	}
+
+	var errs []error
+	count := 0
+	for i, name := range j.Names {
+		p := ReencryptProgress{Name: name, Index: i, Total: len(j.Names)}
+		if newName, ok := done[name]; ok {
+			count++
+			p.NewName, p.Done, p.Skipped = newName, count, true
+			j.report(p)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, ctxError(ctx))...)
+		}
+
+		if sum, ok := intents[name]; ok {
+			// 上次运行在替换这一项时中断，内容已经变化说明 Replace 已经完成
+			replaced, err := j.replaced(name, sum)
+			if err == nil && replaced {
+				if err = appendCheckpoint(cp, checkpointEntry{Name: name, NewName: name}); err == nil {
+					count++
+					p.NewName, p.Done, p.Skipped = name, count, true
+					j.report(p)
+					continue
+				}
+			}
+			p.Err = err
+		}
+
+		if p.Err == nil {
+			p.NewName, p.Bytes, p.Err = j.reencrypt(ctx, name, cp)
+		}
+		if p.Err == nil && cp != nil {
+			p.Err = appendCheckpoint(cp, checkpointEntry{Name: name, NewName: p.NewName})
+		}
+		if p.Err == nil {
+			count++
+		}
+		p.Done = count
+		j.report(p)
+
+		if p.Err != nil {
+			err := fmt.Errorf("re-encrypt %s: %w", name, p.Err)
+			if !j.ContinueOnError || ctx.Err() != nil {
+				return errors.Join(append(errs, err)...)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (j *ReencryptJob) report(p ReencryptProgress) {
+	if j.Progress != nil {
+		j.Progress(p)
+	}
+}
+
+// replaced 重新计算 name 的 SHA-256，与意图记录中的旧密文不同时返回 true。
+// 原位置替换的 Store（FileStore）替换之后内容变化；名字随内容变化的 Store（CID）
+// 用旧名字读到的仍然是旧密文，这一项重新处理
+func (j *ReencryptJob) replaced(name, oldSum string) (bool, error) {
+	src, _, err := j.Store.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, src); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) != oldSum, nil
+}
+
+// reencrypt 处理一项：goroutine 把旧密文写进 DecryptWriter，明文经过管道交给 EncryptStream，
+// 新密文由 Store.Replace 读出。任何一侧出错都会关闭管道，另一侧随之返回。
+// cp 不为 nil 时，新密文读完之后、Replace 读到 io.EOF 之前写入意图记录
+func (j *ReencryptJob) reencrypt(ctx context.Context, name string, cp *os.File) (string, int64, error) {
+	src, size, err := j.Store.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	pr, pw := io.Pipe()
+	dopts := j.DecryptOptions[:len(j.DecryptOptions):len(j.DecryptOptions)]
+	if size > 0 {
+		dopts = append(dopts, WithSize(size))
+	}
+	dw, err := NewDecryptWriterToContext(ctx, pw, dopts...)
+	if err != nil {
+		return "", 0, err
+	}
+
+	oldSum := sha256.New()
+	decDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(dw, io.TeeReader(src, oldSum))
+		if cerr := dw.Close(); err == nil {
+			err = cerr
+		}
+		// err 为 nil 时 EncryptStream 读到明文结束
+		pw.CloseWithError(err)
+		decDone <- err
+	}()
+
+	waitDec := sync.OnceValue(func() error { return <-decDone })
+
+	er, err := EncryptStreamContext(ctx, pr, j.EncryptOptions...)
+	if err != nil {
+		pr.CloseWithError(err)
+		waitDec()
+		return "", 0, err
+	}
+	cr := &commitReader{r: er, commit: func() error {
+		// 新密文读完时解密已经结束，旧密文的 SHA-256 完整
+		if err := waitDec(); err != nil {
+			return err
+		}
+		if cp == nil {
+			return nil
+		}
+		return appendCheckpoint(cp, checkpointEntry{Name: name, OldSum: hex.EncodeToString(oldSum.Sum(nil))})
+	}}
+	newName, err := j.Store.Replace(name, cr)
+	er.Close()
+	// Replace 提前返回时解密的一侧可能还在写管道
+	pr.CloseWithError(ErrBufferStopped)
+	if derr := waitDec(); err == nil {
+		err = derr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return newName, cr.n, nil
+}
+
+// commitReader 记录读出的字节数，r 结束时先执行 commit，成功之后才返回 io.EOF。
+// Store.Replace 读到 io.EOF 之前不会替换原来的内容
+type commitReader struct {
+	r      io.Reader
+	n      int64
+	commit func() error
+	err    error // commit 之后的结果
+}
+
+func (c *commitReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err == io.EOF {
+		if err = c.commit(); err == nil {
+			err = io.EOF
+		}
+		c.err = err
+	}
+	return n, err
+}
+
+// loadCheckpoint 读出检查点中已经完成的项，以及写了意图记录但没有完成的项和旧密文的 SHA-256。
+// 最后一行可能在崩溃时只写了一半，忽略它
+func loadCheckpoint(path string) (done, intents map[string]string, err error) {
+	done = make(map[string]string)
+	intents = make(map[string]string)
+	if path == "" {
+		return done, intents, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return done, intents, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e checkpointEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil || e.Name == "" {
+			continue
+		}
+		if e.OldSum != "" {
+			intents[e.Name] = e.OldSum
+			continue
+		}
+		done[e.Name] = e.NewName
+		delete(intents, e.Name)
+	}
+	return done, intents, sc.Err()
+}
+
+func appendCheckpoint(f *os.File, e checkpointEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// 前一次崩溃可能留下没有换行的半行，先换行，空行在读取时被忽略
+	if _, err := f.Write(append(append([]byte{'\n'}, b...), '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ==================================================================================
+//				File Store
+// ==================================================================================
+
+// FileStore 是文件的 ReencryptStore，名字是文件路径。新密文先写到同一目录下的临时文件，
+// 写完并同步之后改名替换原文件，失败时原文件不变
+type FileStore struct{}
+
+func (FileStore) Open(name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (FileStore) Replace(name string, r io.Reader) (string, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".reencrypt-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
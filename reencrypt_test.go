@@ -0,0 +1,106 @@
+//go:build !keystone
+
+package ipfsKeystoneTest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errCrash = errors.New("crash")
+
+// crashStore 在处理 name 时模拟进程崩溃：after 为 true 时在 Replace 完成之后，
+// 否则在读完新密文、还没有替换时
+type crashStore struct {
+	FileStore
+	name  string
+	after bool
+}
+
+func (s crashStore) Replace(name string, r io.Reader) (string, error) {
+	if name != s.name {
+		return s.FileStore.Replace(name, r)
+	}
+	if s.after {
+		s.FileStore.Replace(name, r)
+		return "", errCrash
+	}
+	io.Copy(io.Discard, r)
+	return "", errCrash
+}
+
+func TestReencryptResumeAfterCrash(t *testing.T) {
+	for _, after := range []bool{true, false} {
+		dir := t.TempDir()
+		var names []string
+		var plains [][]byte
+		for i := 0; i < 3; i++ {
+			path, data := writeTemp(t, (i+1)*DefaultBlockSize/2)
+			r, err := NewEncryptReader(path, WithCipher(CipherAES))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := filepath.Join(dir, string(rune('a'+i)))
+			if err := os.WriteFile(name, ct, 0600); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+			plains = append(plains, data)
+		}
+
+		j := &ReencryptJob{
+			Store:          crashStore{name: names[1], after: after},
+			Names:          names,
+			DecryptOptions: []Option{WithCipher(CipherAES)},
+			EncryptOptions: []Option{WithCipher(CipherAESGCM), WithKey(testKey)},
+			Checkpoint:     filepath.Join(dir, "checkpoint"),
+		}
+		if err := j.Run(context.Background()); !errors.Is(err, errCrash) {
+			t.Fatalf("after=%v: first run: %v", after, err)
+		}
+
+		var skipped []string
+		j.Store = FileStore{}
+		j.Progress = func(p ReencryptProgress) {
+			if p.Skipped {
+				skipped = append(skipped, p.Name)
+			}
+		}
+		if err := j.Run(context.Background()); err != nil {
+			t.Fatalf("after=%v: resumed run: %v", after, err)
+		}
+		// 已经替换的一项不能再用 CipherAES 解密
+		want := 1
+		if after {
+			want = 2
+		}
+		if len(skipped) != want {
+			t.Fatalf("after=%v: skipped %v", after, skipped)
+		}
+
+		for i, name := range names {
+			ct, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pt bytes.Buffer
+			w, err := NewDecryptWriterTo(&pt, WithCipher(CipherAESGCM), WithKey(testKey), WithSize(int64(len(ct))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writeAll(w, ct); err != nil || !bytes.Equal(pt.Bytes(), plains[i]) {
+				t.Fatalf("after=%v: %s: %v", after, name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package ipfsKeystoneTest
+
+import (
+	"io"
+	"sync"
+)
+
+// ringBuffer 是 C 语言 RingBuffer 的 Go 实现：单生产者单消费者，
+// 写满时阻塞写端，读空时阻塞读端，stop 之后读端取完剩余数据即结束
+type ringBuffer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	head    int   // 读位置
+	size    int   // 已有数据量
+	running bool  // 对应 C 结构中的 running
+	err     error // 生产者出错时记录，读端取完数据后返回
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	rb := &ringBuffer{buf: make([]byte, capacity), running: true}
+	rb.cond = sync.NewCond(&rb.mu)
+	return rb
+}
+
+// write 写入全部数据，缓冲区停止时返回已写入的长度和 ErrBufferStopped
+func (rb *ringBuffer) write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		for rb.running && rb.size == len(rb.buf) {
+			rb.cond.Wait()
+		}
+		if !rb.running {
+			return n, ErrBufferStopped
+		}
+		tail := (rb.head + rb.size) % len(rb.buf)
+		end := len(rb.buf)
+		if tail < rb.head {
+			end = rb.head
+		}
+		c := copy(rb.buf[tail:end], p[n:])
+		rb.size += c
+		n += c
+		rb.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// read 读取已有的数据，缓冲区停止且为空时返回 io.EOF
+func (rb *ringBuffer) read(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for rb.running && rb.size == 0 {
+		rb.cond.Wait()
+	}
+	if rb.size == 0 {
+		if rb.err != nil {
+			return 0, rb.err
+		}
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && rb.size > 0 {
+		end := rb.head + rb.size
+		if end > len(rb.buf) {
+			end = len(rb.buf)
+		}
+		c := copy(p[n:], rb.buf[rb.head:end])
+		rb.head = (rb.head + c) % len(rb.buf)
+		rb.size -= c
+		n += c
+	}
+	rb.cond.Broadcast()
+	return n, nil
+}
+
+// stop 对应 ring_buffer_stop，通知读端没有更多数据
+func (rb *ringBuffer) stop() {
+	rb.fail(nil)
+}
+
+// fail 停止缓冲区并记录错误
+func (rb *ringBuffer) fail(err error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if rb.running {
+		rb.running = false
+		rb.err = err
+	}
+	rb.cond.Broadcast()
+}
+
+// blockFrames 对应交叉读取共享内存中的块区：文件按 256 KiB 分块，
+// 由多个 worker 并发填充，读端按块序号顺序取出
+type blockFrames struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	blocks  [][]byte // 未就绪的块为 nil
+	next    int      // 下一个要读取的块
+	off     int      // 当前块内已读取的偏移
+	stopped bool
+	err     error
+}
+
+func newBlockFrames(n int) *blockFrames {
+	f := &blockFrames{blocks: make([][]byte, n)}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// put 放入第 i 块，读端已经停止时返回 false
+func (f *blockFrames) put(i int, b []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stopped {
+		return false
+	}
+	f.blocks[i] = b
+	f.cond.Broadcast()
+	return true
+}
+
+// fail 记录 worker 的错误，读端读到出错的块时返回
+func (f *blockFrames) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err == nil {
+		f.err = err
+	}
+	f.cond.Broadcast()
+}
+
+// stop 停止读取，之后的 put 都会被丢弃
+func (f *blockFrames) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = true
+	f.blocks = nil
+	f.cond.Broadcast()
+}
+
+// read 按顺序读取已就绪的块，全部读完后返回 io.EOF
+func (f *blockFrames) read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if f.stopped {
+			return n, ErrBufferStopped
+		}
+		if f.next == len(f.blocks) {
+			break
+		}
+		b := f.blocks[f.next]
+		if b == nil {
+			if n > 0 {
+				break
+			}
+			if f.err != nil {
+				return 0, f.err
+			}
+			f.cond.Wait()
+			continue
+		}
+		c := copy(p[n:], b[f.off:])
+		n += c
+		f.off += c
+		if f.off == len(b) {
+			f.blocks[f.next] = nil
+			f.next++
+			f.off = 0
+		}
+	}
+	if n == 0 && f.next == len(f.blocks) {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// take 取出下一个块中还没有读出的部分，没有就绪时等待，全部读完后返回 io.EOF。
+// 取出的块不再由 blockFrames 引用，可以直接交给 io.Writer
+func (f *blockFrames) take() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for {
+		if f.stopped {
+			return nil, ErrBufferStopped
+		}
+		if f.next == len(f.blocks) {
+			return nil, io.EOF
+		}
+		b := f.blocks[f.next]
+		if b == nil {
+			if f.err != nil {
+				return nil, f.err
+			}
+			f.cond.Wait()
+			continue
+		}
+		b = b[f.off:]
+		f.blocks[f.next] = nil
+		f.next++
+		f.off = 0
+		return b, nil
+	}
+}
@@ -0,0 +1,114 @@
+package ipfsKeystoneTest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// availableShm 估计还能创建的 System V 共享内存字节数：取 shmmax、shmall 减去已经
+// 使用的部分、MemAvailable 三者中最小的一个，都读不到时返回 -1
+func availableShm() int64 {
+	avail := int64(-1)
+	limit := func(n int64) {
+		if n >= 0 && (avail < 0 || n < avail) {
+			avail = n
+		}
+	}
+
+	if max, err := readProcInt("/proc/sys/kernel/shmmax"); err == nil {
+		limit(max)
+	}
+	if all, err := readProcInt("/proc/sys/kernel/shmall"); err == nil {
+		total := all * int64(os.Getpagesize())
+		if total/int64(os.Getpagesize()) != all {
+			total = -1 // 默认值很大，乘法溢出时视为没有限制
+		}
+		if total >= 0 {
+			limit(total - usedShm())
+		}
+	}
+	if mem, err := memAvailable(); err == nil {
+		limit(mem)
+	}
+	return avail
+}
+
+func readProcInt(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// usedShm 累加 /proc/sysvipc/shm 中所有共享内存段的大小
+func usedShm() int64 {
+	f, err := os.Open("/proc/sysvipc/shm")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var used int64
+	sc := bufio.NewScanner(f)
+	sc.Scan() // 表头
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			used += n
+		}
+	}
+	return used
+}
+
+// memAvailable 返回 /proc/meminfo 中的 MemAvailable
+func memAvailable() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	return 0, os.ErrNotExist
+}
+
+// anonShmSeq 让同一个进程创建的共享内存名字不同
+var anonShmSeq atomic.Uint64
+
+// spoolAnonShm 把 r 的 size 字节明文复制到 /dev/shm 中已经删除名字的文件。
+// 多个 enclave 子进程按块的偏移读取源文件，不能从管道读取，明文先放在内存中，不写到磁盘
+func spoolAnonShm(name string, r io.Reader, size int64) (*os.File, error) {
+	path := fmt.Sprintf("/dev/shm/ipfs-keystone-%s-%d-%d", name, os.Getpid(), anonShmSeq.Add(1))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+
+	in := newPlainInput(r, size)
+	defer in.Close()
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package ipfsKeystoneTest
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// 其他系统上不检查共享内存，由创建共享内存时返回 ErrShmCreate
+func availableShm() int64 { return -1 }
+
+func spoolAnonShm(name string, r io.Reader, size int64) (*os.File, error) {
+	return nil, errors.New("encrypting an io.Reader with several enclaves is only supported on linux")
+}
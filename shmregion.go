@@ -0,0 +1,64 @@
+package ipfsKeystoneTest
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// ShmRegion 是映射到当前进程的一段共享内存。长度用 int64 表示，
+// 通过 unsafe.Slice 访问，不再受 (*[1 << 32]byte) 转换的 4 GiB 限制
+type ShmRegion struct {
+	addr unsafe.Pointer
+	size int64
+}
+
+// newShmRegion 检查 C 函数返回的地址并创建 ShmRegion。shmat 失败时返回 (void*)-1，
+// 其他函数失败时返回 NULL，两种情况都返回包装了 ErrShmCreate 的错误，what 是出错的 C 函数
+func newShmRegion(addr unsafe.Pointer, size int64, what string) (ShmRegion, error) {
+	switch {
+	case addr == nil:
+		return ShmRegion{}, shmCreateError(fmt.Errorf("%s returned NULL", what))
+	case uintptr(addr) == ^uintptr(0):
+		return ShmRegion{}, shmCreateError(fmt.Errorf("%s returned (void*)-1", what))
+	case size <= 0:
+		return ShmRegion{}, shmCreateError(fmt.Errorf("%s: invalid size %d", what, size))
+	case uint64(size) > math.MaxInt:
+		return ShmRegion{}, shmCreateError(fmt.Errorf("%s: size %d does not fit in the address space", what, size))
+	}
+	return ShmRegion{addr: addr, size: size}, nil
+}
+
+// newShmRegionU 与 newShmRegion 相同，长度是 C 函数使用的 unsigned long long
+func newShmRegionU(addr unsafe.Pointer, size uint64, what string) (ShmRegion, error) {
+	if size > math.MaxInt64 {
+		return ShmRegion{}, shmCreateError(fmt.Errorf("%s: size %d overflows int64", what, size))
+	}
+	return newShmRegion(addr, int64(size), what)
+}
+
+// Ptr 返回共享内存的起始地址，用于传给 C 函数
+func (r ShmRegion) Ptr() unsafe.Pointer { return r.addr }
+
+// Size 返回共享内存的长度
+func (r ShmRegion) Size() int64 { return r.size }
+
+// Valid 判断 r 是否指向一段共享内存
+func (r ShmRegion) Valid() bool { return r.addr != nil }
+
+// Bytes 返回整段共享内存的切片，切片的生命周期不能超过共享内存的连接
+func (r ShmRegion) Bytes() []byte {
+	if r.addr == nil {
+		return nil
+	}
+	return unsafe.Slice((*byte)(r.addr), int(r.size))
+}
+
+// shmHeader 把共享内存开头解释为头部结构体 T，共享内存比 T 小时返回 nil
+func shmHeader[T any](r ShmRegion) *T {
+	var zero T
+	if r.addr == nil || int64(unsafe.Sizeof(zero)) > r.size {
+		return nil
+	}
+	return (*T)(r.addr)
+}
@@ -0,0 +1,33 @@
+//go:build keystone
+
+package ipfsKeystoneTest
+
+// #include "ipfs_keystone.h"
+import "C"
+
+// 共享内存开头的头部结构体，由 libipfs_keystone.a 定义。
+// 共享内存的长度都包含头部，返回 nil 说明共享内存的长度算错了
+
+func (r ShmRegion) multiProcessHeader() *C.MultiProcessSHMBuffer {
+	return shmHeader[C.MultiProcessSHMBuffer](r)
+}
+
+func (r ShmRegion) crossHeader() *C.MultiProcessCrossSHMBuffer {
+	return shmHeader[C.MultiProcessCrossSHMBuffer](r)
+}
+
+func (r ShmRegion) crossFlexibleHeader() *C.MultiProcessCrossFlexibleSHMBuffer {
+	return shmHeader[C.MultiProcessCrossFlexibleSHMBuffer](r)
+}
+
+func (r ShmRegion) dispatchHeader() *C.MultiProcessTEEDispatchSHMBuffer {
+	return shmHeader[C.MultiProcessTEEDispatchSHMBuffer](r)
+}
+
+func (r ShmRegion) dirFlexibleHeader() *C.TheNewDirMultiProcessCrossFlexibleSHMBufferJustCall {
+	return shmHeader[C.TheNewDirMultiProcessCrossFlexibleSHMBufferJustCall](r)
+}
+
+func (r ShmRegion) dirFlexibleFileHeader() *C.TheNewDirMultiProcessCrossFlexibleSHMBufferReader {
+	return shmHeader[C.TheNewDirMultiProcessCrossFlexibleSHMBufferReader](r)
+}